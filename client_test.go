@@ -0,0 +1,212 @@
+package jobserver_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/server"
+	"github.com/Sirupsen/logrus"
+)
+
+// startServer starts a server with a TCP listener on addr, and returns the
+// address it's listening on. Unlike jobservertest, the server can be stopped
+// and another started in its place.
+func startServer(t *testing.T, addr string) (*server.Server, string) {
+	st, err := server.Backends[server.DefaultBackend].Open(filepath.Join(t.TempDir(), "jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		st.Close()
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.Out = ioutil.Discard
+
+	s := server.New(st)
+	s.SetLogger(l)
+	s.AddListener(ln)
+
+	go s.Serve()
+
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		st.Close()
+	})
+
+	return s, ln.Addr().String()
+}
+
+// silentListener accepts TCP connections and never answers anything sent on
+// them. Connections it's accepted are sent on the returned channel.
+func silentListener(t *testing.T) (string, chan net.Conn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			conns <- c
+		}
+	}()
+
+	return ln.Addr().String(), conns
+}
+
+func TestClientClose(t *testing.T) {
+	addr, _ := silentListener(t)
+
+	c, err := jobserver.DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(time.Minute)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Ping()
+		errs <- err
+	}()
+
+	// give the ping time to be sent
+	time.Sleep(time.Millisecond * 50)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != jobserver.ErrClosed {
+			t.Fatalf("in-flight ping got %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight ping was still waiting after the client was closed")
+	}
+
+	if _, err := c.Ping(); err != jobserver.ErrClosed {
+		t.Fatalf("ping after closing got %v, want ErrClosed", err)
+	}
+	if err := c.Err(); err != jobserver.ErrClosed {
+		t.Fatalf("Err is %v, want ErrClosed", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("closing again got %v", err)
+	}
+}
+
+func TestClientConnectionDropped(t *testing.T) {
+	addr, conns := silentListener(t)
+
+	c, err := jobserver.DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(time.Minute)
+
+	if err := c.Err(); err != nil {
+		t.Fatalf("Err is %v before anything went wrong", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Ping()
+		errs <- err
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	(<-conns).Close()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(*jobserver.ConnectionError); !ok {
+			t.Fatalf("in-flight ping got %v, want a ConnectionError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight ping was still waiting after the connection dropped")
+	}
+
+	eventually(t, "Err to report the dropped connection", func() bool { return c.Err() != nil })
+
+	if err := c.Err(); err == jobserver.ErrClosed {
+		t.Fatal("Err is ErrClosed, but the client wasn't closed")
+	}
+	if _, err := c.Ping(); err == nil {
+		t.Fatal("ping worked after the connection dropped")
+	} else if _, ok := err.(*jobserver.ConnectionError); !ok {
+		t.Fatalf("ping after the connection dropped got %v, want a ConnectionError", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	s, addr := startServer(t, "127.0.0.1:0")
+
+	c, err := jobserver.DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReconnect(time.Millisecond*10, time.Millisecond*50)
+
+	failures := make(chan error, 100)
+	c.SetErrorHandler(func(err error) {
+		select {
+		case failures <- err:
+		default:
+		}
+	})
+
+	if err := c.Put("q", "a", "x", 0, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Shutdown(context.Background())
+
+	select {
+	case <-failures:
+	case <-time.After(time.Second):
+		t.Fatal("error handler wasn't called when the server stopped")
+	}
+
+	// while the server's down, requests fail, but the client isn't broken
+	if _, err := c.Ping(); err == nil {
+		t.Fatal("ping worked while the server was down")
+	} else if _, ok := err.(*jobserver.ConnectionError); !ok {
+		t.Fatalf("ping while the server was down got %v, want a ConnectionError", err)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("Err is %v while reconnecting", err)
+	}
+
+	startServer(t, addr)
+
+	eventually(t, "the client to reconnect", func() bool {
+		_, err := c.Ping()
+		return err == nil
+	})
+
+	if err := c.Put("q", "b", "x", 0, time.Now(), time.Minute); err != nil {
+		t.Fatalf("put after reconnecting: %v", err)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("Err is %v after reconnecting", err)
+	}
+}
@@ -0,0 +1,455 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoServers = errors.New("no healthy servers")
+)
+
+// Failover orders decide which server a Cluster uses. With FailoverPriority,
+// it's the first healthy server in the order they were given, and the cluster
+// goes back to an earlier server as soon as it's healthy again. With
+// FailoverRandom, it's any healthy server, and the cluster sticks with it
+// until it fails.
+const (
+	FailoverPriority = "priority"
+	FailoverRandom   = "random"
+)
+
+// ServerStatus is what a Cluster knows about one of its servers.
+type ServerStatus struct {
+	Addr    string
+	Healthy bool
+	Active  bool
+	// Err is the last thing that went wrong with the server, if anything.
+	Err error
+}
+
+type clusterServer struct {
+	addr     string
+	c        *Client
+	healthy  bool
+	failures int
+	err      error
+}
+
+// Cluster sends requests to one of several servers, and moves on to another
+// if it stops responding. It pings every server regularly to see which ones
+// are healthy.
+//
+// The servers don't share jobs. A job stays on the server it was put on, so
+// Delete and Release look for jobs on every healthy server if the active one
+// doesn't have them.
+type Cluster struct {
+	m           sync.RWMutex
+	servers     []*clusterServer
+	active      *clusterServer
+	dial        func(addr string) (*Client, error)
+	order       string
+	maxFailures int
+	interval    time.Duration
+	reset       chan struct{}
+	done        chan struct{}
+}
+
+// NewCluster makes a cluster of the servers at addrs. dial connects to each of
+// them, and can set up the clients with keys, timeouts and so on; if it's
+// nil, Dial is used. Servers that can't be connected to yet are tried again
+// with each health check.
+//
+// By default, servers are used in priority order, a server is given up on
+// after 3 requests in a row time out, and health checks run every 5 seconds.
+func NewCluster(addrs []string, dial func(addr string) (*Client, error)) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoServers
+	}
+
+	if dial == nil {
+		dial = Dial
+	}
+
+	c := Cluster{
+		dial:        dial,
+		order:       FailoverPriority,
+		maxFailures: 3,
+		interval:    time.Second * 5,
+		reset:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	for _, addr := range addrs {
+		s := clusterServer{addr: addr}
+
+		if s.c, s.err = dial(addr); s.err == nil {
+			s.healthy = true
+		}
+
+		c.servers = append(c.servers, &s)
+	}
+
+	c.pick()
+
+	go c.run()
+
+	return &c, nil
+}
+
+// SetOrder sets the failover order, which is FailoverPriority or
+// FailoverRandom.
+func (c *Cluster) SetOrder(order string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.order = order
+	c.active = nil
+	c.pick()
+}
+
+// SetMaxFailures sets how many requests to a server have to time out or fail
+// to connect in a row before the cluster moves on to another server.
+func (c *Cluster) SetMaxFailures(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	c.m.Lock()
+	c.maxFailures = n
+	c.m.Unlock()
+}
+
+// SetCheckInterval sets how often every server is pinged. The next check is
+// d from when it's called.
+func (c *Cluster) SetCheckInterval(d time.Duration) {
+	c.m.Lock()
+	c.interval = d
+	c.m.Unlock()
+
+	select {
+	case c.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Active returns the address of the server that requests are going to, or an
+// empty string if none of them are healthy.
+func (c *Cluster) Active() string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	if c.active == nil {
+		return ""
+	}
+
+	return c.active.addr
+}
+
+// Servers returns the status of every server, in the order they were given.
+func (c *Cluster) Servers() []ServerStatus {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	var l []ServerStatus
+	for _, s := range c.servers {
+		l = append(l, ServerStatus{
+			Addr:    s.addr,
+			Healthy: s.healthy,
+			Active:  s == c.active,
+			Err:     s.err,
+		})
+	}
+
+	return l
+}
+
+// Close stops the health checks and closes the connections to every server.
+func (c *Cluster) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	default:
+		close(c.done)
+	}
+
+	for _, s := range c.servers {
+		if s.c != nil {
+			s.c.Close()
+		}
+	}
+
+	return nil
+}
+
+// pick chooses the active server. The caller has to hold c.m.
+func (c *Cluster) pick() {
+	if c.order == FailoverRandom && c.active != nil && c.active.healthy {
+		return
+	}
+
+	var healthy []*clusterServer
+	for _, s := range c.servers {
+		if s.healthy {
+			healthy = append(healthy, s)
+		}
+	}
+
+	switch {
+	case len(healthy) == 0:
+		c.active = nil
+	case c.order == FailoverRandom:
+		c.active = healthy[rand.Intn(len(healthy))]
+	default:
+		c.active = healthy[0]
+	}
+}
+
+// run checks every server's health until the cluster is closed.
+func (c *Cluster) run() {
+	for {
+		c.m.RLock()
+		interval := c.interval
+		c.m.RUnlock()
+
+		t := time.NewTimer(interval)
+
+		select {
+		case <-t.C:
+		case <-c.reset:
+			t.Stop()
+			continue
+		case <-c.done:
+			t.Stop()
+			return
+		}
+
+		c.check()
+	}
+}
+
+// check pings every server at once, connecting again to the ones whose
+// clients have stopped working, and picks the active server again.
+func (c *Cluster) check() {
+	c.m.RLock()
+	servers := c.servers
+	c.m.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *clusterServer) {
+			defer wg.Done()
+
+			c.m.RLock()
+			cl := s.c
+			c.m.RUnlock()
+
+			if cl == nil || cl.Err() != nil {
+				if cl != nil {
+					cl.Close()
+				}
+
+				var err error
+				if cl, err = c.dial(s.addr); err != nil {
+					c.m.Lock()
+					s.c, s.healthy, s.err = nil, false, err
+					c.m.Unlock()
+					return
+				}
+			}
+
+			_, err := cl.Ping()
+
+			c.m.Lock()
+			defer c.m.Unlock()
+
+			select {
+			case <-c.done:
+				cl.Close()
+				return
+			default:
+			}
+
+			s.c, s.healthy = cl, err == nil
+			if err == nil {
+				s.failures = 0
+			} else {
+				s.err = err
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	c.m.Lock()
+	c.pick()
+	c.m.Unlock()
+}
+
+// record keeps track of how requests to a server go, and fails over to
+// another server if too many time out or fail to connect in a row.
+func (c *Cluster) record(s *clusterServer, err error) {
+	_, connErr := err.(*ConnectionError)
+	if err != nil && err != ErrTimeout && !connErr {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if err == nil {
+		s.failures = 0
+		return
+	}
+
+	s.err = err
+	if s.failures++; s.failures >= c.maxFailures {
+		s.healthy = false
+
+		if c.active == s {
+			c.pick()
+		}
+	}
+}
+
+// Do calls fn with the client for the active server. If the request that fn
+// makes times out or fails to connect, that counts towards giving up on the
+// server, but the request isn't sent to another server, since it might have
+// made it to this one anyway.
+func (c *Cluster) Do(fn func(cl *Client) error) error {
+	c.m.RLock()
+	s := c.active
+	var cl *Client
+	if s != nil {
+		cl = s.c
+	}
+	c.m.RUnlock()
+
+	if cl == nil {
+		return ErrNoServers
+	}
+
+	err := fn(cl)
+
+	c.record(s, err)
+
+	return err
+}
+
+// everywhere is Do, but if the active server returns ErrNotFound, fn is tried
+// with every other healthy server too.
+func (c *Cluster) everywhere(fn func(cl *Client) error) error {
+	c.m.RLock()
+	active := c.active
+	c.m.RUnlock()
+
+	if err := c.Do(fn); err != ErrNotFound {
+		return err
+	}
+
+	var servers []*clusterServer
+	var clients []*Client
+
+	c.m.RLock()
+	for _, s := range c.servers {
+		if s != active && s.healthy && s.c != nil {
+			servers = append(servers, s)
+			clients = append(clients, s.c)
+		}
+	}
+	c.m.RUnlock()
+
+	for i, s := range servers {
+		err := fn(clients[i])
+
+		c.record(s, err)
+
+		if err != ErrNotFound {
+			return err
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (c *Cluster) Put(queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.PutContext(context.Background(), queue, id, content, priority, holdUntil, ttr)
+}
+
+// PutContext is Put, but gives up when ctx is done.
+func (c *Cluster) PutContext(ctx context.Context, queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.Do(func(cl *Client) error {
+		return cl.PutContext(ctx, queue, id, content, priority, holdUntil, ttr)
+	})
+}
+
+func (c *Cluster) PutJob(j *Job, conflict string) error {
+	return c.PutJobContext(context.Background(), j, conflict)
+}
+
+// PutJobContext is PutJob, but gives up when ctx is done.
+func (c *Cluster) PutJobContext(ctx context.Context, j *Job, conflict string) error {
+	return c.Do(func(cl *Client) error {
+		return cl.PutJobContext(ctx, j, conflict)
+	})
+}
+
+func (c *Cluster) Reserve(queue string) (*Job, error) {
+	return c.ReserveContext(context.Background(), queue)
+}
+
+// ReserveContext is Reserve, but gives up when ctx is done.
+func (c *Cluster) ReserveContext(ctx context.Context, queue string) (*Job, error) {
+	var j *Job
+	err := c.Do(func(cl *Client) error {
+		var err error
+		j, err = cl.ReserveContext(ctx, queue)
+		return err
+	})
+
+	return j, err
+}
+
+func (c *Cluster) Peek(queue string) (*Job, error) {
+	return c.PeekContext(context.Background(), queue)
+}
+
+// PeekContext is Peek, but gives up when ctx is done.
+func (c *Cluster) PeekContext(ctx context.Context, queue string) (*Job, error) {
+	var j *Job
+	err := c.Do(func(cl *Client) error {
+		var err error
+		j, err = cl.PeekContext(ctx, queue)
+		return err
+	})
+
+	return j, err
+}
+
+func (c *Cluster) Delete(queue, id string) error {
+	return c.DeleteContext(context.Background(), queue, id)
+}
+
+// DeleteContext is Delete, but gives up when ctx is done.
+func (c *Cluster) DeleteContext(ctx context.Context, queue, id string) error {
+	return c.everywhere(func(cl *Client) error {
+		return cl.DeleteContext(ctx, queue, id)
+	})
+}
+
+func (c *Cluster) Release(queue, id string, priority float64, holdUntil time.Time) error {
+	return c.ReleaseContext(context.Background(), queue, id, priority, holdUntil)
+}
+
+// ReleaseContext is Release, but gives up when ctx is done.
+func (c *Cluster) ReleaseContext(ctx context.Context, queue, id string, priority float64, holdUntil time.Time) error {
+	return c.everywhere(func(cl *Client) error {
+		return cl.ReleaseContext(ctx, queue, id, priority, holdUntil)
+	})
+}
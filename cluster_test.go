@@ -0,0 +1,173 @@
+package jobserver_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+// testCluster starts n servers and makes a cluster of them. The cluster's
+// clients are returned too, so that tests can make them fail.
+func testCluster(t *testing.T, n int) (*jobserver.Cluster, []*jobservertest.Server, map[string]*jobserver.Client) {
+	var servers []*jobservertest.Server
+	var addrs []string
+	for i := 0; i < n; i++ {
+		s := jobservertest.New(t)
+		servers = append(servers, s)
+		addrs = append(addrs, s.Addr)
+	}
+
+	var m sync.Mutex
+	clients := make(map[string]*jobserver.Client)
+
+	c, err := jobserver.NewCluster(addrs, func(addr string) (*jobserver.Client, error) {
+		cl, err := jobserver.Dial(addr)
+		if err == nil {
+			m.Lock()
+			clients[addr] = cl
+			m.Unlock()
+		}
+
+		return cl, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c, servers, clients
+}
+
+func TestClusterFailover(t *testing.T) {
+	c, servers, clients := testCluster(t, 2)
+	a, b := servers[0].Addr, servers[1].Addr
+
+	c.SetMaxFailures(3)
+
+	if c.Active() != a {
+		t.Fatalf("active server is %q, want the first one %q", c.Active(), a)
+	}
+
+	// every request to the first server times out
+	clients[a].SetTimeout(time.Nanosecond)
+
+	for i := 0; i < 3; i++ {
+		if c.Active() != a {
+			t.Fatalf("failed over after %d failures", i)
+		}
+
+		if _, err := c.Peek("q"); err != jobserver.ErrTimeout {
+			t.Fatalf("request %d got %v, want a timeout", i, err)
+		}
+	}
+
+	if c.Active() != b {
+		t.Fatalf("active server is %q after 3 failures, want %q", c.Active(), b)
+	}
+	if err := c.Put("q", "j", "x", 0, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	servers[1].AssertJobs("q", "j")
+
+	// once pings get through, the first server's used again
+	clients[a].SetTimeout(time.Second)
+	c.SetCheckInterval(time.Millisecond * 10)
+
+	eventually(t, "the first server to recover", func() bool { return c.Active() == a })
+
+	for _, st := range c.Servers() {
+		if !st.Healthy {
+			t.Errorf("server %s isn't healthy after recovering", st.Addr)
+		}
+	}
+}
+
+func TestClusterRandom(t *testing.T) {
+	c, servers, clients := testCluster(t, 3)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		c.SetOrder(jobserver.FailoverRandom)
+		seen[c.Active()] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("random order always picked %v", seen)
+	}
+
+	// make sure it's not the first server, which priority order would go
+	// back to
+	for c.Active() == servers[0].Addr {
+		c.SetOrder(jobserver.FailoverRandom)
+	}
+
+	first := c.Active()
+
+	c.SetMaxFailures(1)
+	clients[first].SetTimeout(time.Nanosecond)
+
+	if _, err := c.Peek("q"); err != jobserver.ErrTimeout {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	second := c.Active()
+	if second == first || second == "" {
+		t.Fatalf("active server is %q after %q failed", second, first)
+	}
+
+	// it sticks with the new server, even once the old one recovers
+	clients[first].SetTimeout(time.Second)
+	c.SetCheckInterval(time.Millisecond * 10)
+
+	eventually(t, "the failed server to recover", func() bool {
+		for _, st := range c.Servers() {
+			if st.Addr == first {
+				return st.Healthy
+			}
+		}
+
+		return false
+	})
+
+	time.Sleep(time.Millisecond * 50)
+
+	if c.Active() != second {
+		t.Fatalf("active server moved from %q to %q", second, c.Active())
+	}
+}
+
+func TestClusterEverywhere(t *testing.T) {
+	c, servers, _ := testCluster(t, 2)
+	a, b := servers[0], servers[1]
+
+	if c.Active() != a.Addr {
+		t.Fatalf("active server is %q, want %q", c.Active(), a.Addr)
+	}
+
+	// the jobs are on the server that isn't active
+	for _, id := range []string{"x", "y"} {
+		if err := b.Client().Put("q", id, id, 0, b.Now(), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Release("q", "x", 5, b.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("releasing a job on the other server: %v", err)
+	}
+	if err := c.Delete("q", "y"); err != nil {
+		t.Fatalf("deleting a job on the other server: %v", err)
+	}
+
+	b.AssertJobs("q", "x")
+	b.AssertHeld("q", "x")
+
+	if err := c.Delete("q", "z"); err != jobserver.ErrNotFound {
+		t.Fatalf("deleting a job that's nowhere got %v", err)
+	}
+
+	if c.Active() != a.Addr {
+		t.Fatalf("active server moved to %q", c.Active())
+	}
+}
@@ -0,0 +1,114 @@
+package main // import "fknsrs.biz/p/jobserver/cmd/jobserverc"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+// exportedJob is the format of each line written by export and read by
+// import. Times are in seconds, and content is encoded, the same way as on the
+// wire. JSON strings can't hold content that isn't UTF-8, so that's written
+// as base64, and content_encoding says so.
+type exportedJob struct {
+	ID              string  `json:"id"`
+	Queue           string  `json:"queue"`
+	Priority        float64 `json:"priority"`
+	HoldUntil       int64   `json:"hold_until"`
+	TTR             uint64  `json:"ttr"`
+	ContentType     string  `json:"content_type,omitempty"`
+	ContentEncoding string  `json:"content_encoding,omitempty"`
+	Content         string  `json:"content"`
+}
+
+func exportJobs(c *jobserver.Client, w io.Writer, queue, state string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	n := 0
+	after := ""
+	for {
+		j, err := c.Scan(queue, state, after)
+		if err == jobserver.ErrNoJobs {
+			break
+		} else if err != nil {
+			return n, err
+		}
+
+		encoding, content := protocol.EncodeContent(j.Content)
+
+		if err := enc.Encode(exportedJob{
+			ID:              j.ID,
+			Queue:           j.Queue,
+			Priority:        j.Priority,
+			HoldUntil:       j.HoldUntil.Unix(),
+			TTR:             uint64(j.TTR / time.Second),
+			ContentType:     j.ContentType,
+			ContentEncoding: encoding,
+			Content:         content,
+		}); err != nil {
+			return n, err
+		}
+
+		n++
+		after = j.ID
+	}
+
+	return n, bw.Flush()
+}
+
+// importRetry is how puts are sent again during an import. Over UDP, a
+// client doesn't send requests again by default, so one lost datagram would
+// stop an import partway through. Puts that fail if the job exists are only
+// sent again while the server remembers its response to the first try, so a
+// put whose response was lost isn't reported as a conflict.
+var importRetry = jobserver.ExponentialRetry(time.Second, time.Second*10, 5)
+
+func importJobs(c *jobserver.Client, r io.Reader, conflict string, progress int) (int, error) {
+	c.SetOpRetryPolicy(jobserver.OpPut, importRetry)
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	before := time.Now()
+
+	n := 0
+	for {
+		var j exportedJob
+		if err := dec.Decode(&j); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("job %d: %s", n+1, err.Error())
+		}
+
+		content, err := protocol.DecodeContent(j.ContentEncoding, j.Content)
+		if err != nil {
+			return n, fmt.Errorf("job %d (%s): %s", n+1, j.ID, err.Error())
+		}
+
+		if err := c.PutJob(&jobserver.Job{
+			ID:          j.ID,
+			Queue:       j.Queue,
+			Priority:    j.Priority,
+			HoldUntil:   time.Unix(j.HoldUntil, 0),
+			TTR:         time.Duration(j.TTR) * time.Second,
+			ContentType: j.ContentType,
+			Content:     content,
+		}, conflict); err != nil {
+			return n, fmt.Errorf("job %d (%s): %s", n+1, j.ID, err.Error())
+		}
+
+		n++
+
+		if progress > 0 && n%progress == 0 {
+			fmt.Fprintf(os.Stderr, "imported %d jobs (%.0f/s)\n", n, float64(n)/time.Now().Sub(before).Seconds())
+		}
+	}
+
+	return n, nil
+}
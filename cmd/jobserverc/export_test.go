@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+// exportTestJobs puts some jobs to s, including one whose content isn't
+// UTF-8, and returns them.
+func exportTestJobs(t *testing.T, s *jobservertest.Server) []*jobserver.Job {
+	now := s.Now().Truncate(time.Second)
+
+	jobs := []*jobserver.Job{
+		{ID: "bin", Queue: "q", Priority: 1, HoldUntil: now.Add(-time.Minute), TTR: time.Minute, ContentType: "application/octet-stream", Content: "\xff\xfe\x00binary"},
+		{ID: "held", Queue: "other", Priority: 3, HoldUntil: now.Add(time.Hour), TTR: time.Second * 90, Content: "held"},
+		{ID: "text", Queue: "q", Priority: 2, HoldUntil: now.Add(-time.Minute), TTR: time.Minute, ContentType: "text/plain", Content: "text ✓"},
+	}
+
+	for _, j := range jobs {
+		if err := s.Client().PutJob(j, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return jobs
+}
+
+// checkJobs fails the test unless s has exactly the jobs in want.
+func checkJobs(t *testing.T, s *jobservertest.Server, want []*jobserver.Job) {
+	t.Helper()
+
+	got := s.Jobs("", "")
+	if len(got) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(got), len(want))
+	}
+
+	for i, j := range got {
+		w := want[i]
+		if j.ID != w.ID || j.Queue != w.Queue || j.Priority != w.Priority || !j.HoldUntil.Equal(w.HoldUntil) || j.TTR != w.TTR || j.ContentType != w.ContentType || j.Content != w.Content {
+			t.Errorf("got job %#v, want %#v", j, w)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := jobservertest.New(t)
+	jobs := exportTestJobs(t, src)
+
+	var b bytes.Buffer
+	if n, err := exportJobs(src.Client(), &b, "", ""); err != nil || n != len(jobs) {
+		t.Fatalf("exported %d jobs, %v", n, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(jobs) {
+		t.Fatalf("export has %d lines, want %d", len(lines), len(jobs))
+	}
+	if !strings.Contains(lines[0], `"content_encoding":"base64"`) || strings.Contains(lines[2], "content_encoding") {
+		t.Fatalf("only content that isn't UTF-8 should be base64 encoded, got\n%s", b.String())
+	}
+
+	dst := jobservertest.New(t)
+	if n, err := importJobs(dst.Client(), bytes.NewReader(b.Bytes()), "", 0); err != nil || n != len(jobs) {
+		t.Fatalf("imported %d jobs, %v", n, err)
+	}
+
+	checkJobs(t, dst, jobs)
+
+	// filtering by queue and state
+	b.Reset()
+	if n, err := exportJobs(src.Client(), &b, "q", jobserver.StateReady); err != nil || n != 2 {
+		t.Fatalf("exported %d ready jobs from q, %v", n, err)
+	}
+	b.Reset()
+	if n, err := exportJobs(src.Client(), &b, "", jobserver.StateHeld); err != nil || n != 1 || !strings.Contains(b.String(), `"id":"held"`) {
+		t.Fatalf("exported %d held jobs, %v:\n%s", n, err, b.String())
+	}
+}
+
+func TestImportConflict(t *testing.T) {
+	src := jobservertest.New(t)
+	jobs := exportTestJobs(t, src)
+
+	var b bytes.Buffer
+	if _, err := exportJobs(src.Client(), &b, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := jobservertest.New(t)
+
+	// text is already in the destination, with different content, priority
+	// and TTR
+	changed := *jobs[2]
+	changed.Priority, changed.TTR, changed.Content = 9, time.Hour, "changed"
+
+	reset := func() {
+		if err := dst.Client().PutJob(&changed, jobserver.ConflictReplace); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reset()
+	if n, err := importJobs(dst.Client(), bytes.NewReader(b.Bytes()), jobserver.ConflictFail, 0); err == nil || !strings.Contains(err.Error(), "job 3 (text): exists") || n != 2 {
+		t.Fatalf("importing with conflict fail got %d jobs, %v", n, err)
+	}
+	checkJobs(t, dst, []*jobserver.Job{jobs[0], jobs[1], &changed})
+
+	reset()
+	if n, err := importJobs(dst.Client(), bytes.NewReader(b.Bytes()), jobserver.ConflictSkip, 0); err != nil || n != 3 {
+		t.Fatalf("importing with conflict skip got %d jobs, %v", n, err)
+	}
+	checkJobs(t, dst, []*jobserver.Job{jobs[0], jobs[1], &changed})
+
+	// updating changes the priority and TTR, but not the content
+	reset()
+	if n, err := importJobs(dst.Client(), bytes.NewReader(b.Bytes()), jobserver.ConflictUpdate, 0); err != nil || n != 3 {
+		t.Fatalf("importing with conflict update got %d jobs, %v", n, err)
+	}
+	updated := *jobs[2]
+	updated.Content = changed.Content
+	checkJobs(t, dst, []*jobserver.Job{jobs[0], jobs[1], &updated})
+
+	reset()
+	if n, err := importJobs(dst.Client(), bytes.NewReader(b.Bytes()), jobserver.ConflictReplace, 0); err != nil || n != 3 {
+		t.Fatalf("importing with conflict replace got %d jobs, %v", n, err)
+	}
+	checkJobs(t, dst, jobs)
+}
+
+// lossyProxy forwards datagrams between one client and the server at addr.
+// It loses the first request that contains drop or, if response is set, the
+// response to it instead. It returns the address for the client to use.
+func lossyProxy(t *testing.T, addr, drop string, response bool) string {
+	front, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { front.Close() })
+
+	back, err := net.Dial("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { back.Close() })
+
+	client := make(chan net.Addr, 1)
+	key := make(chan string, 1)
+
+	go func() {
+		dropped := false
+
+		d := make([]byte, 65536)
+		for {
+			n, from, err := front.ReadFrom(d)
+			if err != nil {
+				return
+			}
+
+			select {
+			case client <- from:
+			default:
+			}
+
+			if !dropped && bytes.Contains(d[0:n], []byte(drop)) {
+				dropped = true
+
+				if response {
+					key <- strings.Fields(string(d[0:n]))[1] + " "
+				} else {
+					continue
+				}
+			}
+
+			back.Write(d[0:n])
+		}
+	}()
+
+	go func() {
+		to := <-client
+		k := ""
+
+		d := make([]byte, 65536)
+		for {
+			n, err := back.Read(d)
+			if err != nil {
+				return
+			}
+
+			select {
+			case k = <-key:
+			default:
+			}
+
+			if k != "" && bytes.Contains(append(d[0:n:n], ' '), []byte(k)) {
+				k = ""
+				continue
+			}
+
+			front.WriteTo(d[0:n], to)
+		}
+	}()
+
+	return front.LocalAddr().String()
+}
+
+func TestImportLostDatagram(t *testing.T) {
+	defer func(p jobserver.RetryPolicy) { importRetry = p }(importRetry)
+	importRetry = jobserver.ConstantRetry(time.Millisecond*100, 3)
+
+	src := jobservertest.New(t)
+	jobs := exportTestJobs(t, src)
+
+	var b bytes.Buffer
+	if _, err := exportJobs(src.Client(), &b, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		conflict string
+		response bool
+	}{
+		{jobserver.ConflictUpdate, false},
+		{jobserver.ConflictUpdate, true},
+		{jobserver.ConflictFail, false},
+		// the put is sent again after it made it to the server, and the
+		// server's response to the first try means it isn't taken to be a
+		// conflict with itself
+		{jobserver.ConflictFail, true},
+	} {
+		dst := jobservertest.New(t)
+
+		c, err := jobserver.Dial(lossyProxy(t, dst.Addr, "id=text ", tc.response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if n, err := importJobs(c, bytes.NewReader(b.Bytes()), tc.conflict, 0); err != nil || n != len(jobs) {
+			t.Fatalf("importing with conflict %s, losing the response %v, got %d jobs, %v", tc.conflict, tc.response, n, err)
+		}
+
+		checkJobs(t, dst, jobs)
+	}
+}
@@ -1,8 +1,12 @@
 package main // import "fknsrs.biz/p/jobserver/cmd/jobserverc"
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"fknsrs.biz/p/jobserver"
@@ -11,34 +15,72 @@ import (
 )
 
 var (
-	app                 = kingpin.New("jobserverd", "Job server using SQLite as a backend.")
-	addr                = app.Flag("addr", "Address of job server.").Default("127.0.0.1:2097").Envar("ADDR").String()
-	pingCommand         = app.Command("ping", "Ping the job server.")
-	putCommand          = app.Command("put", "Put a job into a queue, or update an existing job.")
-	putCommandQueue     = putCommand.Arg("queue", "Queue to put the job into.").Required().String()
-	putCommandID        = putCommand.Arg("id", "Identifier for the job.").Required().String()
-	putCommandContent   = putCommand.Arg("content", "Content of the job.").Required().String()
-	putCommandPriority  = putCommand.Flag("priority", "Priority of the job.").Default("0").Float64()
-	putCommandHoldUntil = putCommand.Flag("hold_until", "Hold the job until this time.").String()
-	putCommandHoldFor   = putCommand.Flag("hold_for", "Hold the job for this amout of time.").Duration()
-	putCommandTTR       = putCommand.Flag("ttr", "Time-to-run for the job.").Default("5m").Duration()
-	reserveCommand      = app.Command("reserve", "Try to reserve a job from a queue.")
-	reserveCommandQueue = reserveCommand.Arg("queue", "Queue to try to reserve a job from.").Required().String()
-	reserveCommandWait  = reserveCommand.Flag("wait", "Wait for a job to become available.").Bool()
-	peekCommand         = app.Command("peek", "Try to peek a job from a queue.")
-	peekCommandQueue    = peekCommand.Arg("queue", "Queue to try to peek a job from.").Required().String()
-	deleteCommand       = app.Command("delete", "Delete a job.")
-	deleteCommandQueue  = deleteCommand.Arg("queue", "Queue from which to delete a job.").Required().String()
-	deleteCommandID     = deleteCommand.Arg("id", "Identifier of the job to delete.").Required().String()
+	app                       = kingpin.New("jobserverd", "Job server using SQLite as a backend.")
+	addr                      = app.Flag("addr", "Address of job server, as host:port for UDP over IPv4 or a URL like udp6://[::1]:2097, tls://jobs.example.com:2099 or unix:///run/jobserver.sock.").Default("127.0.0.1:2097").Envar("ADDR").String()
+	useTCP                    = app.Flag("tcp", "Connect over TCP instead of UDP.").Envar("TCP").Bool()
+	pingCommand               = app.Command("ping", "Ping the job server.")
+	authKeyFile               = app.Flag("auth_key_file", "Seal messages with the keys in this file.").Envar("AUTH_KEY_FILE").String()
+	tlsCA                     = app.Flag("tls_ca", "Check the server's TLS certificate against the authorities in this file instead of the system's.").Envar("TLS_CA").String()
+	tlsCert                   = app.Flag("tls_cert", "Identify with this TLS certificate, in PEM format.").Envar("TLS_CERT").String()
+	tlsKey                    = app.Flag("tls_key", "Private key for the certificate in --tls_cert, in PEM format.").Envar("TLS_KEY").String()
+	helloCommand              = app.Command("hello", "Show what the job server supports.")
+	putCommand                = app.Command("put", "Put a job into a queue, or update an existing job.")
+	putCommandQueue           = putCommand.Arg("queue", "Queue to put the job into.").Required().String()
+	putCommandID              = putCommand.Arg("id", "Identifier for the job.").Required().String()
+	putCommandContent         = putCommand.Arg("content", "Content of the job.").Required().String()
+	putCommandPriority        = putCommand.Flag("priority", "Priority of the job.").Default("0").Float64()
+	putCommandHoldUntil       = putCommand.Flag("hold_until", "Hold the job until this time.").String()
+	putCommandHoldFor         = putCommand.Flag("hold_for", "Hold the job for this amout of time.").Duration()
+	putCommandTTR             = putCommand.Flag("ttr", "Time-to-run for the job.").Default("5m").Duration()
+	reserveCommand            = app.Command("reserve", "Try to reserve a job from a queue.")
+	reserveCommandQueue       = reserveCommand.Arg("queue", "Queue to try to reserve a job from.").Required().String()
+	reserveCommandWait        = reserveCommand.Flag("wait", "Wait for a job to become available.").Bool()
+	peekCommand               = app.Command("peek", "Try to peek a job from a queue.")
+	peekCommandQueue          = peekCommand.Arg("queue", "Queue to try to peek a job from.").Required().String()
+	deleteCommand             = app.Command("delete", "Delete a job.")
+	deleteCommandQueue        = deleteCommand.Arg("queue", "Queue from which to delete a job.").Required().String()
+	deleteCommandID           = deleteCommand.Arg("id", "Identifier of the job to delete.").Required().String()
+	statsCommand              = app.Command("stats", "Count the ready and held jobs in each queue.")
+	statsCommandQueue         = statsCommand.Arg("queue", "Only count jobs in this queue.").String()
+	exportCommand             = app.Command("export", "Write jobs to a file as JSON lines.")
+	exportCommandQueue        = exportCommand.Flag("queue", "Only export jobs from this queue.").String()
+	exportCommandState        = exportCommand.Flag("state", "Only export jobs in this state.").Enum("ready", "held")
+	exportCommandOutput       = exportCommand.Flag("output", "File to write to, or - for stdout.").Default("-").String()
+	importCommand             = app.Command("import", "Read jobs from a file of JSON lines and put them into the server.")
+	importCommandInput        = importCommand.Arg("input", "File to read from, or - for stdin.").Default("-").String()
+	importCommandConflict     = importCommand.Flag("conflict", "What to do with jobs that already exist.").Default("update").Enum("update", "replace", "skip", "fail")
+	importCommandProgress     = importCommand.Flag("progress", "Report progress after this many jobs.").Default("10000").Int()
+	adminCommand              = app.Command("admin", "Administrative commands.")
+	adminPurgeCommand         = adminCommand.Command("purge", "Delete every job in a queue.")
+	adminPurgeCommandQueue    = adminPurgeCommand.Arg("queue", "Queue to delete every job from.").Required().String()
+	adminBackupCommand        = adminCommand.Command("backup", "Write a consistent snapshot of the database while the server is running.")
+	adminBackupCommandPath    = adminBackupCommand.Arg("path", "Path to write the snapshot to, relative to the server's backup directory.").Required().String()
+	adminBackupCommandTimeout = adminBackupCommand.Flag("timeout", "How long to wait for the backup to finish.").Default("10m").Duration()
 )
 
 func main() {
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	c, err := jobserver.Dial(*addr)
+	dial := jobserver.Dial
+	if *useTCP {
+		dial = jobserver.DialTCP
+	}
+
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		dial = dialTLS
+	}
+
+	c, err := dial(*addr)
 	if err != nil {
 		panic(err)
 	}
+	defer c.Close()
+
+	if *authKeyFile != "" {
+		if err := c.SetKeyFile(*authKeyFile); err != nil {
+			panic(err)
+		}
+	}
 
 	switch cmd {
 	case pingCommand.FullCommand():
@@ -47,6 +89,16 @@ func main() {
 			panic(err)
 		}
 		fmt.Println(d)
+	case helloCommand.FullCommand():
+		info, err := c.Hello()
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("version: %d\n", info.Version)
+		fmt.Printf("types: %s\n", strings.Join(info.Types, ", "))
+		fmt.Printf("max message size: %d\n", info.MaxMessageSize)
+		fmt.Printf("max frame size: %d\n", info.MaxFrameSize)
 	case putCommand.FullCommand():
 		holdUntil := time.Now()
 		switch {
@@ -102,5 +154,91 @@ func main() {
 			}
 			panic(err)
 		}
+	case statsCommand.FullCommand():
+		for after := ""; ; {
+			st, err := c.Stats(*statsCommandQueue, after)
+			if err != nil {
+				if err == jobserver.ErrNoJobs {
+					return
+				}
+				panic(err)
+			}
+
+			fmt.Printf("[%s] ready=%d held=%d\n", st.Queue, st.Ready, st.Held)
+
+			after = st.Queue
+		}
+	case exportCommand.FullCommand():
+		w := os.Stdout
+		if *exportCommandOutput != "-" {
+			f, err := os.Create(*exportCommandOutput)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := exportJobs(c, w, *exportCommandQueue, *exportCommandState)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Fprintf(os.Stderr, "exported %d jobs\n", n)
+	case importCommand.FullCommand():
+		r := os.Stdin
+		if *importCommandInput != "-" {
+			f, err := os.Open(*importCommandInput)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		n, err := importJobs(c, r, *importCommandConflict, *importCommandProgress)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Fprintf(os.Stderr, "imported %d jobs\n", n)
+	case adminPurgeCommand.FullCommand():
+		if err := c.Purge(*adminPurgeCommandQueue); err != nil {
+			panic(err)
+		}
+	case adminBackupCommand.FullCommand():
+		c.SetOpRetryPolicy(jobserver.OpBackup, jobserver.ConstantRetry(*adminBackupCommandTimeout, 0))
+
+		if err := c.Backup(*adminBackupCommandPath); err != nil {
+			panic(err)
+		}
 	}
 }
+
+// dialTLS connects over TLS with the certificates given on the command line.
+func dialTLS(addr string) (*jobserver.Client, error) {
+	var config tls.Config
+
+	if *tlsCA != "" {
+		d, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(d) {
+			return nil, fmt.Errorf("no certificates in %s", *tlsCA)
+		}
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return jobserver.DialTLS(strings.TrimPrefix(addr, "tls://"), &config)
+}
@@ -1,310 +1,241 @@
 package main // import "fknsrs.biz/p/jobserver/cmd/jobserverd"
 
 import (
-	"bytes"
-	"database/sql"
-	"fmt"
+	"context"
 	"net"
 	"os"
-	"time"
-
-	"fknsrs.biz/p/jobserver/internal/protocol"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/server"
 	"github.com/Sirupsen/logrus"
-	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	createTableQuery = `create table if not exists "jobs" ("id" text primary key, "queue" text not null, "priority" float not null, "hold_until" integer not null, "ttr" integer, "content" text not null)`
-	fetchJobQuery    = `select "queue", "priority", "hold_until", "ttr", "content" from "jobs" where "id" = ?`
-	putJobQuery      = `insert into "jobs" ("id", "queue", "priority", "hold_until", "ttr", "content") values (?, ?, ?, ?, ?, ?)`
-	getTopJobQuery   = `select "id", "queue", "priority", "hold_until", "ttr", "content" from "jobs" where "queue" = ? and "hold_until" < ? order by "priority" desc limit 1`
-	reserveJobQuery  = `update "jobs" set "hold_until" = ? + "ttr" where "id" = ?`
-	updateJobQuery   = `update "jobs" set "priority" = ?, "hold_until" = ?, "ttr" = ? where "id" = ?`
-	deleteJobQuery   = `delete from "jobs" where "queue" = ? and "id" = ?`
-	listQueuesQuery  = `select distinct "queue" from "jobs"`
-	queueStatsQuery  = `select "queue", count(1) as "count" from "jobs" group by "queue"`
+	app           = kingpin.New("jobserverd", "Job server with SQLite or append-only log storage.")
+	backendName   = app.Flag("backend", "Storage backend (sqlite or log).").Default(server.DefaultBackend).Envar("BACKEND").String()
+	dbPath        = app.Flag("db_path", "Path to the database.").Default("jobs.db").Envar("DB_PATH").String()
+	addrs         = app.Flag("addr", "Addresses to listen on, separated by commas or given more than once. Addresses are host:port for UDP over IPv4, or URLs like udp6://[::]:2097, tcp://:2098, tls://:2099, unixgram:///run/jobserver.sock or unix:///run/jobserver.sock.").Default(":2097").Envar("ADDR").Strings()
+	socketMode    = app.Flag("socket_mode", "File mode for unix sockets, in octal.").Default("0660").Envar("SOCKET_MODE").String()
+	tcpAddr       = app.Flag("tcp_addr", "Address to listen on for TCP connections. Leave empty to turn TCP off.").Envar("TCP_ADDR").String()
+	httpAddr      = app.Flag("http_addr", "Address to listen on for HTTP requests. Leave empty to turn HTTP off.").Envar("HTTP_ADDR").String()
+	beanstalkAddr = app.Flag("beanstalk_addr", "Address to listen on for beanstalkd clients. Leave empty to turn the beanstalkd protocol off.").Envar("BEANSTALK_ADDR").String()
+	logLevel      = app.Flag("log_level", "Log level").Default("info").Envar("LOG_LEVEL").Enum("debug", "info", "warn", "error")
+	backupDir     = app.Flag("backup_dir", "Directory that clients can write backups to. Leave empty to turn backups off.").Envar("BACKUP_DIR").String()
+
+	shutdownTimeout = app.Flag("shutdown_timeout", "How long to wait for requests to finish when shutting down.").Default("10s").Envar("SHUTDOWN_TIMEOUT").Duration()
+
+	replaySize = app.Flag("replay_size", "Number of recent responses to keep for repeated requests. Requests are turned away while it's full. Zero turns replays off.").Default("100000").Envar("REPLAY_SIZE").Int()
+	replayTTL  = app.Flag("replay_ttl", "How long to keep responses for repeated requests.").Default("1m").Envar("REPLAY_TTL").Duration()
+
+	authKeyFile = app.Flag("auth_key_file", "Only accept messages sealed with the keys in this file, and seal responses with them. This doesn't cover the HTTP or beanstalkd listeners.").Envar("AUTH_KEY_FILE").String()
+	authWindow  = app.Flag("auth_window", "How far a sealed message's time can be from the server's.").Default("30s").Envar("AUTH_WINDOW").Duration()
+	policyFile  = app.Flag("policy_file", "Only allow the requests that the rules in this file allow. Clients are identified by the common name of their TLS certificate, or the ID of the key they authenticate with.").Envar("POLICY_FILE").String()
+
+	tlsCert     = app.Flag("tls_cert", "Certificate for tls:// listeners, in PEM format.").Envar("TLS_CERT").String()
+	tlsKey      = app.Flag("tls_key", "Private key for the certificate in --tls_cert, in PEM format.").Envar("TLS_KEY").String()
+	tlsClientCA = app.Flag("tls_client_ca", "Let clients on tls:// listeners identify themselves with certificates signed by the authorities in this file.").Envar("TLS_CLIENT_CA").String()
+
+	compressThreshold = app.Flag("compress_threshold", "Compress job content of at least this many bytes. Zero turns compression off.").Default("0").Envar("COMPRESS_THRESHOLD").Int()
+	keyFile           = app.Flag("key_file", "Encrypt job content with the keys in this file.").Envar("KEY_FILE").String()
+
+	serveCommand        = app.Command("serve", "Run the job server.").Default()
+	restoreCommand      = app.Command("restore", "Install a database snapshot. The server must not be running.")
+	restoreCommandPath  = restoreCommand.Arg("path", "Path to the snapshot.").Required().ExistingFile()
+	restoreCommandForce = restoreCommand.Flag("force", "Replace the existing database.").Bool()
+
+	compressCommand           = app.Command("compress", "Compress the content of existing jobs. Encrypted jobs need --key_file, and are encrypted again with its primary key. With the log backend, the server must not be running.")
+	compressCommandBatchSize  = compressCommand.Flag("batch_size", "Number of jobs to compress in each batch.").Default("1000").Int()
+	compressCommandBatchDelay = compressCommand.Flag("batch_delay", "Time to wait between batches.").Default("0s").Duration()
+
+	reencryptCommand           = app.Command("reencrypt", "Encrypt the content of existing jobs with the primary key. With the log backend, the server must not be running.")
+	reencryptCommandBatchSize  = reencryptCommand.Flag("batch_size", "Number of jobs to re-encrypt in each batch.").Default("1000").Int()
+	reencryptCommandBatchDelay = reencryptCommand.Flag("batch_delay", "Time to wait between batches.").Default("0s").Duration()
 )
 
-func withTx(db *sql.DB, f func(tx *sql.Tx) error) error {
-	tx, terr := db.Begin()
-	if terr != nil {
-		return terr
+func main() {
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	ll, lerr := logrus.ParseLevel(*logLevel)
+	if lerr != nil {
+		panic(lerr)
 	}
+	logrus.SetLevel(ll)
 
-	done := false
-	defer func() {
-		if !done {
-			tx.Rollback()
+	b, ok := server.Backends[*backendName]
+	if !ok {
+		var names []string
+		for k := range server.Backends {
+			names = append(names, k)
 		}
-	}()
+		sort.Strings(names)
 
-	if err := f(tx); err != nil {
-		rerr := tx.Rollback()
-		done = true
-		return rerr
+		app.Fatalf("unknown backend %q; available backends are %s", *backendName, strings.Join(names, ", "))
 	}
 
-	cerr := tx.Commit()
-	done = true
-	return cerr
-}
-
-func maybePanic(err error) {
-	if err != nil {
-		panic(err)
+	switch cmd {
+	case restoreCommand.FullCommand():
+		restore(b)
+	case compressCommand.FullCommand():
+		compress(b)
+	case reencryptCommand.FullCommand():
+		reencrypt(b)
+	default:
+		serve(b)
 	}
 }
 
-var (
-	app      = kingpin.New("jobserverd", "Job server using SQLite as a backend.")
-	dbPath   = app.Flag("db_path", "Path to SQLite database.").Default("jobs.db").Envar("DB_PATH").String()
-	addr     = app.Flag("addr", "Address to listen on.").Default(":2097").Envar("ADDR").String()
-	logLevel = app.Flag("log_level", "Log level").Default("info").Envar("LOG_LEVEL").Enum("debug", "info", "warn", "error")
-)
-
-func main() {
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+func restore(bk server.Backend) {
+	logrus.WithFields(logrus.Fields{
+		"backend":  *backendName,
+		"db_path":  *dbPath,
+		"snapshot": *restoreCommandPath,
+	}).Info("restoring snapshot")
 
-	ll, lerr := logrus.ParseLevel(*logLevel)
-	if lerr != nil {
-		panic(lerr)
+	if err := bk.Restore(*restoreCommandPath, *dbPath, *restoreCommandForce); err != nil {
+		panic(err)
 	}
-	logrus.SetLevel(ll)
 
+	logrus.Info("restored snapshot")
+}
+
+func serve(bk server.Backend) {
 	logrus.WithFields(logrus.Fields{
-		"db_path":   *dbPath,
-		"addr":      *addr,
-		"log_level": *logLevel,
+		"backend":        *backendName,
+		"db_path":        *dbPath,
+		"addr":           strings.Join(*addrs, ","),
+		"tcp_addr":       *tcpAddr,
+		"http_addr":      *httpAddr,
+		"beanstalk_addr": *beanstalkAddr,
+		"log_level":      *logLevel,
 	}).Info("starting up")
 
 	logrus.WithField("db_path", *dbPath).Debug("opening database")
-	db, dberr := sql.Open("sqlite3", *dbPath)
-	if dberr != nil {
-		panic(dberr)
+	st, err := bk.Open(*dbPath)
+	if err != nil {
+		panic(err)
 	}
-	defer db.Close()
+	defer st.Close()
 	logrus.Debug("opened database")
 
-	logrus.Debug("ensuring tables exist")
-	if _, err := db.Exec(createTableQuery); err != nil {
-		panic(err)
+	if *keyFile != "" {
+		keys, err := keyring.Load(*keyFile)
+		if err != nil {
+			panic(err)
+		}
+
+		logrus.WithField("primary_key", keys.Primary()).Info("encrypting job content")
+
+		st = store.Encrypt(st, keys)
 	}
-	logrus.Debug("tables created")
 
-	logrus.Debug("opening listening socket")
-	s, serr := net.ListenPacket("udp4", *addr)
-	if serr != nil {
-		panic(serr)
+	st = store.Compress(st, *compressThreshold)
+
+	srv := server.New(st)
+	srv.SetReplay(*replaySize, *replayTTL)
+	srv.SetBackupDir(*backupDir)
+
+	if *authKeyFile != "" {
+		if err := srv.SetAuthKeyFile(*authKeyFile, *authWindow); err != nil {
+			panic(err)
+		}
+
+		if *httpAddr != "" || *beanstalkAddr != "" {
+			logrus.Warn("the http and beanstalk listeners don't authenticate requests")
+		}
 	}
-	logrus.Info("listening")
 
-	snum := 1
+	if *policyFile != "" {
+		if err := srv.SetPolicyFile(*policyFile); err != nil {
+			panic(err)
+		}
+	}
 
-	for {
-		logrus.Debug("waiting for incoming message")
+	if *tcpAddr != "" {
+		logrus.Debug("opening tcp listener")
+		ln, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			panic(err)
+		}
+		logrus.WithField("tcp_addr", *tcpAddr).Info("listening on tcp")
+
+		srv.AddListener(ln)
+	}
 
-		b := make([]byte, protocol.MessageSize)
-		n, r, err := s.ReadFrom(b)
+	if *httpAddr != "" {
+		logrus.Debug("opening http listener")
+		ln, err := net.Listen("tcp", *httpAddr)
 		if err != nil {
 			panic(err)
 		}
+		logrus.WithField("http_addr", *httpAddr).Info("listening on http")
 
-		before := time.Now()
+		srv.AddHTTPListener(ln)
+	}
 
-		mnum := snum
-		snum++
+	if *beanstalkAddr != "" {
+		logrus.Debug("opening beanstalk listener")
+		ln, err := net.Listen("tcp", *beanstalkAddr)
+		if err != nil {
+			panic(err)
+		}
+		logrus.WithField("beanstalk_addr", *beanstalkAddr).Info("listening for beanstalk clients")
 
-		l := logrus.WithField("seq", mnum)
+		srv.AddBeanstalkListener(ln)
+	}
 
-		l.WithFields(logrus.Fields{
-			"size":   n,
-			"remote": r.String(),
-		}).Debug("got message")
+	if *tlsCert != "" || *tlsKey != "" {
+		c, err := server.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			panic(err)
+		}
 
-		func() {
-			defer func() {
-				l := l.WithField("measure#duration", time.Now().Sub(before).Seconds()*1000)
+		srv.SetTLSConfig(c)
+	}
 
-				if e := recover(); e != nil {
-					if err, ok := e.(error); ok {
-						l.WithField("error", err.Error()).Error("error processing message")
-					} else {
-						l.WithField("error", e).Error("error processing message")
-					}
-				} else {
-					l.Debug("processed message successfully")
-				}
-			}()
+	mode, merr := strconv.ParseUint(*socketMode, 8, 32)
+	if merr != nil {
+		app.Fatalf("invalid socket mode %q", *socketMode)
+	}
+	srv.SetSocketMode(os.FileMode(mode))
 
-			m, err := protocol.Parse(bytes.TrimSpace(b[0:n]))
-			if err != nil {
+	for _, a := range *addrs {
+		for _, a := range strings.Split(a, ",") {
+			logrus.WithField("addr", a).Debug("opening listening socket")
+			if err := srv.Listen(a); err != nil {
 				panic(err)
 			}
+			logrus.WithField("addr", a).Info("listening")
+		}
+	}
 
-			l = l.WithField("message_key", m.GetKey())
-
-			l.WithField("message_type", fmt.Sprintf("%T", m)).Debug("processing message")
-
-			switch m := m.(type) {
-			case *protocol.PingMessage:
-				if _, err := s.WriteTo(m.Serialise(), r); err != nil {
-					panic(err)
-				}
-			case *protocol.JobMessage:
-				maybePanic(withTx(db, func(tx *sql.Tx) error {
-					if m.HoldUntil == 0 {
-						m.HoldUntil = time.Now().Unix()
-					}
-					if m.TTR == 0 {
-						m.TTR = uint64(time.Hour / time.Second)
-					}
-
-					var queue, content string
-					var priority float64
-					var holdUntil int64
-					var ttr uint64
-					var found bool
-
-					if err := tx.QueryRow(fetchJobQuery, m.ID).Scan(&queue, &priority, &holdUntil, &ttr, &content); err != nil && err != sql.ErrNoRows {
-						return err
-					} else if err == nil {
-						found = true
-					}
-
-					if found == false {
-						if _, err := tx.Exec(putJobQuery, m.ID, m.Queue, m.Priority, m.HoldUntil, m.TTR, m.Content); err != nil {
-							return err
-						}
-
-						d := protocol.Serialise(&protocol.SuccessMessage{Key: m.Key})
-						if _, err := s.WriteTo(d, r); err != nil {
-							return err
-						}
-
-						l.WithFields(logrus.Fields{
-							"queue":               m.Queue,
-							"job_id":              m.ID,
-							"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
-						}).Info("created job")
-					} else {
-						if m.HoldUntil > holdUntil {
-							m.HoldUntil = holdUntil
-						}
-
-						if _, err := tx.Exec(updateJobQuery, m.Priority, m.HoldUntil, m.TTR, m.ID); err != nil {
-							return err
-						}
-
-						d := protocol.Serialise(&protocol.SuccessMessage{Key: m.Key})
-						if _, err := s.WriteTo(d, r); err != nil {
-							return err
-						}
-
-						l.WithFields(logrus.Fields{
-							"queue":               m.Queue,
-							"job_id":              m.ID,
-							"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
-						}).Info("updated job")
-					}
-
-					return nil
-				}))
-			case *protocol.ReserveMessage:
-				maybePanic(withTx(db, func(tx *sql.Tx) error {
-					var id, queue, content string
-					var priority float64
-					var holdUntil int64
-					var ttr uint64
-					if err := tx.QueryRow(getTopJobQuery, m.Queue, time.Now().Unix()).Scan(&id, &queue, &priority, &holdUntil, &ttr, &content); err != nil {
-						if err == sql.ErrNoRows {
-							d := protocol.Serialise(&protocol.ErrorMessage{Key: m.Key, Reason: "empty"})
-							if _, werr := s.WriteTo(d, r); werr != nil {
-								return werr
-							}
-
-							return nil
-						}
-
-						return err
-					}
-
-					if _, err := tx.Exec(reserveJobQuery, time.Now().Unix(), id); err != nil {
-						return err
-					}
-
-					d := protocol.Serialise(&protocol.JobMessage{Key: m.Key, ID: id, Queue: queue, Priority: priority, HoldUntil: holdUntil, TTR: ttr, Content: content})
-					if _, err := s.WriteTo(d, r); err != nil {
-						return err
-					}
-
-					l.WithFields(logrus.Fields{
-						"queue":               m.Queue,
-						"job_id":              id,
-						"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
-					}).Info("dispatched job")
-
-					return nil
-				}))
-			case *protocol.PeekMessage:
-				maybePanic(withTx(db, func(tx *sql.Tx) error {
-					var id, queue, content string
-					var priority float64
-					var holdUntil int64
-					var ttr uint64
-					if err := tx.QueryRow(getTopJobQuery, m.Queue, time.Now().Unix()).Scan(&id, &queue, &priority, &holdUntil, &ttr, &content); err != nil {
-						if err == sql.ErrNoRows {
-							d := protocol.Serialise(&protocol.ErrorMessage{Key: m.Key, Reason: "empty"})
-							if _, werr := s.WriteTo(d, r); werr != nil {
-								return werr
-							}
-
-							return nil
-						}
-
-						return err
-					}
-
-					d := protocol.Serialise(&protocol.JobMessage{Key: m.Key, ID: id, Queue: queue, Priority: priority, HoldUntil: holdUntil, TTR: ttr, Content: content})
-					if _, err := s.WriteTo(d, r); err != nil {
-						return err
-					}
-
-					return nil
-				}))
-			case *protocol.DeleteMessage:
-				maybePanic(withTx(db, func(tx *sql.Tx) error {
-					qr, err := db.Exec(deleteJobQuery, m.Queue, m.ID)
-					if err != nil {
-						return err
-					}
-
-					n, err := qr.RowsAffected()
-					if err != nil {
-						return err
-					}
-
-					if n == 0 {
-						d := protocol.Serialise(&protocol.ErrorMessage{Key: m.Key, Reason: "not found"})
-						if _, err := s.WriteTo(d, r); err != nil {
-							return err
-						}
-					} else {
-						d := protocol.Serialise(&protocol.SuccessMessage{Key: m.Key})
-						if _, err := s.WriteTo(d, r); err != nil {
-							return err
-						}
-					}
-
-					l.WithFields(logrus.Fields{
-						"queue":               m.Queue,
-						"job_id":              m.ID,
-						"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
-					}).Info("deleted job")
-
-					return nil
-				}))
-			}
-		}()
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+		sig := <-ch
+		logrus.WithFields(logrus.Fields{
+			"signal":  sig.String(),
+			"timeout": shutdownTimeout.String(),
+		}).Info("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.WithField("error", err.Error()).Warn("gave up waiting for requests to finish")
+		}
+	}()
+
+	if err := srv.Serve(); err != server.ErrServerClosed {
+		panic(err)
 	}
+
+	logrus.Info("shut down")
 }
@@ -0,0 +1,163 @@
+package main // import "fknsrs.biz/p/jobserver/cmd/jobserverd"
+
+import (
+	"fmt"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/server"
+	"github.com/Sirupsen/logrus"
+)
+
+// rewrite runs fn over the raw content of every job in batches, and writes
+// back the jobs that fn changes. It's how existing jobs are brought in line
+// with new compression and encryption settings. Jobs that are put again while
+// it's running keep their new content.
+func rewrite(bk server.Backend, batchSize int, batchDelay time.Duration, fn func(j *store.Job) (bool, error)) {
+	st, err := bk.Open(*dbPath)
+	if err != nil {
+		panic(err)
+	}
+	defer st.Close()
+
+	var scanned, rewritten, skipped, before, after int
+
+	last := ""
+	for {
+		n := 0
+		for ; n < batchSize; n++ {
+			j, err := st.Scan("", "", last, time.Now())
+			if err == store.ErrEmpty {
+				break
+			} else if err != nil {
+				panic(err)
+			}
+
+			last = j.ID
+			scanned++
+
+			orig := *j
+
+			ok, err := fn(j)
+			if err != nil {
+				panic(err)
+			}
+			if !ok {
+				continue
+			}
+
+			// the job may have been deleted or put again since it was
+			// scanned, in which case it's left as it is now
+			if err := st.SetContent(&orig, j.Content, j.Encoding); err == store.ErrNotFound {
+				skipped++
+				continue
+			} else if err != nil {
+				panic(err)
+			}
+
+			rewritten++
+			before += len(orig.Content)
+			after += len(j.Content)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"scanned":      scanned,
+			"rewritten":    rewritten,
+			"skipped":      skipped,
+			"bytes_before": before,
+			"bytes_after":  after,
+		}).Info("finished batch")
+
+		if n < batchSize {
+			break
+		}
+
+		time.Sleep(batchDelay)
+	}
+}
+
+func compress(bk server.Backend) {
+	if *compressThreshold <= 0 {
+		app.Fatalf("--compress_threshold must be set to compress jobs")
+	}
+
+	// encrypted content doesn't get any smaller, so it has to be decrypted,
+	// compressed, and then encrypted again
+	var keys *keyring.Keyring
+	if *keyFile != "" {
+		k, err := keyring.Load(*keyFile)
+		if err != nil {
+			panic(err)
+		}
+
+		keys = k
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend":            *backendName,
+		"db_path":            *dbPath,
+		"compress_threshold": *compressThreshold,
+	}).Info("compressing jobs")
+
+	rewrite(bk, *compressCommandBatchSize, *compressCommandBatchDelay, func(j *store.Job) (bool, error) {
+		if store.KeyID(j) == "" {
+			return store.CompressContent(j, *compressThreshold)
+		}
+
+		if keys == nil {
+			return false, fmt.Errorf("job %s is encrypted, so --key_file must be set to compress it", j.ID)
+		}
+
+		if _, err := store.DecryptContent(keys, j); err != nil {
+			return false, err
+		}
+
+		if ok, err := store.CompressContent(j, *compressThreshold); err != nil || !ok {
+			return false, err
+		}
+
+		if err := store.EncryptContent(keys, j); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+
+	logrus.Info("finished compressing jobs")
+}
+
+func reencrypt(bk server.Backend) {
+	if *keyFile == "" {
+		app.Fatalf("--key_file must be set to re-encrypt jobs")
+	}
+
+	keys, err := keyring.Load(*keyFile)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend":     *backendName,
+		"db_path":     *dbPath,
+		"primary_key": keys.Primary(),
+	}).Info("re-encrypting jobs")
+
+	rewrite(bk, *reencryptCommandBatchSize, *reencryptCommandBatchDelay, func(j *store.Job) (bool, error) {
+		if store.KeyID(j) == keys.Primary() {
+			return false, nil
+		}
+
+		if _, err := store.DecryptContent(keys, j); err != nil {
+			return false, err
+		}
+
+		if err := store.EncryptContent(keys, j); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+
+	logrus.Info("finished re-encrypting jobs")
+}
@@ -0,0 +1,120 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	ErrUnknownContentType error
+)
+
+// Codec turns values into job content and back. ContentType is recorded on
+// each job put with the codec, so that Decode can find the codec again.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(d []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                     { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(d []byte, v interface{}) error { return json.Unmarshal(d, v) }
+
+// JSON encodes values with encoding/json. It's what clients use unless told
+// otherwise, and what Decode uses for jobs without a content type.
+var JSON Codec = jsonCodec{}
+
+var (
+	codecsM sync.RWMutex
+	codecs  = map[string]Codec{JSON.ContentType(): JSON}
+)
+
+// RegisterCodec makes a codec available to Decode, for jobs with its content
+// type. Registering a codec for a content type that already has one replaces
+// it.
+func RegisterCodec(c Codec) {
+	codecsM.Lock()
+	defer codecsM.Unlock()
+
+	codecs[c.ContentType()] = c
+}
+
+// DecodeError is what Decode returns when a job's content can't be decoded.
+type DecodeError struct {
+	JobID       string
+	ContentType string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("can't decode job %s as %s: %s", e.JobID, e.ContentType, e.Err.Error())
+}
+
+// Decode decodes a job's content into v, with the codec registered for its
+// content type. Jobs without a content type are decoded as JSON.
+func (j *Job) Decode(v interface{}) error {
+	typ := j.ContentType
+	if typ == "" {
+		typ = JSON.ContentType()
+	}
+
+	codecsM.RLock()
+	c, ok := codecs[typ]
+	codecsM.RUnlock()
+
+	if !ok {
+		return ErrUnknownContentType(fmt.Errorf("no codec for job %s with content type %q", j.ID, typ))
+	}
+
+	if err := c.Unmarshal([]byte(j.Content), v); err != nil {
+		return &DecodeError{JobID: j.ID, ContentType: typ, Err: err}
+	}
+
+	return nil
+}
+
+// SetCodec sets the codec that PutValue encodes values with.
+func (c *Client) SetCodec(codec Codec) {
+	c.m.Lock()
+	c.codec = codec
+	c.m.Unlock()
+}
+
+// PutValue is Put for a value that's encoded with the client's codec, which is
+// JSON unless SetCodec says otherwise. The job's content type is set to the
+// codec's.
+func (c *Client) PutValue(queue, id string, v interface{}, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.PutValueContext(context.Background(), queue, id, v, priority, holdUntil, ttr)
+}
+
+// PutValueContext is PutValue, but gives up when ctx is done.
+func (c *Client) PutValueContext(ctx context.Context, queue, id string, v interface{}, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	c.m.RLock()
+	codec := c.codec
+	c.m.RUnlock()
+
+	if codec == nil {
+		codec = JSON
+	}
+
+	d, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.PutJobContext(ctx, &Job{
+		ID:          id,
+		Queue:       queue,
+		Priority:    priority,
+		HoldUntil:   holdUntil,
+		TTR:         ttr,
+		ContentType: codec.ContentType(),
+		Content:     string(d),
+	}, ConflictUpdate)
+}
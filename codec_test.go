@@ -0,0 +1,116 @@
+package jobserver_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(d []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(d)).Decode(v)
+}
+
+type codecValue struct {
+	Name  string
+	Count int
+}
+
+// putAndReserve puts v with c, and reserves the job it went in.
+func putAndReserve(t *testing.T, s *jobservertest.Server, c *jobserver.Client, v interface{}) *jobserver.Job {
+	if err := c.PutValue("q", "j", v, 0, s.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Advance(time.Second)
+
+	j, err := c.Reserve("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j
+}
+
+func TestCodecJSON(t *testing.T) {
+	s := jobservertest.New(t)
+
+	j := putAndReserve(t, s, s.Client(), codecValue{Name: "a", Count: 3})
+
+	if j.ContentType != "application/json" {
+		t.Fatalf("job has content type %q", j.ContentType)
+	}
+	if j.Content != `{"Name":"a","Count":3}` {
+		t.Fatalf("job has content %q", j.Content)
+	}
+
+	var v codecValue
+	if err := j.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != (codecValue{Name: "a", Count: 3}) {
+		t.Fatalf("decoded %#v", v)
+	}
+
+	// jobs without a content type are JSON too
+	var n int
+	if err := (&jobserver.Job{Content: "5"}).Decode(&n); err != nil || n != 5 {
+		t.Fatalf("decoded %d, %v from a job without a content type", n, err)
+	}
+
+	err := (&jobserver.Job{ID: "bad", Content: "{"}).Decode(&v)
+	if e, ok := err.(*jobserver.DecodeError); !ok || e.JobID != "bad" || e.ContentType != "application/json" {
+		t.Fatalf("decoding bad content got %#v", err)
+	}
+}
+
+func TestCodecRegistered(t *testing.T) {
+	s := jobservertest.New(t)
+
+	jobserver.RegisterCodec(gobCodec{})
+
+	c := s.Client()
+	c.SetCodec(gobCodec{})
+	defer c.SetCodec(jobserver.JSON)
+
+	j := putAndReserve(t, s, c, codecValue{Name: "b", Count: 7})
+
+	if j.ContentType != "application/x-gob" {
+		t.Fatalf("job has content type %q", j.ContentType)
+	}
+
+	var v codecValue
+	if err := j.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != (codecValue{Name: "b", Count: 7}) {
+		t.Fatalf("decoded %#v", v)
+	}
+}
+
+func TestCodecUnknown(t *testing.T) {
+	j := jobserver.Job{ID: "j", ContentType: "application/x-unknown", Content: "?"}
+
+	var v codecValue
+	err := j.Decode(&v)
+	if err == nil {
+		t.Fatal("decoded a job with an unknown content type")
+	}
+	if _, ok := err.(*jobserver.DecodeError); ok || !strings.Contains(err.Error(), "application/x-unknown") {
+		t.Fatalf("got error %#v, want one about the content type", err)
+	}
+}
@@ -0,0 +1,64 @@
+package jobserver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	addr, _, stop := silentServer(t)
+	defer stop()
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the context has to be what stops the request, not the timeout
+	c.SetTimeout(time.Minute)
+
+	for _, tc := range []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"cancelled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(time.Millisecond*50, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"expired", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), time.Millisecond*50)
+		}, context.DeadlineExceeded},
+	} {
+		ctx, cancel := tc.ctx()
+		before := time.Now()
+
+		if _, err := c.PingContext(ctx); err != tc.want {
+			t.Errorf("%s context got %v, want %v", tc.name, err, tc.want)
+		}
+		if d := time.Now().Sub(before); d < time.Millisecond*40 || d > time.Second {
+			t.Errorf("%s context gave up after %s", tc.name, d)
+		}
+
+		cancel()
+
+		c.m.RLock()
+		n := len(c.pending)
+		c.m.RUnlock()
+
+		if n != 0 {
+			t.Errorf("%s context left %d requests pending", tc.name, n)
+		}
+	}
+
+	// a context that's already done doesn't get as far as sending anything
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.PingContext(done); err != context.Canceled {
+		t.Fatalf("done context got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,189 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+type (
+	ErrUnsupported error
+)
+
+// legacyTypes are the message types that servers from before the hello
+// exchange are known to handle.
+var legacyTypes = []string{"delete", "error", "job", "peek", "ping", "reserve", "success"}
+
+var (
+	// helloTries is how many hellos in a row have to time out before a
+	// server is taken to be from before the hello exchange. A server that's
+	// just slow or unreachable for a moment times out too.
+	helloTries = 3
+	// legacyInfoTTL is how long a server that didn't answer is taken to be
+	// from before the hello exchange, before it's asked again in the
+	// background.
+	legacyInfoTTL = time.Minute
+)
+
+// ServerInfo describes what a server supports, as reported by Hello.
+// ReplayTTL is how long the server remembers its responses, so that a request
+// that's sent again gets the same response instead of being run twice. It's
+// zero if the server doesn't remember them.
+type ServerInfo struct {
+	Version        int
+	Types          []string
+	MaxMessageSize int
+	MaxFrameSize   int
+	ReplayTTL      time.Duration
+}
+
+// Supports reports whether the server handles messages of the given type.
+func (i *ServerInfo) Supports(typ string) bool {
+	for _, t := range i.Types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Hello asks the server what it supports. Servers from before this existed
+// don't answer, so if the request times out a few times in a row, the server
+// is taken to be one of those: version 0, handling only the original message
+// types. In case it was only unreachable, it's asked again after a minute,
+// in the background, so that requests don't wait for it to time out again.
+//
+// Clients say hello by themselves the first time they need to know about the
+// server, and remember the answer. Calling Hello asks again.
+func (c *Client) Hello() (*ServerInfo, error) {
+	return c.HelloContext(context.Background())
+}
+
+// HelloContext is Hello, but gives up when ctx is done.
+func (c *Client) HelloContext(ctx context.Context) (*ServerInfo, error) {
+	var info *ServerInfo
+	err := c.do(ctx, &Call{Op: OpHello}, func(ctx context.Context) error {
+		var err error
+		info, err = c.hello(ctx)
+		return err
+	})
+
+	return info, err
+}
+
+func (c *Client) hello(ctx context.Context) (*ServerInfo, error) {
+	var r protocol.Message
+	var err error
+	for i := 0; i < helloTries; i++ {
+		r, err = c.req(ctx, &protocol.HelloMessage{
+			Version: protocol.Version,
+			Types:   strings.Join(protocol.DefaultParser.Types(), ","),
+		})
+		if err != ErrTimeout {
+			break
+		}
+	}
+
+	var info *ServerInfo
+	var until time.Time
+	if err == ErrTimeout {
+		info = &ServerInfo{Types: legacyTypes, MaxMessageSize: protocol.MessageSize}
+		until = time.Now().Add(legacyInfoTTL)
+	} else if err != nil {
+		return nil, err
+	} else {
+		switch r := r.(type) {
+		case *protocol.HelloMessage:
+			info = &ServerInfo{
+				Version:        r.Version,
+				Types:          strings.Split(r.Types, ","),
+				MaxMessageSize: r.MaxMessageSize,
+				MaxFrameSize:   r.MaxFrameSize,
+				ReplayTTL:      time.Duration(r.ReplayTTL) * time.Second,
+			}
+		default:
+			return nil, ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+		}
+	}
+
+	c.infoM.Lock()
+	c.info, c.infoUntil = info, until
+	c.infoM.Unlock()
+
+	return info, nil
+}
+
+func (c *Client) serverInfo(ctx context.Context) (*ServerInfo, error) {
+	c.infoM.Lock()
+	info := c.info
+	if info != nil && !c.infoUntil.IsZero() && !time.Now().Before(c.infoUntil) && !c.probing {
+		c.probing = true
+		go c.reprobe()
+	}
+	c.infoM.Unlock()
+
+	if info != nil {
+		return info, nil
+	}
+
+	return c.HelloContext(ctx)
+}
+
+// reprobe says hello again to a server that was taken to be from before the
+// hello exchange, in case it was only unreachable. Until it's done, requests
+// carry on as if the server is from before then.
+func (c *Client) reprobe() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_, err := c.HelloContext(ctx)
+
+	c.infoM.Lock()
+	if err != nil && c.info != nil && !c.infoUntil.IsZero() {
+		c.infoUntil = time.Now().Add(legacyInfoTTL)
+	}
+	c.probing = false
+	c.infoM.Unlock()
+}
+
+// require returns an error if the server doesn't handle messages of the given
+// type, or if the server can't be asked.
+func (c *Client) require(ctx context.Context, typ string) error {
+	info, err := c.serverInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !info.Supports(typ) {
+		return ErrUnsupported(fmt.Errorf("server version %d doesn't support %s messages", info.Version, typ))
+	}
+
+	return nil
+}
+
+// requireVersion returns an error if the server's protocol version is older
+// than v, which is what's needed for what.
+func (c *Client) requireVersion(ctx context.Context, v int, what string) error {
+	info, err := c.serverInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if info.Version < v {
+		return ErrUnsupported(fmt.Errorf("server version %d doesn't support %s", info.Version, what))
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package jobserver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// silentServer listens for datagrams and never answers them. It returns its
+// address and a count of the datagrams it's had.
+func silentServer(t *testing.T) (string, *int64, func()) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	go func() {
+		d := make([]byte, 65536)
+		for {
+			if _, _, err := pc.ReadFrom(d); err != nil {
+				return
+			}
+			atomic.AddInt64(&n, 1)
+		}
+	}()
+
+	return pc.LocalAddr().String(), &n, func() { pc.Close() }
+}
+
+// waitProbe waits for a background hello to finish, so that a test can put
+// back the settings it reads.
+func waitProbe(c *Client) {
+	for {
+		c.infoM.Lock()
+		probing := c.probing
+		c.infoM.Unlock()
+
+		if !probing {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestHelloLegacy(t *testing.T) {
+	defer func(d time.Duration) { legacyInfoTTL = d }(legacyInfoTTL)
+	legacyInfoTTL = time.Millisecond * 200
+
+	addr, n, done := silentServer(t)
+	defer done()
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waitProbe(c)
+	defer c.Close()
+
+	c.SetTimeout(time.Millisecond * 20)
+
+	info, err := c.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 0 || info.Supports("hello") {
+		t.Fatalf("silent server was taken to be %#v", info)
+	}
+
+	// give the last datagram time to arrive
+	time.Sleep(time.Millisecond * 20)
+	if got := atomic.LoadInt64(n); got != int64(helloTries) {
+		t.Fatalf("server got %d hellos before it was taken to be legacy, want %d", got, helloTries)
+	}
+
+	// the answer is remembered for a while
+	if err := c.requireVersion(context.Background(), 0, "anything"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(n); got != int64(helloTries) {
+		t.Fatalf("server got %d hellos, want %d", got, helloTries)
+	}
+
+	// and then the server is asked again, in the background, so requests
+	// don't wait for all of the hellos to time out
+	c.SetTimeout(time.Millisecond * 200)
+	time.Sleep(legacyInfoTTL)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.requireVersion(context.Background(), 0, "anything"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Millisecond*100 {
+		t.Fatalf("requests waited %s for the server to be asked again", d)
+	}
+
+	// only one of the requests starts asking
+	for deadline := time.Now().Add(time.Second * 2); atomic.LoadInt64(n) < int64(helloTries*2) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 250)
+	if got := atomic.LoadInt64(n); got != int64(helloTries*2) {
+		t.Fatalf("server got %d hellos after the legacy answer expired, want %d", got, helloTries*2)
+	}
+}
@@ -0,0 +1,86 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"time"
+)
+
+// Operations that a Call can be for. Each one is named after the client
+// method that makes it.
+const (
+	OpPing    = "ping"
+	OpHello   = "hello"
+	OpPut     = "put"
+	OpReserve = "reserve"
+	OpPeek    = "peek"
+	OpScan    = "scan"
+	OpStats   = "stats"
+	OpDelete  = "delete"
+	OpRelease = "release"
+	OpPurge   = "purge"
+	OpBackup  = "backup"
+)
+
+// Call describes one call to a client method, for interceptors. Op, Queue and
+// JobID are set before the call is made, except that JobID is only known
+// afterwards for calls that return a job, like Reserve. Attempts and Duration
+// are filled in once the call is done.
+type Call struct {
+	Op    string
+	Queue string
+	JobID string
+	// Attempts is how many times the request was sent, counting the sends
+	// that timed out. It's zero if the call failed before anything was sent.
+	Attempts int
+	// Duration is how long the call took, not counting any interceptors.
+	Duration time.Duration
+}
+
+// Interceptor wraps every call that a client makes. It has to call next to
+// make the call, and return what next returns, unless it means to change the
+// outcome. Calls that the client makes for itself, like the Hello that finds
+// out what the server supports, go through interceptors too.
+type Interceptor func(ctx context.Context, call *Call, next func(ctx context.Context) error) error
+
+// SetInterceptors sets the interceptors that every call goes through. The
+// first one is the outermost, so it sees the call first and the result last.
+func (c *Client) SetInterceptors(l ...Interceptor) {
+	c.m.Lock()
+	c.intercept = l
+	c.m.Unlock()
+}
+
+type callKey struct{}
+
+// callFrom returns the call that ctx is for, if it's for one.
+func callFrom(ctx context.Context) *Call {
+	call, _ := ctx.Value(callKey{}).(*Call)
+	return call
+}
+
+// do makes a call through the client's interceptors.
+func (c *Client) do(ctx context.Context, call *Call, fn func(ctx context.Context) error) error {
+	c.m.RLock()
+	l := c.intercept
+	c.m.RUnlock()
+
+	next := func(ctx context.Context) error {
+		before := time.Now()
+		err := fn(context.WithValue(ctx, callKey{}, call))
+		call.Duration = time.Now().Sub(before)
+
+		return err
+	}
+
+	for i := len(l) - 1; i >= 0; i-- {
+		next = wrap(l[i], call, next)
+	}
+
+	return next(ctx)
+}
+
+func wrap(i Interceptor, call *Call, next func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return i(ctx, call, next)
+	}
+}
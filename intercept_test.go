@@ -0,0 +1,117 @@
+package jobserver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+	s := jobservertest.New(t)
+	c := s.Client()
+
+	var got []string
+	record := func(name string) jobserver.Interceptor {
+		return func(ctx context.Context, call *jobserver.Call, next func(ctx context.Context) error) error {
+			got = append(got, name+" "+call.Op)
+			err := next(ctx)
+			got = append(got, name+" done")
+			return err
+		}
+	}
+
+	c.SetInterceptors(record("outer"), record("inner"))
+	defer c.SetInterceptors()
+
+	if _, err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"outer ping", "inner ping", "inner done", "outer done"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("interceptors ran as %q, want %q", got, want)
+	}
+}
+
+func TestInterceptorCall(t *testing.T) {
+	s := jobservertest.New(t)
+	c := s.Client()
+
+	var calls []jobserver.Call
+	c.SetInterceptors(func(ctx context.Context, call *jobserver.Call, next func(ctx context.Context) error) error {
+		err := next(ctx)
+		calls = append(calls, *call)
+		return err
+	})
+	defer c.SetInterceptors()
+
+	if err := c.Put("q", "j", "x", 0, s.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(time.Second)
+	if _, err := c.Reserve("q"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("q", "j"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 3 {
+		t.Fatalf("got calls %#v", calls)
+	}
+
+	for i, op := range []string{jobserver.OpPut, jobserver.OpReserve, jobserver.OpDelete} {
+		call := calls[i]
+		if call.Op != op || call.Queue != "q" || call.JobID != "j" || call.Attempts != 1 || call.Duration <= 0 {
+			t.Errorf("call %d is %#v, want a %s of job j in queue q sent once", i, call, op)
+		}
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	s := jobservertest.New(t)
+	c := s.Client()
+
+	refused := errors.New("refused")
+
+	var call jobserver.Call
+	c.SetInterceptors(func(ctx context.Context, c *jobserver.Call, next func(ctx context.Context) error) error {
+		call = *c
+		return refused
+	})
+	defer c.SetInterceptors()
+
+	if err := c.Put("q", "j", "x", 0, s.Now(), time.Minute); err != refused {
+		t.Fatalf("put got %v, want the interceptor's error", err)
+	}
+	if call.Attempts != 0 {
+		t.Fatalf("call was sent %d times", call.Attempts)
+	}
+
+	c.SetInterceptors()
+	s.AssertEmpty("q")
+}
+
+func TestInterceptorWrapError(t *testing.T) {
+	s := jobservertest.New(t)
+	c := s.Client()
+
+	c.SetInterceptors(func(ctx context.Context, call *jobserver.Call, next func(ctx context.Context) error) error {
+		if err := next(ctx); err != nil {
+			return fmt.Errorf("%s %s: %w", call.Op, call.JobID, err)
+		}
+
+		return nil
+	})
+	defer c.SetInterceptors()
+
+	err := c.Delete("q", "missing")
+	if !errors.Is(err, jobserver.ErrNotFound) || err.Error() != "delete missing: not found" {
+		t.Fatalf("got %v, want a wrapped ErrNotFound", err)
+	}
+}
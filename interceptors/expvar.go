@@ -0,0 +1,31 @@
+package interceptors // import "fknsrs.biz/p/jobserver/interceptors"
+
+import (
+	"context"
+	"expvar"
+
+	"fknsrs.biz/p/jobserver"
+)
+
+// Expvar counts calls in m, by operation. For each operation, there's
+// op_calls, op_errors, op_retries for the sends after the first, and
+// op_duration_ms for the total time taken. Reserves, peeks and scans that
+// find no jobs aren't errors.
+//
+// m is usually made with expvar.NewMap, so that it's published.
+func Expvar(m *expvar.Map) jobserver.Interceptor {
+	return func(ctx context.Context, call *jobserver.Call, next func(ctx context.Context) error) error {
+		err := next(ctx)
+
+		m.Add(call.Op+"_calls", 1)
+		if err != nil && err != jobserver.ErrNoJobs {
+			m.Add(call.Op+"_errors", 1)
+		}
+		if call.Attempts > 1 {
+			m.Add(call.Op+"_retries", int64(call.Attempts-1))
+		}
+		m.AddFloat(call.Op+"_duration_ms", call.Duration.Seconds()*1000)
+
+		return err
+	}
+}
@@ -0,0 +1,104 @@
+package interceptors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"github.com/Sirupsen/logrus"
+)
+
+// run sends a call through an interceptor, with a next that takes a
+// millisecond, sends the request attempts times and returns err.
+func run(i jobserver.Interceptor, call *jobserver.Call, attempts int, err error) error {
+	return i(context.Background(), call, func(ctx context.Context) error {
+		call.Attempts = attempts
+		call.Duration = time.Millisecond
+		return err
+	})
+}
+
+func TestExpvar(t *testing.T) {
+	m := new(expvar.Map).Init()
+	i := Expvar(m)
+
+	failed := errors.New("failed")
+
+	if err := run(i, &jobserver.Call{Op: jobserver.OpPut}, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(i, &jobserver.Call{Op: jobserver.OpPut}, 3, failed); err != failed {
+		t.Fatalf("got %v, want the call's error", err)
+	}
+	if err := run(i, &jobserver.Call{Op: jobserver.OpReserve}, 1, jobserver.ErrNoJobs); err != jobserver.ErrNoJobs {
+		t.Fatalf("got %v, want the call's error", err)
+	}
+
+	for name, want := range map[string]string{
+		"put_calls":           "2",
+		"put_errors":          "1",
+		"put_retries":         "2",
+		"put_duration_ms":     "2",
+		"reserve_calls":       "1",
+		"reserve_duration_ms": "1",
+	} {
+		v := m.Get(name)
+		if v == nil {
+			t.Errorf("no %s", name)
+		} else if v.String() != want {
+			t.Errorf("%s is %s, want %s", name, v.String(), want)
+		}
+	}
+
+	if v := m.Get("reserve_errors"); v != nil {
+		t.Errorf("reserves that found no jobs counted as %s errors", v.String())
+	}
+}
+
+func TestLogrus(t *testing.T) {
+	var b bytes.Buffer
+
+	l := logrus.New()
+	l.Out = &b
+	l.Formatter = &logrus.JSONFormatter{}
+	l.Level = logrus.DebugLevel
+
+	i := Logrus(l)
+
+	failed := errors.New("failed")
+
+	run(i, &jobserver.Call{Op: jobserver.OpReserve, Queue: "q", JobID: "j"}, 1, nil)
+	run(i, &jobserver.Call{Op: jobserver.OpPeek, Queue: "q"}, 1, jobserver.ErrNoJobs)
+	run(i, &jobserver.Call{Op: jobserver.OpDelete, Queue: "q", JobID: "j"}, 2, failed)
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("got %d log entries, want 3", len(entries))
+	}
+
+	for n, want := range []map[string]interface{}{
+		{"level": "debug", "op": "reserve", "queue": "q", "job_id": "j", "attempts": 1.0},
+		{"level": "debug", "op": "peek", "queue": "q"},
+		{"level": "warning", "op": "delete", "job_id": "j", "attempts": 2.0, "error": "failed"},
+	} {
+		for k, v := range want {
+			if entries[n][k] != v {
+				t.Errorf("entry %d has %s %#v, want %#v", n, k, entries[n][k], v)
+			}
+		}
+	}
+}
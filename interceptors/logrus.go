@@ -0,0 +1,34 @@
+// Package interceptors has interceptors for jobserver clients that log calls
+// and keep metrics about them. They're also examples of how to write your own.
+package interceptors // import "fknsrs.biz/p/jobserver/interceptors"
+
+import (
+	"context"
+
+	"fknsrs.biz/p/jobserver"
+	"github.com/Sirupsen/logrus"
+)
+
+// Logrus logs every call at debug level, or at warning level if it fails.
+// Reserves, peeks and scans that find no jobs aren't failures.
+func Logrus(l *logrus.Logger) jobserver.Interceptor {
+	return func(ctx context.Context, call *jobserver.Call, next func(ctx context.Context) error) error {
+		err := next(ctx)
+
+		e := l.WithFields(logrus.Fields{
+			"op":                  call.Op,
+			"queue":               call.Queue,
+			"job_id":              call.JobID,
+			"attempts":            call.Attempts,
+			"measure#duration_ms": call.Duration.Seconds() * 1000,
+		})
+
+		if err != nil && err != jobserver.ErrNoJobs {
+			e.WithField("error", err.Error()).Warn("call failed")
+		} else {
+			e.Debug("call finished")
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,118 @@
+// Package keyring reads the key files that jobserver uses for encryption,
+// both of job content at rest and of messages on the wire.
+package keyring // import "fknsrs.biz/p/jobserver/internal/keyring"
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoKeys     = errors.New("keyring has no keys")
+	ErrUnknownKey = errors.New("unknown key")
+)
+
+// Keyring holds a set of AES-256-GCM keys by ID. The primary key is used to
+// encrypt, and every key can be used to decrypt.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// Load reads a key file. See Parse for its format.
+func Load(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse reads keys, one per line, as a key ID and a base64-encoded 32 byte
+// key separated by whitespace. Blank lines and lines starting with # are
+// ignored. The first key is the primary key, so rotating keys is a matter of
+// adding a new key at the top, and then removing the old key once nothing
+// uses it.
+func Parse(r io.Reader) (*Keyring, error) {
+	k := Keyring{keys: make(map[string]cipher.AEAD)}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		bits := strings.Fields(line)
+		if len(bits) != 2 {
+			return nil, fmt.Errorf("line %d: expected a key ID and a key", n)
+		}
+
+		id := bits[0]
+		if len(id) > 255 {
+			return nil, fmt.Errorf("line %d: key ID can't be longer than 255 bytes", n)
+		}
+		if strings.ContainsAny(id, ",:") {
+			return nil, fmt.Errorf("line %d: key ID can't contain commas or colons", n)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key ID %q", n, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(bits[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("line %d: key must be 32 bytes; got %d", n, len(key))
+		}
+
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+
+		a, err := cipher.NewGCM(b)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+
+		k.keys[id] = a
+		if k.primary == "" {
+			k.primary = id
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.primary == "" {
+		return nil, ErrNoKeys
+	}
+
+	return &k, nil
+}
+
+// Primary returns the ID of the key used for encryption.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Get returns the key with the given ID.
+func (k *Keyring) Get(id string) (cipher.AEAD, error) {
+	a, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%s %q", ErrUnknownKey.Error(), id)
+	}
+
+	return a, nil
+}
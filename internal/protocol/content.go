@@ -0,0 +1,78 @@
+package protocol // import "fknsrs.biz/p/jobserver/internal/protocol"
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Job content is written with %q, which escapes some things in ways that
+// logfmt can't read back; binary data gets \x escapes, for example. Content
+// like that is sent as base64 instead, and the content_encoding field says so.
+// Content that was fine before is still sent as it is, so older clients only
+// see base64 for content they couldn't have read anyway.
+const (
+	ContentEncodingBase64 = "base64"
+)
+
+var (
+	ErrUnknownContentEncoding = errors.New("unknown content encoding")
+)
+
+// decoder is implemented by messages that need more done to them after their
+// fields have been read.
+type decoder interface {
+	decode() error
+}
+
+// NeedsEncoding reports whether content has to be sent as base64, which is
+// when %q would write anything that logfmt can't unquote. logfmt only knows
+// \u escapes and the short escapes that JSON has.
+func NeedsEncoding(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '\b', r == '\f', r == '\n', r == '\r', r == '\t':
+			continue
+		case r < ' ', r == 0x7f:
+			return true
+		case r > 0xffff && !strconv.IsPrint(r):
+			return true
+		}
+	}
+
+	return false
+}
+
+// EncodeContent returns the content encoding that content needs, and the
+// content encoded with it. It's the one rule for everywhere that job content
+// goes in text, which includes JSON as well as messages.
+func EncodeContent(s string) (string, string) {
+	if NeedsEncoding(s) {
+		return ContentEncodingBase64, base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	return "", s
+}
+
+// DecodeContent undoes EncodeContent.
+func DecodeContent(encoding, s string) (string, error) {
+	switch encoding {
+	case "":
+		return s, nil
+	case ContentEncodingBase64:
+		d, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+
+		return string(d), nil
+	default:
+		return "", fmt.Errorf("%s %q", ErrUnknownContentEncoding.Error(), encoding)
+	}
+}
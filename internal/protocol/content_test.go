@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeContent(t *testing.T) {
+	for _, tc := range []struct {
+		content  string
+		encoding string
+	}{
+		{"", ""},
+		{"hello", ""},
+		{`{"a": "quoted\\"}`, ""},
+		{"tabs\tand\nnewlines\r\n", ""},
+		{"ünïcödé ✓", ""},
+		{"\x00\x01\x02", ContentEncodingBase64},
+		{"bell\a", ContentEncodingBase64},
+		{"del\x7f", ContentEncodingBase64},
+		{"\xff\xfe not utf-8", ContentEncodingBase64},
+	} {
+		encoding, encoded := EncodeContent(tc.content)
+		if encoding != tc.encoding {
+			t.Errorf("%q was encoded with %q, want %q", tc.content, encoding, tc.encoding)
+		}
+		if encoding == "" && encoded != tc.content {
+			t.Errorf("%q was changed to %q without an encoding", tc.content, encoded)
+		}
+
+		decoded, err := DecodeContent(encoding, encoded)
+		if err != nil {
+			t.Errorf("%q didn't decode: %s", tc.content, err.Error())
+		} else if decoded != tc.content {
+			t.Errorf("%q decoded to %q", tc.content, decoded)
+		}
+	}
+}
+
+func TestDecodeContentErrors(t *testing.T) {
+	if _, err := DecodeContent(ContentEncodingBase64, "not base64!"); err == nil {
+		t.Error("invalid base64 decoded without an error")
+	}
+
+	if _, err := DecodeContent("rot13", "uryyb"); err == nil || !strings.HasPrefix(err.Error(), ErrUnknownContentEncoding.Error()) {
+		t.Errorf("unknown encoding got error %v, want %v", err, ErrUnknownContentEncoding)
+	}
+}
+
+func TestJobMessageContent(t *testing.T) {
+	for _, content := range []string{"hello", "\x00binary\xff", "line\nbreaks"} {
+		d := Serialise(&JobMessage{Key: "k", ID: "j", Queue: "q", Content: content})
+
+		m, err := Parse(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j, ok := m.(*JobMessage)
+		if !ok {
+			t.Fatalf("%q parsed as %T", d, m)
+		}
+		if j.Content != content || j.ContentEncoding != "" {
+			t.Errorf("%q came back as %q with encoding %q", content, j.Content, j.ContentEncoding)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package protocol // import "fknsrs.biz/p/jobserver/internal/protocol"
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Stream transports carry each message in a frame, which is the length of the
+// message as a big-endian uint32 followed by the message itself.
+var (
+	MaxFrameSize = 1024 * 1024 * 64
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+func WriteFrame(w io.Writer, d []byte) error {
+	if len(d) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	b := make([]byte, 4+len(d))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(d)))
+	copy(b[4:], d)
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	h := make([]byte, 4)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(h)
+	if n > uint32(MaxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	d := make([]byte, n)
+	if _, err := io.ReadFull(r, d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
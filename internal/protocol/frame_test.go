@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	var b bytes.Buffer
+
+	msgs := [][]byte{[]byte("ping key=a"), {}, bytes.Repeat([]byte{0, 1, 2}, 1000)}
+	for _, d := range msgs {
+		if err := WriteFrame(&b, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b.Len() != 4*len(msgs)+10+3000 {
+		t.Fatalf("frames took %d bytes", b.Len())
+	}
+
+	for _, want := range msgs {
+		d, err := ReadFrame(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d, want) {
+			t.Fatalf("read frame %q, want %q", d, want)
+		}
+	}
+
+	if _, err := ReadFrame(&b); err != io.EOF {
+		t.Fatalf("got error %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	defer func(n int) { MaxFrameSize = n }(MaxFrameSize)
+	MaxFrameSize = 4
+
+	var b bytes.Buffer
+	if err := WriteFrame(&b, []byte("hello")); err != ErrFrameTooLarge {
+		t.Fatalf("wrote frame with error %v, want %v", err, ErrFrameTooLarge)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("wrote %d bytes for a frame that's too large", b.Len())
+	}
+
+	// a header claiming too much is rejected before anything is allocated
+	if _, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err != ErrFrameTooLarge {
+		t.Fatalf("read frame with error %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestFrameShort(t *testing.T) {
+	for _, d := range [][]byte{{0, 0}, {0, 0, 0, 5, 'a', 'b'}} {
+		if _, err := ReadFrame(bytes.NewReader(d)); err != io.ErrUnexpectedEOF {
+			t.Errorf("read %q with error %v, want %v", d, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
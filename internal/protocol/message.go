@@ -1,5 +1,11 @@
 package protocol // import "fknsrs.biz/p/jobserver/internal/protocol"
 
+// Version is bumped whenever messages change in a way that older clients or
+// servers would get wrong. Version 1 added the hello exchange, conflict
+// policies and content_encoding, and version 2 added content_type; anything
+// that doesn't answer hello is version 0.
+const Version = 2
+
 var (
 	MessageSize = 1024 * 16
 )
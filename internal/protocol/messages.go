@@ -4,6 +4,17 @@ import (
 	"fmt"
 )
 
+type BackupMessage struct {
+	Key  string
+	Path string
+}
+
+func (m BackupMessage) GetKey() string     { return m.Key }
+func (m *BackupMessage) SetKey(key string) { m.Key = key }
+func (m BackupMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("backup key=%s path=%q", m.Key, m.Path))
+}
+
 type DeleteMessage struct {
 	Key   string
 	Queue string
@@ -27,20 +38,58 @@ func (m ErrorMessage) Serialise() []byte {
 	return []byte(fmt.Sprintf("error key=%s reason=%q", m.Key, m.Reason))
 }
 
+// HelloMessage is sent by clients to find out what a server supports, and
+// sent back with the server's details. Types is a comma-separated list of the
+// message types that can be parsed. ReplayTTL is how many seconds the server
+// remembers responses for, so that a repeated request gets the same response
+// instead of being run again; it's zero if the server doesn't, or is too old
+// to say.
+type HelloMessage struct {
+	Key            string
+	Version        int
+	Types          string
+	MaxMessageSize int `logfmt:"max_message_size"`
+	MaxFrameSize   int `logfmt:"max_frame_size"`
+	ReplayTTL      int `logfmt:"replay_ttl"`
+}
+
+func (m HelloMessage) GetKey() string     { return m.Key }
+func (m *HelloMessage) SetKey(key string) { m.Key = key }
+func (m HelloMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("hello key=%s version=%d types=%s max_message_size=%d max_frame_size=%d replay_ttl=%d", m.Key, m.Version, m.Types, m.MaxMessageSize, m.MaxFrameSize, m.ReplayTTL))
+}
+
+// JobMessage.Content is always the job's content as it is. ContentEncoding is
+// only used on the wire, and is empty once a message has been parsed.
+// ContentType is up to the client, and the server just keeps it with the job.
 type JobMessage struct {
-	Key       string
-	ID        string
-	Queue     string
-	Priority  float64
-	HoldUntil int64
-	TTR       uint64
-	Content   string
+	Key             string
+	ID              string
+	Queue           string
+	Priority        float64
+	HoldUntil       int64 `logfmt:"hold_until"`
+	TTR             uint64
+	Conflict        string
+	ContentType     string `logfmt:"content_type"`
+	ContentEncoding string `logfmt:"content_encoding"`
+	Content         string
 }
 
 func (m JobMessage) GetKey() string     { return m.Key }
 func (m *JobMessage) SetKey(key string) { m.Key = key }
 func (m JobMessage) Serialise() []byte {
-	return []byte(fmt.Sprintf("job key=%s id=%s queue=%s priority=%#v hold_until=%d ttr=%d content=%q", m.Key, m.ID, m.Queue, m.Priority, m.HoldUntil, m.TTR, m.Content))
+	encoding, content := EncodeContent(m.Content)
+	return []byte(fmt.Sprintf("job key=%s id=%s queue=%s priority=%#v hold_until=%d ttr=%d conflict=%s content_type=%q content_encoding=%s content=%q", m.Key, m.ID, m.Queue, m.Priority, m.HoldUntil, m.TTR, m.Conflict, m.ContentType, encoding, content))
+}
+func (m *JobMessage) decode() error {
+	content, err := DecodeContent(m.ContentEncoding, m.Content)
+	if err != nil {
+		return err
+	}
+
+	m.ContentEncoding, m.Content = "", content
+
+	return nil
 }
 
 type PeekMessage struct {
@@ -64,6 +113,44 @@ func (m PingMessage) Serialise() []byte {
 	return []byte(fmt.Sprintf("ping key=%s", m.Key))
 }
 
+type PurgeMessage struct {
+	Key   string
+	Queue string
+}
+
+func (m PurgeMessage) GetKey() string     { return m.Key }
+func (m *PurgeMessage) SetKey(key string) { m.Key = key }
+func (m PurgeMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("purge key=%s queue=%s", m.Key, m.Queue))
+}
+
+type QueueStatsMessage struct {
+	Key   string
+	Queue string
+	Ready uint64
+	Held  uint64
+}
+
+func (m QueueStatsMessage) GetKey() string     { return m.Key }
+func (m *QueueStatsMessage) SetKey(key string) { m.Key = key }
+func (m QueueStatsMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("queue_stats key=%s queue=%s ready=%d held=%d", m.Key, m.Queue, m.Ready, m.Held))
+}
+
+type ReleaseMessage struct {
+	Key       string
+	Queue     string
+	ID        string
+	Priority  float64
+	HoldUntil int64 `logfmt:"hold_until"`
+}
+
+func (m ReleaseMessage) GetKey() string     { return m.Key }
+func (m *ReleaseMessage) SetKey(key string) { m.Key = key }
+func (m ReleaseMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("release key=%s queue=%s id=%s priority=%#v hold_until=%d", m.Key, m.Queue, m.ID, m.Priority, m.HoldUntil))
+}
+
 type ReserveMessage struct {
 	Key   string
 	Queue string
@@ -75,6 +162,31 @@ func (m ReserveMessage) Serialise() []byte {
 	return []byte(fmt.Sprintf("reserve key=%s queue=%s", m.Key, m.Queue))
 }
 
+type ScanMessage struct {
+	Key   string
+	Queue string
+	State string
+	After string
+}
+
+func (m ScanMessage) GetKey() string     { return m.Key }
+func (m *ScanMessage) SetKey(key string) { m.Key = key }
+func (m ScanMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("scan key=%s queue=%s state=%s after=%s", m.Key, m.Queue, m.State, m.After))
+}
+
+type StatsMessage struct {
+	Key   string
+	Queue string
+	After string
+}
+
+func (m StatsMessage) GetKey() string     { return m.Key }
+func (m *StatsMessage) SetKey(key string) { m.Key = key }
+func (m StatsMessage) Serialise() []byte {
+	return []byte(fmt.Sprintf("stats key=%s queue=%s after=%s", m.Key, m.Queue, m.After))
+}
+
 type SuccessMessage struct {
 	Key string
 }
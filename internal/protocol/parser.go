@@ -3,6 +3,7 @@ package protocol // import "fknsrs.biz/p/jobserver/internal/protocol"
 import (
 	"bytes"
 	"fmt"
+	"sort"
 
 	"github.com/kr/logfmt"
 )
@@ -12,13 +13,20 @@ type (
 )
 
 var DefaultParser = NewParser(map[string]func() Message{
-	"delete":  func() Message { return &DeleteMessage{} },
-	"error":   func() Message { return &ErrorMessage{} },
-	"job":     func() Message { return &JobMessage{} },
-	"peek":    func() Message { return &PeekMessage{} },
-	"ping":    func() Message { return &PingMessage{} },
-	"reserve": func() Message { return &ReserveMessage{} },
-	"success": func() Message { return &SuccessMessage{} },
+	"backup":      func() Message { return &BackupMessage{} },
+	"delete":      func() Message { return &DeleteMessage{} },
+	"error":       func() Message { return &ErrorMessage{} },
+	"hello":       func() Message { return &HelloMessage{} },
+	"job":         func() Message { return &JobMessage{} },
+	"peek":        func() Message { return &PeekMessage{} },
+	"ping":        func() Message { return &PingMessage{} },
+	"purge":       func() Message { return &PurgeMessage{} },
+	"queue_stats": func() Message { return &QueueStatsMessage{} },
+	"release":     func() Message { return &ReleaseMessage{} },
+	"reserve":     func() Message { return &ReserveMessage{} },
+	"scan":        func() Message { return &ScanMessage{} },
+	"stats":       func() Message { return &StatsMessage{} },
+	"success":     func() Message { return &SuccessMessage{} },
 })
 
 func Parse(d []byte) (Message, error) {
@@ -33,6 +41,7 @@ func NewParser(types map[string]func() Message) *Parser {
 	return &Parser{types: types}
 }
 
+// Types returns the names of the message types the parser knows, in order.
 func (p *Parser) Types() []string {
 	r := make([]string, len(p.types))
 
@@ -42,6 +51,8 @@ func (p *Parser) Types() []string {
 		i++
 	}
 
+	sort.Strings(r)
+
 	return r
 }
 
@@ -59,5 +70,15 @@ func (p *Parser) Parse(d []byte) (Message, error) {
 
 	m := fn()
 
-	return m, logfmt.Unmarshal(rest, m)
+	if err := logfmt.Unmarshal(rest, m); err != nil {
+		return m, err
+	}
+
+	if d, ok := m.(decoder); ok {
+		if err := d.decode(); err != nil {
+			return m, err
+		}
+	}
+
+	return m, nil
 }
@@ -0,0 +1,123 @@
+package protocol // import "fknsrs.biz/p/jobserver/internal/protocol"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+)
+
+// When both ends share a key file, every serialised message is sealed with
+// AES-256-GCM before it's sent. A sealed message is the two bytes in
+// sealMagic, the length of the key ID as one byte, the key ID, a random nonce,
+// and the ciphertext. The plaintext is the time the message was sealed, in
+// nanoseconds since the epoch as a big-endian uint64, followed by the
+// serialised message. The key ID is the additional data.
+//
+// Messages can't start with a zero byte otherwise, so sealed and plain
+// messages can't be mistaken for each other.
+var sealMagic = []byte{0x00, 0x01}
+
+var (
+	// AuthWindow is how far from now a sealed message's time can be before
+	// it's rejected.
+	AuthWindow = time.Second * 30
+)
+
+var (
+	ErrNotSealed  = errors.New("message isn't sealed")
+	ErrBadSeal    = errors.New("message failed authentication")
+	ErrStaleSeal  = errors.New("message was sealed outside the time window")
+	ErrShortSeal  = errors.New("sealed message is too short")
+	ErrKeyIDLimit = errors.New("key ID is too long")
+)
+
+// Sealed is a message that's been opened.
+type Sealed struct {
+	KeyID   string
+	Nonce   []byte
+	Time    time.Time
+	Message []byte
+}
+
+// Seal seals a serialised message with the key with the given ID.
+func Seal(keys *keyring.Keyring, id string, d []byte, now time.Time) ([]byte, error) {
+	if len(id) > 255 {
+		return nil, ErrKeyIDLimit
+	}
+
+	a, err := keys.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(sealMagic)+1+len(id)+a.NonceSize()+8+len(d)+a.Overhead())
+	b = append(b, sealMagic...)
+	b = append(b, byte(len(id)))
+	b = append(b, id...)
+
+	nonce := make([]byte, a.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	b = append(b, nonce...)
+
+	p := make([]byte, 8+len(d))
+	binary.BigEndian.PutUint64(p[0:8], uint64(now.UnixNano()))
+	copy(p[8:], d)
+
+	return a.Seal(b, nonce, p, []byte(id)), nil
+}
+
+// Open checks and unseals a sealed message. Messages sealed more than window
+// before or after now are rejected.
+func Open(keys *keyring.Keyring, d []byte, now time.Time, window time.Duration) (*Sealed, error) {
+	if !bytes.HasPrefix(d, sealMagic) {
+		return nil, ErrNotSealed
+	}
+	d = d[len(sealMagic):]
+
+	if len(d) < 1 || len(d) < 1+int(d[0]) {
+		return nil, ErrShortSeal
+	}
+
+	id := string(d[1 : 1+int(d[0])])
+	d = d[1+int(d[0]):]
+
+	a, err := keys.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d) < a.NonceSize() {
+		return nil, ErrShortSeal
+	}
+
+	nonce := d[0:a.NonceSize()]
+
+	p, err := a.Open(nil, nonce, d[a.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, ErrBadSeal
+	}
+
+	if len(p) < 8 {
+		return nil, ErrShortSeal
+	}
+
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(p[0:8])))
+	if t.Before(now.Add(-window)) || t.After(now.Add(window)) {
+		return nil, fmt.Errorf("%s: sealed at %s", ErrStaleSeal.Error(), t.UTC().Format(time.RFC3339))
+	}
+
+	return &Sealed{
+		KeyID:   id,
+		Nonce:   append([]byte(nil), nonce...),
+		Time:    t,
+		Message: p[8:],
+	}, nil
+}
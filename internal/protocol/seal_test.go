@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+)
+
+func testKeys(t *testing.T, s string) *keyring.Keyring {
+	k, err := keyring.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+var (
+	keysAB = "a AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\nb AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"
+	keysC  = "c AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=\n"
+	sealed = time.Unix(1500000000, 0)
+)
+
+func TestSealOpen(t *testing.T) {
+	k := testKeys(t, keysAB)
+
+	for _, id := range []string{"a", "b"} {
+		d, err := Seal(k, id, []byte("ping key=x"), sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(d, []byte("ping")) {
+			t.Fatalf("sealed message %q contains its plaintext", d)
+		}
+
+		sm, err := Open(k, d, sealed.Add(time.Second), time.Second*30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sm.KeyID != id || !sm.Time.Equal(sealed) || string(sm.Message) != "ping key=x" {
+			t.Fatalf("opened %q sealed with key %s at %s, want %q sealed with key %s at %s", sm.Message, sm.KeyID, sm.Time, "ping key=x", id, sealed)
+		}
+	}
+}
+
+func TestSealNonces(t *testing.T) {
+	k := testKeys(t, keysAB)
+
+	d1, err := Seal(k, "a", []byte("ping"), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Seal(k, "a", []byte("ping"), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(d1, d2) {
+		t.Fatal("sealing the same message twice gave the same result")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	k := testKeys(t, keysAB)
+
+	d, err := Seal(k, "a", []byte("ping"), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), d...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	// claiming a different key changes the additional data
+	moved := append([]byte(nil), d...)
+	moved[3] = 'b'
+
+	for _, tc := range []struct {
+		name string
+		keys *keyring.Keyring
+		d    []byte
+		now  time.Time
+		want error
+	}{
+		{"plain", k, []byte("ping"), sealed, ErrNotSealed},
+		{"empty", k, sealMagic, sealed, ErrShortSeal},
+		{"short key id", k, d[0:4], sealed, ErrShortSeal},
+		{"short nonce", k, d[0:10], sealed, ErrShortSeal},
+		{"tampered", k, tampered, sealed, ErrBadSeal},
+		{"other key id", k, moved, sealed, ErrBadSeal},
+		{"unknown key", testKeys(t, keysC), d, sealed, keyring.ErrUnknownKey},
+		{"too old", k, d, sealed.Add(time.Second * 31), ErrStaleSeal},
+		{"too new", k, d, sealed.Add(-time.Second * 31), ErrStaleSeal},
+	} {
+		_, err := Open(tc.keys, tc.d, tc.now, time.Second*30)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want.Error()) {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestSealKeyIDLimit(t *testing.T) {
+	if _, err := Seal(testKeys(t, keysAB), strings.Repeat("x", 256), []byte("ping"), sealed); err != ErrKeyIDLimit {
+		t.Fatalf("got error %v, want %v", err, ErrKeyIDLimit)
+	}
+}
@@ -0,0 +1,118 @@
+package store // import "fknsrs.biz/p/jobserver/internal/store"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const EncodingGzip = "gzip"
+
+// PushEncoding records that encoding e has been applied on top of enc.
+func PushEncoding(enc, e string) string {
+	if enc == "" {
+		return e
+	}
+
+	return enc + "," + e
+}
+
+// PopEncoding splits off the last encoding applied, which is the first one
+// that has to be undone.
+func PopEncoding(enc string) (string, string) {
+	i := strings.LastIndex(enc, ",")
+	if i == -1 {
+		return "", enc
+	}
+
+	return enc[0:i], enc[i+1:]
+}
+
+// CompressContent gzips the job's content if it's at least threshold bytes
+// long, hasn't been encoded already, and gets smaller for it. It reports
+// whether the job was changed.
+func CompressContent(j *Job, threshold int) (bool, error) {
+	if threshold <= 0 || len(j.Content) < threshold || j.Encoding != "" {
+		return false, nil
+	}
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(j.Content); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+
+	if b.Len() >= len(j.Content) {
+		return false, nil
+	}
+
+	j.Content = b.Bytes()
+	j.Encoding = PushEncoding(j.Encoding, EncodingGzip)
+
+	return true, nil
+}
+
+type compressedStore struct {
+	Store
+	threshold int
+}
+
+// Compress wraps a Store so that content of at least threshold bytes is
+// compressed as it's written. Compressed content is decompressed as it's read
+// whatever the threshold is, so a threshold of zero turns compression off
+// without making existing jobs unreadable.
+func Compress(s Store, threshold int) Store {
+	return &compressedStore{Store: s, threshold: threshold}
+}
+
+func (s *compressedStore) decompress(j *Job, err error) (*Job, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	rest, last := PopEncoding(j.Encoding)
+	if last != EncodingGzip {
+		return j, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(j.Content))
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	j.Content = d
+	j.Encoding = rest
+
+	return j, nil
+}
+
+func (s *compressedStore) Put(j *Job, conflict string) (string, error) {
+	c := *j
+	if _, err := CompressContent(&c, s.threshold); err != nil {
+		return "", err
+	}
+
+	return s.Store.Put(&c, conflict)
+}
+
+func (s *compressedStore) Reserve(queue string, now time.Time) (*Job, error) {
+	return s.decompress(s.Store.Reserve(queue, now))
+}
+
+func (s *compressedStore) Peek(queue string, now time.Time) (*Job, error) {
+	return s.decompress(s.Store.Peek(queue, now))
+}
+
+func (s *compressedStore) Scan(queue, state, after string, now time.Time) (*Job, error) {
+	return s.decompress(s.Store.Scan(queue, state, after, now))
+}
@@ -0,0 +1,128 @@
+package store_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/logstore"
+	"fknsrs.biz/p/jobserver/internal/store/storetest"
+)
+
+// openRaw opens a log store in a temporary directory, to wrap and then look
+// at what the wrapper wrote.
+func openRaw(t *testing.T) store.Store {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	st, err := logstore.Open(filepath.Join(dir, "jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	return st
+}
+
+// putJob puts a ready job with the given content.
+func putJob(t *testing.T, st store.Store, id string, content []byte) {
+	if _, err := st.Put(&store.Job{ID: id, Queue: "q", HoldUntil: time.Now().Add(-time.Minute).Unix(), TTR: 60, Content: content}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scanJob scans for the job with the given ID.
+func scanJob(t *testing.T, st store.Store, id string) *store.Job {
+	for after := ""; ; {
+		j, err := st.Scan("", "", after, time.Now())
+		if err != nil {
+			t.Fatalf("scanning for job %s: %v", id, err)
+		}
+		if j.ID == id {
+			return j
+		}
+		after = j.ID
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	// the jobs here are too small to get smaller when they're gzipped, so
+	// this checks the wrapper leaves everything else alone;
+	// TestCompressContent checks what it does to content it compresses
+	if err := storetest.TestWrapper(func(path string) (store.Store, error) {
+		st, err := logstore.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return store.Compress(st, 1), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressContent(t *testing.T) {
+	raw := openRaw(t)
+	st := store.Compress(raw, 100)
+
+	big := []byte(strings.Repeat("compressible ", 100))
+	random := make([]byte, 200)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	putJob(t, st, "big", big)
+	putJob(t, st, "small", []byte("small"))
+	putJob(t, st, "random", random)
+
+	j := scanJob(t, raw, "big")
+	if j.Encoding != store.EncodingGzip || len(j.Content) >= len(big) {
+		t.Fatalf("big job was stored with encoding %q and %d bytes, want it gzipped to less than %d", j.Encoding, len(j.Content), len(big))
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(j.Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(d, big) {
+		t.Fatalf("stored content gunzips to %q, %v", d, err)
+	}
+
+	if j := scanJob(t, raw, "small"); j.Encoding != "" || string(j.Content) != "small" {
+		t.Fatalf("small job was stored as %q with encoding %q", j.Content, j.Encoding)
+	}
+
+	// content that doesn't get smaller is left as it is
+	if j := scanJob(t, raw, "random"); j.Encoding != "" || !bytes.Equal(j.Content, random) {
+		t.Fatalf("random job was stored with encoding %q", j.Encoding)
+	}
+
+	for id, want := range map[string][]byte{"big": big, "small": []byte("small"), "random": random} {
+		if j := scanJob(t, st, id); j.Encoding != "" || !bytes.Equal(j.Content, want) {
+			t.Errorf("job %s read back as %q with encoding %q", id, j.Content, j.Encoding)
+		}
+	}
+
+	// turning compression off doesn't stop compressed jobs being read
+	if j := scanJob(t, store.Compress(raw, 0), "big"); !bytes.Equal(j.Content, big) {
+		t.Fatalf("big job read back as %q with compression off", j.Content)
+	}
+
+	j, err = store.Compress(raw, 0).Reserve("q", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != "big" || j.Encoding != "" || !bytes.Equal(j.Content, big) {
+		t.Fatalf("reserved job %s as %q with encoding %q", j.ID, j.Content, j.Encoding)
+	}
+}
@@ -0,0 +1,119 @@
+package store // import "fknsrs.biz/p/jobserver/internal/store"
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+)
+
+// Encrypted content is recorded in a job's encoding as EncodingAESGCM, a
+// colon, and the ID of the key it was encrypted with. The content itself is a
+// random nonce followed by the AES-256-GCM ciphertext, with the job ID as
+// additional data so content can't be moved from one job to another.
+const EncodingAESGCM = "aes256gcm"
+
+// KeyID returns the ID of the key that the job's content is encrypted with,
+// or an empty string if it isn't encrypted.
+func KeyID(j *Job) string {
+	_, last := PopEncoding(j.Encoding)
+	if !strings.HasPrefix(last, EncodingAESGCM+":") {
+		return ""
+	}
+
+	return strings.TrimPrefix(last, EncodingAESGCM+":")
+}
+
+// EncryptContent encrypts the job's content with the primary key.
+func EncryptContent(k *keyring.Keyring, j *Job) error {
+	a, err := k.Get(k.Primary())
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, a.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	j.Content = a.Seal(nonce, nonce, j.Content, []byte(j.ID))
+	j.Encoding = PushEncoding(j.Encoding, EncodingAESGCM+":"+k.Primary())
+
+	return nil
+}
+
+// DecryptContent decrypts the job's content if it's encrypted, and reports
+// whether it was.
+func DecryptContent(k *keyring.Keyring, j *Job) (bool, error) {
+	id := KeyID(j)
+	if id == "" {
+		return false, nil
+	}
+
+	a, err := k.Get(id)
+	if err != nil {
+		return false, fmt.Errorf("job %s: %s", j.ID, err.Error())
+	}
+
+	if len(j.Content) < a.NonceSize() {
+		return false, fmt.Errorf("job %s: encrypted content is too short", j.ID)
+	}
+
+	d, err := a.Open(nil, j.Content[0:a.NonceSize()], j.Content[a.NonceSize():], []byte(j.ID))
+	if err != nil {
+		return false, fmt.Errorf("job %s: %s", j.ID, err.Error())
+	}
+
+	j.Content = d
+	j.Encoding, _ = PopEncoding(j.Encoding)
+
+	return true, nil
+}
+
+type encryptedStore struct {
+	Store
+	keys *keyring.Keyring
+}
+
+// Encrypt wraps a Store so that content is encrypted as it's written and
+// decrypted as it's read. Only content is encrypted; everything the store
+// needs for scheduling stays in the clear.
+func Encrypt(s Store, keys *keyring.Keyring) Store {
+	return &encryptedStore{Store: s, keys: keys}
+}
+
+func (s *encryptedStore) decrypt(j *Job, err error) (*Job, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := DecryptContent(s.keys, j); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (s *encryptedStore) Put(j *Job, conflict string) (string, error) {
+	c := *j
+	if err := EncryptContent(s.keys, &c); err != nil {
+		return "", err
+	}
+
+	return s.Store.Put(&c, conflict)
+}
+
+func (s *encryptedStore) Reserve(queue string, now time.Time) (*Job, error) {
+	return s.decrypt(s.Store.Reserve(queue, now))
+}
+
+func (s *encryptedStore) Peek(queue string, now time.Time) (*Job, error) {
+	return s.decrypt(s.Store.Peek(queue, now))
+}
+
+func (s *encryptedStore) Scan(queue, state, after string, now time.Time) (*Job, error) {
+	return s.decrypt(s.Store.Scan(queue, state, after, now))
+}
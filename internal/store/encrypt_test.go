@@ -0,0 +1,98 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/logstore"
+	"fknsrs.biz/p/jobserver/internal/store/storetest"
+)
+
+// testKeys makes a keyring from key IDs and the byte that each key is made
+// of, in order, so the first is the primary key.
+func testKeys(t *testing.T, keys ...string) *keyring.Keyring {
+	var b strings.Builder
+	for i := 0; i < len(keys); i += 2 {
+		b.WriteString(keys[i] + " " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(keys[i+1]), 32)) + "\n")
+	}
+
+	k, err := keyring.Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestEncryptStore(t *testing.T) {
+	keys := testKeys(t, "k1", "a")
+
+	if err := storetest.TestWrapper(func(path string) (store.Store, error) {
+		st, err := logstore.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return store.Encrypt(st, keys), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptContent(t *testing.T) {
+	raw := openRaw(t)
+	st := store.Encrypt(raw, testKeys(t, "k1", "a"))
+
+	secret := []byte("the secret content")
+	putJob(t, st, "j", secret)
+
+	j := scanJob(t, raw, "j")
+	if j.Encoding != store.EncodingAESGCM+":k1" {
+		t.Fatalf("job was stored with encoding %q", j.Encoding)
+	}
+	if bytes.Contains(j.Content, secret) || len(j.Content) <= len(secret) {
+		t.Fatalf("job was stored as %q", j.Content)
+	}
+
+	if j := scanJob(t, st, "j"); j.Encoding != "" || !bytes.Equal(j.Content, secret) {
+		t.Fatalf("job read back as %q with encoding %q", j.Content, j.Encoding)
+	}
+
+	// after rotating, new content uses the new key, and old content can
+	// still be read with the old one
+	rotated := store.Encrypt(raw, testKeys(t, "k2", "b", "k1", "a"))
+	putJob(t, rotated, "new", secret)
+
+	if j := scanJob(t, raw, "new"); j.Encoding != store.EncodingAESGCM+":k2" {
+		t.Fatalf("job put after rotating was stored with encoding %q", j.Encoding)
+	}
+	for _, id := range []string{"j", "new"} {
+		if j := scanJob(t, rotated, id); !bytes.Equal(j.Content, secret) {
+			t.Fatalf("job %s read back as %q after rotating", id, j.Content)
+		}
+	}
+}
+
+func TestEncryptWrongKey(t *testing.T) {
+	raw := openRaw(t)
+	putJob(t, store.Encrypt(raw, testKeys(t, "k1", "a")), "j", []byte("secret"))
+
+	for name, keys := range map[string]*keyring.Keyring{
+		"a different key with the same ID": testKeys(t, "k1", "b"),
+		"a keyring without the key":        testKeys(t, "k2", "a"),
+	} {
+		st := store.Encrypt(raw, keys)
+
+		if _, err := st.Scan("", "", "", time.Now()); err == nil || !strings.Contains(err.Error(), "job j") {
+			t.Errorf("reading with %s got %v, want an error about job j", name, err)
+		}
+		if _, err := st.Peek("q", time.Now()); err == nil {
+			t.Errorf("peeking with %s worked", name)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package logstore // import "fknsrs.biz/p/jobserver/internal/store/logstore"
+
+import (
+	"container/heap"
+	"math/rand"
+)
+
+// queue is the jobs in one queue. Ready jobs are kept in a heap with the next
+// one to hand out on top, and held jobs in a heap with the one that'll be
+// ready soonest on top, so that finding the next job doesn't mean looking at
+// every job in the queue.
+type queue struct {
+	jobs  map[string]*entry
+	ready entryHeap
+	held  entryHeap
+}
+
+func newQueue() *queue {
+	return &queue{
+		jobs:  make(map[string]*entry),
+		ready: entryHeap{less: readyBefore},
+		held:  entryHeap{less: heldBefore},
+	}
+}
+
+// readyBefore orders ready jobs by priority, with ties going to the job that
+// was put first.
+func readyBefore(a, b *entry) bool {
+	if a.job.Priority != b.job.Priority {
+		return a.job.Priority > b.job.Priority
+	}
+
+	return a.seq < b.seq
+}
+
+func heldBefore(a, b *entry) bool {
+	return a.job.HoldUntil < b.job.HoldUntil
+}
+
+// add adds a job to the queue. It starts out with the held jobs, and top moves
+// it over once it's ready.
+func (q *queue) add(e *entry) {
+	q.jobs[e.job.ID] = e
+	e.heap = &q.held
+	heap.Push(&q.held, e)
+}
+
+func (q *queue) remove(e *entry) {
+	delete(q.jobs, e.job.ID)
+	heap.Remove(e.heap, e.index)
+	e.heap = nil
+}
+
+// top returns the highest priority job that's ready at now, or nil if there
+// isn't one.
+func (q *queue) top(now int64) *entry {
+	for q.held.Len() > 0 && q.held.entries[0].job.HoldUntil < now {
+		q.move(heap.Pop(&q.held).(*entry), &q.ready)
+	}
+
+	// the clock can go backwards, so jobs that were ready might not be any
+	// more
+	for q.ready.Len() > 0 {
+		if e := q.ready.entries[0]; e.job.HoldUntil < now {
+			return e
+		}
+
+		q.move(heap.Pop(&q.ready).(*entry), &q.held)
+	}
+
+	return nil
+}
+
+func (q *queue) move(e *entry, h *entryHeap) {
+	e.heap = h
+	heap.Push(h, e)
+}
+
+// entryHeap is a heap.Interface of entries, ordered by less. Entries keep
+// track of where they are in it, so that they can be taken out from the
+// middle.
+type entryHeap struct {
+	entries []*entry
+	less    func(a, b *entry) bool
+}
+
+func (h *entryHeap) Len() int { return len(h.entries) }
+
+func (h *entryHeap) Less(i, j int) bool { return h.less(h.entries[i], h.entries[j]) }
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	n := len(h.entries) - 1
+	e := h.entries[n]
+	h.entries[n] = nil
+	h.entries = h.entries[:n]
+
+	return e
+}
+
+// idTree holds the ID of every job in order, so that jobs can be scanned by
+// ID. It's a treap, which stays balanced without much bookkeeping.
+type idTree struct {
+	root *idNode
+}
+
+type idNode struct {
+	id          string
+	priority    uint32
+	left, right *idNode
+}
+
+func (t *idTree) insert(id string) {
+	t.root = insertID(t.root, id, rand.Uint32())
+}
+
+func (t *idTree) delete(id string) {
+	t.root = deleteID(t.root, id)
+}
+
+// after returns the lowest ID greater than id.
+func (t *idTree) after(id string) (string, bool) {
+	var best *idNode
+	for n := t.root; n != nil; {
+		if n.id > id {
+			best, n = n, n.left
+		} else {
+			n = n.right
+		}
+	}
+
+	if best == nil {
+		return "", false
+	}
+
+	return best.id, true
+}
+
+// each calls fn with every ID, in order.
+func (t *idTree) each(fn func(id string)) {
+	var walk func(n *idNode)
+	walk = func(n *idNode) {
+		if n == nil {
+			return
+		}
+
+		walk(n.left)
+		fn(n.id)
+		walk(n.right)
+	}
+
+	walk(t.root)
+}
+
+func insertID(n *idNode, id string, priority uint32) *idNode {
+	switch {
+	case n == nil:
+		return &idNode{id: id, priority: priority}
+	case id < n.id:
+		n.left = insertID(n.left, id, priority)
+		if n.left.priority > n.priority {
+			l := n.left
+			n.left, l.right = l.right, n
+			return l
+		}
+	case id > n.id:
+		n.right = insertID(n.right, id, priority)
+		if n.right.priority > n.priority {
+			r := n.right
+			n.right, r.left = r.left, n
+			return r
+		}
+	}
+
+	return n
+}
+
+func deleteID(n *idNode, id string) *idNode {
+	switch {
+	case n == nil:
+		return nil
+	case id < n.id:
+		n.left = deleteID(n.left, id)
+	case id > n.id:
+		n.right = deleteID(n.right, id)
+	default:
+		return mergeIDs(n.left, n.right)
+	}
+
+	return n
+}
+
+// mergeIDs joins two trees, where every ID in a is lower than every ID in b.
+func mergeIDs(a, b *idNode) *idNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		a.right = mergeIDs(a.right, b)
+		return a
+	default:
+		b.left = mergeIDs(a, b.left)
+		return b
+	}
+}
@@ -0,0 +1,818 @@
+package logstore // import "fknsrs.biz/p/jobserver/internal/store/logstore"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+)
+
+// A log file starts with magic, followed by records. Each record is a header
+// of four big-endian uint32s (metadata length, content length, a CRC32 of
+// everything after the header and a CRC32 of the rest of the header), then
+// JSON metadata, then the raw content. The header has its own checksum so that
+// a corrupt length can't pass for a record that was cut short.
+//
+// A "put" record carries a whole job. A "meta" record changes a job's
+// metadata and leaves its content where it was, which keeps reserves cheap. A
+// "delete" record removes a job.
+var magic = []byte("JOBLOG2\n")
+
+const headerSize = 16
+
+var (
+	// MinCompactSize is the smallest log that will be compacted. Logs are
+	// compacted once they're more than twice the size of their live data.
+	MinCompactSize int64 = 64 * 1024 * 1024
+)
+
+var (
+	ErrBadMagic  = errors.New("not a job log")
+	ErrBadRecord = errors.New("corrupt record")
+	ErrClosed    = errors.New("store closed")
+)
+
+// meta is a record's metadata. Seq is the order that jobs were first put in,
+// which breaks ties between jobs of the same priority. It's kept in the log so
+// that compaction, which writes jobs out in ID order, doesn't change it.
+type meta struct {
+	Op          string  `json:"op"`
+	ID          string  `json:"id"`
+	Seq         uint64  `json:"seq,omitempty"`
+	Queue       string  `json:"queue,omitempty"`
+	Priority    float64 `json:"priority,omitempty"`
+	HoldUntil   int64   `json:"hold_until,omitempty"`
+	TTR         uint64  `json:"ttr,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	Encoding    string  `json:"encoding,omitempty"`
+}
+
+// entry is a job in the index. offset and length locate its content, and size
+// is the size of the put record that would be needed to write it out again.
+// heap and index are where it is in its queue.
+type entry struct {
+	job    store.Job
+	seq    uint64
+	offset int64
+	length int64
+	size   int64
+	heap   *entryHeap
+	index  int
+}
+
+// Store keeps jobs in an append-only log file, with an index of every job's
+// metadata held in memory. Content stays on disk until it's needed.
+type Store struct {
+	m       sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	live    int64
+	seq     uint64
+	jobs    map[string]*entry
+	queues  map[string]*queue
+	ids     idTree
+	backups int
+	// compactAfter is how big the log has to get before compaction is tried
+	// again, after it's failed.
+	compactAfter int64
+}
+
+func Open(path string) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Store{
+		path:   path,
+		f:      f,
+		jobs:   make(map[string]*entry),
+		queues: make(map[string]*queue),
+	}
+
+	if err := s.load(false); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *Store) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return ErrClosed
+	}
+
+	err := s.f.Close()
+	s.f = nil
+
+	return err
+}
+
+// load replays the log into the index. A torn record at the end of the log is
+// what a crash mid-write leaves behind; unless strict is set, the log is
+// truncated back to the last whole record. A bad record with more records
+// after it can't have come from a crash, so that's always an error, and so is
+// a bad header, since there's no telling where its record would have ended.
+func (s *Store) load(strict bool) error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == 0 {
+		if strict {
+			return ErrBadMagic
+		}
+
+		if _, err := s.f.WriteAt(magic, 0); err != nil {
+			return err
+		}
+		s.size = int64(len(magic))
+
+		return s.f.Sync()
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, fi.Size()))
+
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, m); err != nil || string(m) != string(magic) {
+		return ErrBadMagic
+	}
+
+	off := int64(len(magic))
+	for {
+		n, err := s.replay(r, off, fi.Size()-off)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF || (err == ErrBadRecord && (off+n == fi.Size() || n == 0 && !s.validAfter(off+1, fi.Size()))) {
+			if strict {
+				return fmt.Errorf("%s at offset %d", ErrBadRecord.Error(), off)
+			}
+
+			if err := s.f.Truncate(off); err != nil {
+				return err
+			}
+
+			break
+		} else if err == ErrBadRecord {
+			return fmt.Errorf("%s at offset %d", ErrBadRecord.Error(), off)
+		} else if err != nil {
+			return err
+		}
+
+		off += n
+	}
+
+	s.size = off
+
+	return nil
+}
+
+// replay reads a record and applies it to the index, returning the record's
+// length. A record that turns out to be bad still has its length returned, so
+// that load can tell whether it was the last one. A record that runs past the
+// end of the log is io.ErrUnexpectedEOF, which is only trusted once the header
+// has checked out. A header that doesn't check out has a length of zero, since
+// the lengths in it can't be trusted.
+func (s *Store) replay(r io.Reader, off, remaining int64) (int64, error) {
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return 0, err
+	}
+
+	if crc32.ChecksumIEEE(h[0:12]) != binary.BigEndian.Uint32(h[12:16]) {
+		return 0, ErrBadRecord
+	}
+
+	ml := int64(binary.BigEndian.Uint32(h[0:4]))
+	cl := int64(binary.BigEndian.Uint32(h[4:8]))
+
+	n := headerSize + ml + cl
+	if n > remaining {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	d := make([]byte, ml+cl)
+	if _, err := io.ReadFull(r, d); err != nil {
+		return 0, err
+	}
+
+	if crc32.ChecksumIEEE(d) != binary.BigEndian.Uint32(h[8:12]) {
+		return n, ErrBadRecord
+	}
+
+	var md meta
+	if err := json.Unmarshal(d[0:ml], &md); err != nil {
+		return n, ErrBadRecord
+	}
+
+	switch md.Op {
+	case "put":
+		s.index(&md, off+headerSize+ml, cl, headerSize+ml+cl)
+	case "meta":
+		e, ok := s.jobs[md.ID]
+		if !ok {
+			return n, ErrBadRecord
+		}
+		s.index(&md, e.offset, e.length, e.size)
+	case "delete":
+		s.unindex(md.ID)
+	default:
+		return n, ErrBadRecord
+	}
+
+	return n, nil
+}
+
+// validAfter reports whether there's a whole record anywhere in the log from
+// off up to size. A bad header with nothing valid after it is a record that
+// was torn while its header was being written, rather than a corrupt one in
+// the middle of the log.
+func (s *Store) validAfter(off, size int64) bool {
+	r := bufio.NewReader(io.NewSectionReader(s.f, off, size-off))
+
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return false
+	}
+
+	for p := off; ; p++ {
+		if crc32.ChecksumIEEE(h[0:12]) == binary.BigEndian.Uint32(h[12:16]) {
+			l := int64(binary.BigEndian.Uint32(h[0:4])) + int64(binary.BigEndian.Uint32(h[4:8]))
+			if p+headerSize+l <= size {
+				d := make([]byte, l)
+				if _, err := s.f.ReadAt(d, p+headerSize); err == nil && crc32.ChecksumIEEE(d) == binary.BigEndian.Uint32(h[8:12]) {
+					return true
+				}
+			}
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		copy(h, h[1:])
+		h[headerSize-1] = b
+	}
+}
+
+func (s *Store) index(md *meta, offset, length, size int64) {
+	e, ok := s.jobs[md.ID]
+	if !ok {
+		e = &entry{seq: md.Seq}
+		s.jobs[md.ID] = e
+		s.ids.insert(md.ID)
+
+		if md.Seq > s.seq {
+			s.seq = md.Seq
+		}
+	} else {
+		s.live -= e.size
+		s.dequeue(e)
+	}
+
+	e.job = store.Job{
+		ID:          md.ID,
+		Queue:       md.Queue,
+		Priority:    md.Priority,
+		HoldUntil:   md.HoldUntil,
+		TTR:         md.TTR,
+		ContentType: md.ContentType,
+		Encoding:    md.Encoding,
+	}
+	e.offset = offset
+	e.length = length
+	e.size = size
+
+	s.live += size
+
+	q, ok := s.queues[md.Queue]
+	if !ok {
+		q = newQueue()
+		s.queues[md.Queue] = q
+	}
+	q.add(e)
+}
+
+func (s *Store) unindex(id string) {
+	e, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+
+	s.live -= e.size
+
+	delete(s.jobs, id)
+	s.dequeue(e)
+	s.ids.delete(id)
+}
+
+// dequeue takes a job out of its queue, and drops the queue if it's empty.
+func (s *Store) dequeue(e *entry) {
+	q := s.queues[e.job.Queue]
+
+	q.remove(e)
+	if len(q.jobs) == 0 {
+		delete(s.queues, e.job.Queue)
+	}
+}
+
+func encodeRecord(md *meta, content []byte) ([]byte, error) {
+	m, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	d := make([]byte, headerSize+len(m)+len(content))
+	copy(d[headerSize:], m)
+	copy(d[headerSize+len(m):], content)
+
+	binary.BigEndian.PutUint32(d[0:4], uint32(len(m)))
+	binary.BigEndian.PutUint32(d[4:8], uint32(len(content)))
+	binary.BigEndian.PutUint32(d[8:12], crc32.ChecksumIEEE(d[headerSize:]))
+	binary.BigEndian.PutUint32(d[12:16], crc32.ChecksumIEEE(d[0:12]))
+
+	return d, nil
+}
+
+// write appends a record to the log and updates the index to match.
+func (s *Store) write(md *meta, content []byte) error {
+	if s.f == nil {
+		return ErrClosed
+	}
+
+	if md.Op != "delete" {
+		if e, ok := s.jobs[md.ID]; ok {
+			md.Seq = e.seq
+		} else {
+			md.Seq = s.seq + 1
+		}
+	}
+
+	d, err := encodeRecord(md, content)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.f.WriteAt(d, s.size); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+
+	off := s.size
+	s.size += int64(len(d))
+
+	switch md.Op {
+	case "put":
+		s.index(md, off+int64(len(d)-len(content)), int64(len(content)), int64(len(d)))
+	case "meta":
+		e := s.jobs[md.ID]
+		s.index(md, e.offset, e.length, e.size)
+	case "delete":
+		s.unindex(md.ID)
+	}
+
+	// the record is safely written by now, so a compaction that fails isn't
+	// the caller's problem. it's tried again once the log has grown some more.
+	if s.backups == 0 && s.size > MinCompactSize && s.size > s.live*2 && s.size > s.compactAfter {
+		if err := s.compact(); err != nil {
+			s.compactAfter = s.size + MinCompactSize
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) read(e *entry) (*store.Job, error) {
+	j := e.job
+	j.Content = make([]byte, e.length)
+
+	if _, err := s.f.ReadAt(j.Content, e.offset); err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+func metaFor(op string, j *store.Job) *meta {
+	return &meta{
+		Op:          op,
+		ID:          j.ID,
+		Queue:       j.Queue,
+		Priority:    j.Priority,
+		HoldUntil:   j.HoldUntil,
+		TTR:         j.TTR,
+		ContentType: j.ContentType,
+		Encoding:    j.Encoding,
+	}
+}
+
+func (s *Store) Put(j *store.Job, conflict string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.jobs[j.ID]
+	if !ok {
+		return store.Created, s.write(metaFor("put", j), j.Content)
+	}
+
+	switch conflict {
+	case store.ConflictSkip:
+		return store.Skipped, nil
+	case store.ConflictFail:
+		return "", store.ErrExists
+	case store.ConflictReplace:
+		return store.Replaced, s.write(metaFor("put", j), j.Content)
+	default:
+		u := e.job
+		u.Priority = j.Priority
+		u.TTR = j.TTR
+		if j.HoldUntil < u.HoldUntil {
+			u.HoldUntil = j.HoldUntil
+		}
+
+		return store.Updated, s.write(metaFor("meta", &u), nil)
+	}
+}
+
+// top finds the highest priority ready job in a queue. Ties go to the job
+// that was put first.
+func (s *Store) top(queue string, now time.Time) *entry {
+	q, ok := s.queues[queue]
+	if !ok {
+		return nil
+	}
+
+	return q.top(now.Unix())
+}
+
+func (s *Store) Reserve(queue string, now time.Time) (*store.Job, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+
+	e := s.top(queue, now)
+	if e == nil {
+		return nil, store.ErrEmpty
+	}
+
+	j, err := s.read(e)
+	if err != nil {
+		return nil, err
+	}
+
+	u := e.job
+	u.HoldUntil = now.Unix() + int64(u.TTR)
+	if err := s.write(metaFor("meta", &u), nil); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (s *Store) Peek(queue string, now time.Time) (*store.Job, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+
+	e := s.top(queue, now)
+	if e == nil {
+		return nil, store.ErrEmpty
+	}
+
+	return s.read(e)
+}
+
+func (s *Store) Scan(queue, state, after string, now time.Time) (*store.Job, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+
+	for id, ok := s.ids.after(after); ok; id, ok = s.ids.after(id) {
+		e := s.jobs[id]
+
+		if queue != "" && e.job.Queue != queue {
+			continue
+		}
+
+		switch state {
+		case store.StateReady:
+			if e.job.HoldUntil >= now.Unix() {
+				continue
+			}
+		case store.StateHeld:
+			if e.job.HoldUntil < now.Unix() {
+				continue
+			}
+		}
+
+		return s.read(e)
+	}
+
+	return nil, store.ErrEmpty
+}
+
+func (s *Store) Queue(id string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return "", ErrClosed
+	}
+
+	e, ok := s.jobs[id]
+	if !ok {
+		return "", store.ErrNotFound
+	}
+
+	return e.job.Queue, nil
+}
+
+func (s *Store) Stats(queue, after string, now time.Time) (*store.QueueStats, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+
+	name := ""
+	for q := range s.queues {
+		if q > after && (queue == "" || q == queue) && (name == "" || q < name) {
+			name = q
+		}
+	}
+	if name == "" {
+		return nil, store.ErrEmpty
+	}
+
+	st := store.QueueStats{Queue: name}
+	for _, e := range s.queues[name].jobs {
+		if e.job.HoldUntil < now.Unix() {
+			st.Ready++
+		} else {
+			st.Held++
+		}
+	}
+
+	return &st, nil
+}
+
+func (s *Store) Delete(queue, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.jobs[id]
+	if !ok || e.job.Queue != queue {
+		return store.ErrNotFound
+	}
+
+	return s.write(&meta{Op: "delete", ID: id}, nil)
+}
+
+func (s *Store) Reschedule(queue, id string, priority float64, holdUntil int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.jobs[id]
+	if !ok || e.job.Queue != queue {
+		return store.ErrNotFound
+	}
+
+	u := e.job
+	u.Priority = priority
+	u.HoldUntil = holdUntil
+
+	return s.write(metaFor("meta", &u), nil)
+}
+
+func (s *Store) SetContent(j *store.Job, content []byte, encoding string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		return ErrClosed
+	}
+
+	e, ok := s.jobs[j.ID]
+	if !ok || e.job.Encoding != j.Encoding || e.length != int64(len(j.Content)) {
+		return store.ErrNotFound
+	}
+
+	old, err := s.read(e)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(old.Content, j.Content) {
+		return store.ErrNotFound
+	}
+
+	u := e.job
+	u.Encoding = encoding
+
+	return s.write(metaFor("put", &u), content)
+}
+
+// writeSnapshot writes a log containing only a put record for each of the
+// given entries, reading their content from src.
+func writeSnapshot(path string, src *os.File, entries []entry) ([]entry, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+
+	if _, err := w.Write(magic); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	off := int64(len(magic))
+	out := make([]entry, len(entries))
+	for i, e := range entries {
+		c := make([]byte, e.length)
+		if _, err := src.ReadAt(c, e.offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		md := metaFor("put", &e.job)
+		md.Seq = e.seq
+
+		d, err := encodeRecord(md, c)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if _, err := w.Write(d); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		out[i] = e
+		out[i].offset = off + int64(len(d)-len(c))
+		out[i].size = int64(len(d))
+		off += int64(len(d))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return out, f.Close()
+}
+
+// entries copies the index, in ID order.
+func (s *Store) entries() []entry {
+	r := make([]entry, 0, len(s.jobs))
+	s.ids.each(func(id string) {
+		r = append(r, *s.jobs[id])
+	})
+
+	return r
+}
+
+// compact rewrites the log with only the live records in it. It must be
+// called with s.m held.
+func (s *Store) compact() error {
+	tmp := s.path + ".compact"
+
+	entries, err := writeSnapshot(tmp, s.f, s.entries())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// everything that can fail happens before the rename, so that the store
+	// never ends up writing to a log that's no longer at s.path
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	s.f.Close()
+	s.f = f
+	s.size = fi.Size()
+	s.compactAfter = 0
+
+	s.live = 0
+	for _, e := range entries {
+		j := s.jobs[e.job.ID]
+		j.offset = e.offset
+		j.size = e.size
+		s.live += e.size
+	}
+
+	return nil
+}
+
+// Backup writes a compacted copy of the log to path. The index is copied up
+// front and content is read from the log afterwards, which is safe because
+// records are never changed once written and compaction waits for backups to
+// finish.
+func (s *Store) Backup(path string) error {
+	s.m.Lock()
+	if s.f == nil {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	entries := s.entries()
+	src := s.f
+	s.backups++
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		s.backups--
+		s.m.Unlock()
+	}()
+
+	// whatever's at tmp is removed rather than written through, in case it's
+	// a symlink
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := writeSnapshot(tmp, src, entries); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Validate checks that every record in the log at path is intact.
+func Validate(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := Store{
+		path:   path,
+		f:      f,
+		jobs:   make(map[string]*entry),
+		queues: make(map[string]*queue),
+	}
+
+	return s.load(true)
+}
+
+// Restore validates the snapshot at src and installs it at dst. Nothing may
+// have dst open while this runs.
+func Restore(src, dst string, force bool) error {
+	if err := Validate(src); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %s", src, err.Error())
+	}
+
+	return store.Install(src, dst, force, dst+".compact")
+}
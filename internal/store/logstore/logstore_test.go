@@ -0,0 +1,310 @@
+package logstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/storetest"
+)
+
+func open(path string) (store.Store, error) {
+	return Open(path)
+}
+
+func TestStore(t *testing.T) {
+	if err := storetest.TestStore(open); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCompacting(t *testing.T) {
+	defer func(n int64) { MinCompactSize = n }(MinCompactSize)
+	MinCompactSize = 1
+
+	if err := storetest.TestStore(open); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeLog makes a log with a job for each of ids, each with its ID as its
+// content, and returns its path and contents.
+func writeLog(t *testing.T, dir string, ids ...string) (string, []byte) {
+	path := filepath.Join(dir, "jobs")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		if _, err := s.Put(&store.Job{ID: id, Queue: "q", Content: []byte(id)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, d
+}
+
+func checkIDs(t *testing.T, s *Store, want ...string) {
+	var got []string
+	for after := ""; ; {
+		j, err := s.Scan("", "", after, time.Now())
+		if err == store.ErrEmpty {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, j.ID)
+		after = j.ID
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got jobs %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got jobs %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tear func(d []byte) []byte
+		want []string
+	}{
+		{"short record", func(d []byte) []byte { return d[:len(d)-3] }, []string{"a"}},
+		{"short header", func(d []byte) []byte { return append(d, 0, 0, 0) }, []string{"a", "b"}},
+		{"bad checksum", func(d []byte) []byte { d[len(d)-1] ^= 0xff; return d }, []string{"a"}},
+		{"bad header", func(d []byte) []byte { return append(d, make([]byte, headerSize)...) }, []string{"a", "b"}},
+		{"bad header and junk", func(d []byte) []byte { return append(d, bytes.Repeat([]byte{0xff}, headerSize*3)...) }, []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "logstore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path, d := writeLog(t, dir, "a", "b")
+			if err := ioutil.WriteFile(path, tc.tear(d), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Validate(path); err == nil {
+				t.Fatal("torn log passed validation")
+			}
+
+			s, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkIDs(t, s, tc.want...)
+
+			if _, err := s.Put(&store.Job{ID: "c", Queue: "q", Content: []byte("c")}, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Validate(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if s, err = Open(path); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			checkIDs(t, s, append(tc.want, "c")...)
+		})
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path, d := writeLog(t, dir, "first", "second", "third")
+
+	i := bytes.LastIndex(d, []byte("second"))
+	d[i] ^= 0xff
+	if err := ioutil.WriteFile(path, d, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(path); err == nil {
+		t.Fatal("corrupt log passed validation")
+	}
+
+	if s, err := Open(path); err == nil {
+		s.Close()
+		t.Fatal("opened a log with a corrupt record in the middle")
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, d) {
+		t.Fatalf("log was changed from %d bytes to %d by trying to open it", len(d), len(after))
+	}
+}
+
+func TestCorruptLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path, d := writeLog(t, dir, "first", "second", "third")
+
+	// the content length of the second record, which would run it past the
+	// end of the log if it were believed
+	i := bytes.Index(d, []byte(`{"op":"put","id":"second"`)) - headerSize + 4
+	d[i] ^= 0x01
+	if err := ioutil.WriteFile(path, d, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(path); err == nil {
+		t.Fatal("log with a corrupt length passed validation")
+	}
+
+	if s, err := Open(path); err == nil {
+		s.Close()
+		t.Fatal("opened a log with a corrupt length in the middle")
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, d) {
+		t.Fatalf("log was changed from %d bytes to %d by trying to open it", len(d), len(after))
+	}
+}
+
+func TestOrderAfterBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// backups are written in ID order, which is the opposite of the order the
+	// jobs were put in
+	path, _ := writeLog(t, dir, "c", "b", "a")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	backup := filepath.Join(dir, "backup")
+	if err := s.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	now := time.Now()
+	for _, want := range []string{"c", "b", "a"} {
+		j, err := b.Reserve("q", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.ID != want {
+			t.Fatalf("reserved job %q, want %q", j.ID, want)
+		}
+	}
+}
+
+func TestHeldJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Unix(1500000000, 0)
+
+	for i, id := range []string{"low", "high", "later"} {
+		j := store.Job{ID: id, Queue: "q", Priority: float64(i), HoldUntil: now.Unix() - 1, TTR: 60}
+		if id == "later" {
+			j.Priority, j.HoldUntil = 10, now.Unix()+60
+		}
+
+		if _, err := s.Put(&j, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peek := func(now time.Time) string {
+		j, err := s.Peek("q", now)
+		if err == store.ErrEmpty {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		return j.ID
+	}
+
+	if id := peek(now); id != "high" {
+		t.Fatalf("peeked %q, want %q", id, "high")
+	}
+	if id := peek(now.Add(time.Minute * 2)); id != "later" {
+		t.Fatalf("peeked %q once it was ready, want %q", id, "later")
+	}
+	// and the clock can go backwards
+	if id := peek(now); id != "high" {
+		t.Fatalf("peeked %q after going back in time, want %q", id, "high")
+	}
+
+	if _, err := s.Reserve("q", now); err != nil {
+		t.Fatal(err)
+	}
+	if id := peek(now); id != "low" {
+		t.Fatalf("peeked %q after reserving, want %q", id, "low")
+	}
+	if err := s.Reschedule("q", "low", 0, now.Unix()+30); err != nil {
+		t.Fatal(err)
+	}
+	if id := peek(now); id != "" {
+		t.Fatalf("peeked %q with every job held", id)
+	}
+}
@@ -0,0 +1,472 @@
+package sqlite // import "fknsrs.biz/p/jobserver/internal/store/sqlite"
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	createTableQuery = `create table if not exists "jobs" ("id" text primary key, "queue" text not null, "priority" float not null, "hold_until" integer not null, "ttr" integer, "content" blob not null, "encoding" text not null default '', "content_type" text not null default '')`
+	tableInfoQuery   = `pragma table_info("jobs")`
+	addEncodingQuery = `alter table "jobs" add column "encoding" text not null default ''`
+	addTypeQuery     = `alter table "jobs" add column "content_type" text not null default ''`
+	fetchJobQuery    = `select "queue", "priority", "hold_until", "ttr" from "jobs" where "id" = ?`
+	putJobQuery      = `insert into "jobs" ("id", "queue", "priority", "hold_until", "ttr", "content_type", "encoding", "content") values (?, ?, ?, ?, ?, ?, ?, ?)`
+	getTopJobQuery   = `select "id", "queue", "priority", "hold_until", "ttr", "content_type", "encoding", "content" from "jobs" where "queue" = ? and "hold_until" < ? order by "priority" desc limit 1`
+	reserveJobQuery  = `update "jobs" set "hold_until" = ? + "ttr" where "id" = ?`
+	updateJobQuery   = `update "jobs" set "priority" = ?, "hold_until" = ?, "ttr" = ? where "id" = ?`
+	replaceJobQuery  = `update "jobs" set "queue" = ?, "priority" = ?, "hold_until" = ?, "ttr" = ?, "content_type" = ?, "encoding" = ?, "content" = ? where "id" = ?`
+	rescheduleQuery  = `update "jobs" set "priority" = ?, "hold_until" = ? where "queue" = ? and "id" = ?`
+	setContentQuery  = `update "jobs" set "encoding" = ?, "content" = ? where "id" = ? and "encoding" = ? and cast("content" as blob) = ?`
+	jobQueueQuery    = `select "queue" from "jobs" where "id" = ?`
+	scanJobsQuery    = `select "id", "queue", "priority", "hold_until", "ttr", "content_type", "encoding", "content" from "jobs" where "id" > ? and (? = '' or "queue" = ?) and (? = '' or (? = 'ready' and "hold_until" < ?) or (? = 'held' and "hold_until" >= ?)) order by "id" limit 1`
+	deleteJobQuery   = `delete from "jobs" where "queue" = ? and "id" = ?`
+	queueStatsQuery  = `select "queue", sum("hold_until" < ?), sum("hold_until" >= ?) from "jobs" where "queue" > ? and (? = '' or "queue" = ?) group by "queue" order by "queue" limit 1`
+)
+
+var (
+	backupStepPages = 256
+	backupStepDelay = time.Millisecond * 10
+)
+
+var (
+	ErrBackupRunning = errors.New("backup already running")
+	ErrNotConnected  = errors.New("database not connected")
+)
+
+const driverName = "sqlite3_jobserver"
+
+// stores are the open stores, by the IDs that their DSNs start with, so that
+// the driver can tell each one about its connection.
+var (
+	storesM    sync.Mutex
+	stores     = make(map[string]*Store)
+	storeCount int64
+)
+
+func init() {
+	sql.Register(driverName, connDriver{})
+}
+
+// connDriver opens connections with the sqlite3 driver. DSNs are a store's ID
+// and the database's path, separated by a colon, and the store with that ID
+// is told about the connection.
+type connDriver struct{}
+
+func (connDriver) Open(dsn string) (driver.Conn, error) {
+	i := strings.Index(dsn, ":")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid dsn %q", dsn)
+	}
+
+	storesM.Lock()
+	s := stores[dsn[0:i]]
+	storesM.Unlock()
+
+	if s == nil {
+		return nil, fmt.Errorf("no store with id %s", dsn[0:i])
+	}
+
+	c, err := (&sqlite3.SQLiteDriver{}).Open(dsn[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	s.connM.Lock()
+	s.conn = c.(*sqlite3.SQLiteConn)
+	s.connM.Unlock()
+
+	return c, nil
+}
+
+// Store keeps jobs in a SQLite database.
+//
+// The database is opened with a single connection, and the driver keeps
+// track of it. Online backups read from that same connection, so any writes
+// made while a backup is running are picked up by SQLite instead of forcing
+// the backup to start over.
+type Store struct {
+	id         string
+	db         *sql.DB
+	connM      sync.Mutex
+	conn       *sqlite3.SQLiteConn
+	backupBusy int32
+}
+
+func Open(path string) (*Store, error) {
+	s := Store{id: strconv.FormatInt(atomic.AddInt64(&storeCount, 1), 10)}
+
+	storesM.Lock()
+	stores[s.id] = &s
+	storesM.Unlock()
+
+	db, err := sql.Open(driverName, s.id+":"+path)
+	if err != nil {
+		s.forget()
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(createTableQuery); err != nil {
+		db.Close()
+		s.forget()
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		s.forget()
+		return nil, err
+	}
+
+	s.db = db
+
+	return &s, nil
+}
+
+// migrate brings databases created by older versions up to date. Columns are
+// only ever added, with defaults that keep old rows meaning what they did.
+// Older databases declare content as text rather than blob, which doesn't
+// need changing; SQLite never converts blobs to text, so binary content is
+// kept as it is either way.
+func migrate(db *sql.DB) error {
+	rows, err := db.Query(tableInfoQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var def sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &def, &pk); err != nil {
+			return err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if !columns["encoding"] {
+		if _, err := db.Exec(addEncodingQuery); err != nil {
+			return err
+		}
+	}
+
+	if !columns["content_type"] {
+		if _, err := db.Exec(addTypeQuery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget stops the driver from telling the store about new connections.
+func (s *Store) forget() {
+	storesM.Lock()
+	delete(stores, s.id)
+	storesM.Unlock()
+}
+
+func (s *Store) Close() error {
+	defer s.forget()
+
+	return s.db.Close()
+}
+
+func (s *Store) withTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) Put(j *store.Job, conflict string) (string, error) {
+	var result string
+
+	err := s.withTx(func(tx *sql.Tx) error {
+		var queue string
+		var priority float64
+		var holdUntil int64
+		var ttr uint64
+
+		if err := tx.QueryRow(fetchJobQuery, j.ID).Scan(&queue, &priority, &holdUntil, &ttr); err == sql.ErrNoRows {
+			if _, err := tx.Exec(putJobQuery, j.ID, j.Queue, j.Priority, j.HoldUntil, j.TTR, j.ContentType, j.Encoding, j.Content); err != nil {
+				return err
+			}
+
+			result = store.Created
+
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch conflict {
+		case store.ConflictSkip:
+			result = store.Skipped
+		case store.ConflictFail:
+			return store.ErrExists
+		case store.ConflictReplace:
+			if _, err := tx.Exec(replaceJobQuery, j.Queue, j.Priority, j.HoldUntil, j.TTR, j.ContentType, j.Encoding, j.Content, j.ID); err != nil {
+				return err
+			}
+
+			result = store.Replaced
+		default:
+			if _, err := tx.Exec(updateJobQuery, j.Priority, minInt64(j.HoldUntil, holdUntil), j.TTR, j.ID); err != nil {
+				return err
+			}
+
+			result = store.Updated
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func scanJob(row *sql.Row) (*store.Job, error) {
+	var j store.Job
+	if err := row.Scan(&j.ID, &j.Queue, &j.Priority, &j.HoldUntil, &j.TTR, &j.ContentType, &j.Encoding, &j.Content); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, store.ErrEmpty
+		}
+
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+func (s *Store) Reserve(queue string, now time.Time) (*store.Job, error) {
+	var j *store.Job
+
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		if j, err = scanJob(tx.QueryRow(getTopJobQuery, queue, now.Unix())); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(reserveJobQuery, now.Unix(), j.ID); err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	return j, err
+}
+
+func (s *Store) Peek(queue string, now time.Time) (*store.Job, error) {
+	return scanJob(s.db.QueryRow(getTopJobQuery, queue, now.Unix()))
+}
+
+func (s *Store) Scan(queue, state, after string, now time.Time) (*store.Job, error) {
+	return scanJob(s.db.QueryRow(scanJobsQuery, after, queue, queue, state, state, now.Unix(), state, now.Unix()))
+}
+
+func (s *Store) Queue(id string) (string, error) {
+	var queue string
+	if err := s.db.QueryRow(jobQueueQuery, id).Scan(&queue); err != nil {
+		if err == sql.ErrNoRows {
+			return "", store.ErrNotFound
+		}
+
+		return "", err
+	}
+
+	return queue, nil
+}
+
+func (s *Store) Stats(queue, after string, now time.Time) (*store.QueueStats, error) {
+	var st store.QueueStats
+	if err := s.db.QueryRow(queueStatsQuery, now.Unix(), now.Unix(), after, queue, queue).Scan(&st.Queue, &st.Ready, &st.Held); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, store.ErrEmpty
+		}
+
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func (s *Store) Delete(queue, id string) error {
+	r, err := s.db.Exec(deleteJobQuery, queue, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return store.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) Reschedule(queue, id string, priority float64, holdUntil int64) error {
+	r, err := s.db.Exec(rescheduleQuery, priority, holdUntil, queue, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return store.ErrNotFound
+	}
+
+	return nil
+}
+
+// SetContent compares content as a blob, since older databases can have it
+// stored as text.
+func (s *Store) SetContent(j *store.Job, content []byte, encoding string) error {
+	r, err := s.db.Exec(setContentQuery, encoding, content, j.ID, j.Encoding, j.Content)
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return store.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) Backup(path string) error {
+	if !atomic.CompareAndSwapInt32(&s.backupBusy, 0, 1) {
+		return ErrBackupRunning
+	}
+	defer atomic.StoreInt32(&s.backupBusy, 0)
+
+	s.connM.Lock()
+	src := s.conn
+	s.connM.Unlock()
+
+	if src == nil {
+		return ErrNotConnected
+	}
+
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	d, err := (&sqlite3.SQLiteDriver{}).Open(tmp)
+	if err != nil {
+		return err
+	}
+	dst := d.(*sqlite3.SQLiteConn)
+
+	if err := func() error {
+		defer dst.Close()
+
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return err
+		}
+
+		for {
+			done, err := b.Step(backupStepPages)
+			if err != nil {
+				b.Close()
+				return err
+			}
+			if done {
+				break
+			}
+
+			time.Sleep(backupStepDelay)
+		}
+
+		return b.Close()
+	}(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Validate checks that the file at path is an intact SQLite database with a
+// jobs table that this package can read.
+func Validate(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("pragma integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	rows, err := db.Query(`select "id", "queue", "priority", "hold_until", "ttr", "content" from "jobs" limit 1`)
+	if err != nil {
+		return err
+	}
+
+	return rows.Close()
+}
+
+// Restore validates the snapshot at src and installs it at dst. Nothing may
+// have dst open while this runs.
+func Restore(src, dst string, force bool) error {
+	if err := Validate(src); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %s", src, err.Error())
+	}
+
+	// a leftover journal would be replayed against the restored database
+	return store.Install(src, dst, force, dst+"-journal", dst+"-wal", dst+"-shm")
+}
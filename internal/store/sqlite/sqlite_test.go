@@ -0,0 +1,58 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	if err := storetest.TestStore(func(path string) (store.Store, error) { return Open(path) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenSharesDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	drivers := len(sql.Drivers())
+
+	var l []*Store
+	for _, name := range []string{"a.db", "b.db"} {
+		s, err := Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		l = append(l, s)
+	}
+
+	if n := len(sql.Drivers()); n != drivers {
+		t.Fatalf("opening two stores registered %d drivers", n-drivers)
+	}
+
+	// each store is told about its own connection
+	if l[0].conn == nil || l[1].conn == nil || l[0].conn == l[1].conn {
+		t.Fatalf("stores have connections %p and %p", l[0].conn, l[1].conn)
+	}
+
+	l[0].Close()
+
+	storesM.Lock()
+	_, ok := stores[l[0].id]
+	storesM.Unlock()
+
+	if ok {
+		t.Fatal("closed store is still known to the driver")
+	}
+}
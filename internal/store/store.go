@@ -0,0 +1,180 @@
+package store // import "fknsrs.biz/p/jobserver/internal/store"
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrEmpty    = errors.New("empty")
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("exists")
+)
+
+// Conflict policies decide what Put does with a job whose ID already exists.
+// An empty policy is the same as ConflictUpdate.
+const (
+	ConflictUpdate  = "update"
+	ConflictReplace = "replace"
+	ConflictSkip    = "skip"
+	ConflictFail    = "fail"
+)
+
+// States that Scan can filter on. A job is ready once its hold_until time has
+// passed, and held until then. An empty state matches every job.
+const (
+	StateReady = "ready"
+	StateHeld  = "held"
+)
+
+// Results returned by Put, describing what happened to the job.
+const (
+	Created  = "created"
+	Updated  = "updated"
+	Replaced = "replaced"
+	Skipped  = "skipped"
+)
+
+// Job is a job as it's kept by a Store. HoldUntil is a unix timestamp and TTR
+// is in seconds, the same as on the wire. ContentType is whatever the client
+// said its content is, and goes along with the content; putting a job that
+// already exists only changes it when the job is replaced. Encoding lists the
+// transformations applied to Content, in the order they were applied,
+// separated by commas. An empty Encoding means Content is stored as-is.
+type Job struct {
+	ID          string
+	Queue       string
+	Priority    float64
+	HoldUntil   int64
+	TTR         uint64
+	ContentType string
+	Encoding    string
+	Content     []byte
+}
+
+// QueueStats counts the jobs in a queue. Held jobs are the ones that are
+// reserved or waiting for their hold_until to pass.
+type QueueStats struct {
+	Queue string
+	Ready uint64
+	Held  uint64
+}
+
+// Store is a durable set of jobs. Implementations must be safe for concurrent
+// use, and must behave identically; storetest.TestStore checks that they do.
+//
+// Put creates a job or, if the ID already exists, applies the conflict policy.
+// Updating a job changes its priority and TTR, and moves hold_until earlier but
+// never later. Replacing a job overwrites every field.
+//
+// Reserve returns the highest priority ready job in a queue and holds it for
+// its TTR. Peek does the same without holding the job. Both return ErrEmpty if
+// there are no ready jobs.
+//
+// Scan returns the job with the lowest ID greater than after, optionally
+// filtered by queue and state, or ErrEmpty.
+//
+// Queue returns the name of the queue that a job is in, or ErrNotFound if
+// there's no job with that ID.
+//
+// Reschedule changes the priority and hold_until of a job in a queue, which
+// is how a reserved job is given back or held for longer. It returns
+// ErrNotFound if there's no such job.
+//
+// Stats counts the jobs in the queue with the lowest name greater than after,
+// optionally only looking at the named queue, or returns ErrEmpty.
+//
+// SetContent changes a job's content and encoding, and nothing else. j is the
+// job as it was read, and the change is only made if its content and encoding
+// are still the same, so that content put since isn't lost. It returns
+// ErrNotFound if the job's been deleted or its content changed.
+//
+// Backup writes a consistent copy of the store to path without blocking other
+// operations for its duration.
+type Store interface {
+	Put(j *Job, conflict string) (string, error)
+	Reserve(queue string, now time.Time) (*Job, error)
+	Peek(queue string, now time.Time) (*Job, error)
+	Delete(queue, id string) error
+	Reschedule(queue, id string, priority float64, holdUntil int64) error
+	Scan(queue, state, after string, now time.Time) (*Job, error)
+	Queue(id string) (string, error)
+	Stats(queue, after string, now time.Time) (*QueueStats, error)
+	SetContent(j *Job, content []byte, encoding string) error
+	Backup(path string) error
+	Close() error
+}
+
+// ValidConflict reports whether conflict is a known conflict policy.
+func ValidConflict(conflict string) bool {
+	switch conflict {
+	case "", ConflictUpdate, ConflictReplace, ConflictSkip, ConflictFail:
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidState reports whether state is a known state.
+func ValidState(state string) bool {
+	switch state {
+	case "", StateReady, StateHeld:
+		return true
+	default:
+		return false
+	}
+}
+
+// Install copies the file at src to dst, going through a temporary file so
+// that dst is never left half written. If force is false and dst exists, it
+// fails instead. Any stale files are removed before dst is put in place.
+func Install(src, dst string, force bool, stale ...string) error {
+	if !force {
+		if _, err := os.Stat(dst); err == nil {
+			return errors.New(dst + " already exists")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	tmp := dst + ".restore"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	for _, f := range stale {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
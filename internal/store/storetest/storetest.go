@@ -0,0 +1,432 @@
+// Package storetest checks that implementations of store.Store behave the
+// same way. Every backend is expected to pass TestStore.
+package storetest // import "fknsrs.biz/p/jobserver/internal/store/storetest"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/store"
+)
+
+var now = time.Unix(1500000000, 0)
+
+// TestStore runs a fixed sequence of operations against a store created by
+// open, and returns an error describing the first result that isn't what it
+// should be. open is called with paths in a temporary directory, once to
+// create a store, again to reopen it, and once more to open a backup of it.
+func TestStore(open func(path string) (store.Store, error)) error {
+	return testStore(open, false)
+}
+
+// TestWrapper is TestStore for stores that wrap another store and change
+// content on its way in and out, like store.Compress and store.Encrypt. They
+// pass SetContent straight through, so it works on content as it's stored
+// rather than as they return it, and the steps that use it are left out.
+func TestWrapper(open func(path string) (store.Store, error)) error {
+	return testStore(open, true)
+}
+
+// rawSteps are the steps that need content as it's stored.
+var rawSteps = map[string]bool{"set content": true}
+
+func testStore(open func(path string) (store.Store, error), wrapper bool) error {
+	dir, err := ioutil.TempDir("", "storetest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs")
+
+	s, err := open(path)
+	if err != nil {
+		return fmt.Errorf("open: %s", err.Error())
+	}
+
+	for _, step := range steps {
+		if wrapper && rawSteps[step.name] {
+			continue
+		}
+
+		if err := step.fn(s); err != nil {
+			s.Close()
+			return fmt.Errorf("%s: %s", step.name, err.Error())
+		}
+	}
+
+	backup := filepath.Join(dir, "backup")
+	if err := s.Backup(backup); err != nil {
+		s.Close()
+		return fmt.Errorf("backup: %s", err.Error())
+	}
+
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("close: %s", err.Error())
+	}
+
+	for _, p := range []string{path, backup} {
+		s, err := open(p)
+		if err != nil {
+			return fmt.Errorf("reopen %s: %s", filepath.Base(p), err.Error())
+		}
+
+		if err := checkFinal(s); err != nil {
+			s.Close()
+			return fmt.Errorf("reopen %s: %s", filepath.Base(p), err.Error())
+		}
+
+		if err := s.Close(); err != nil {
+			return fmt.Errorf("close %s: %s", filepath.Base(p), err.Error())
+		}
+	}
+
+	return nil
+}
+
+func at(d time.Duration) int64 {
+	return now.Add(d).Unix()
+}
+
+func binaryContent() []byte {
+	d := make([]byte, 256)
+	for i := range d {
+		d[i] = byte(i)
+	}
+	return d
+}
+
+func checkJob(j *store.Job, err error, want *store.Job) error {
+	if err != nil {
+		return fmt.Errorf("expected job %s; got error %q", want.ID, err.Error())
+	}
+
+	switch {
+	case j.ID != want.ID:
+		return fmt.Errorf("expected job %s; got %s", want.ID, j.ID)
+	case j.Queue != want.Queue:
+		return fmt.Errorf("job %s: expected queue %q; got %q", j.ID, want.Queue, j.Queue)
+	case j.Priority != want.Priority:
+		return fmt.Errorf("job %s: expected priority %v; got %v", j.ID, want.Priority, j.Priority)
+	case j.HoldUntil != want.HoldUntil:
+		return fmt.Errorf("job %s: expected hold_until %d; got %d", j.ID, want.HoldUntil, j.HoldUntil)
+	case j.TTR != want.TTR:
+		return fmt.Errorf("job %s: expected ttr %d; got %d", j.ID, want.TTR, j.TTR)
+	case j.ContentType != want.ContentType:
+		return fmt.Errorf("job %s: expected content type %q; got %q", j.ID, want.ContentType, j.ContentType)
+	case j.Encoding != want.Encoding:
+		return fmt.Errorf("job %s: expected encoding %q; got %q", j.ID, want.Encoding, j.Encoding)
+	case !bytes.Equal(j.Content, want.Content):
+		return fmt.Errorf("job %s: expected content %q; got %q", j.ID, want.Content, j.Content)
+	}
+
+	return nil
+}
+
+func checkErr(err, want error) error {
+	if err != want {
+		return fmt.Errorf("expected error %v; got %v", want, err)
+	}
+
+	return nil
+}
+
+func checkPut(s store.Store, j *store.Job, conflict, want string) error {
+	r, err := s.Put(j, conflict)
+	if err != nil {
+		return fmt.Errorf("put %s: %s", j.ID, err.Error())
+	}
+	if r != want {
+		return fmt.Errorf("put %s: expected %s; got %s", j.ID, want, r)
+	}
+
+	return nil
+}
+
+func checkScan(s store.Store, queue, state string, when time.Time, want ...string) error {
+	var got []string
+
+	after := ""
+	for {
+		j, err := s.Scan(queue, state, after, when)
+		if err == store.ErrEmpty {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		got = append(got, j.ID)
+		after = j.ID
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("scan queue=%q state=%q: expected %v; got %v", queue, state, want, got)
+	}
+
+	return nil
+}
+
+func checkStats(s store.Store, queue string, when time.Time, want ...store.QueueStats) error {
+	var got []store.QueueStats
+
+	after := ""
+	for {
+		st, err := s.Stats(queue, after, when)
+		if err == store.ErrEmpty {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		got = append(got, *st)
+		after = st.Queue
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("stats queue=%q: expected %v; got %v", queue, want, got)
+	}
+
+	return nil
+}
+
+var (
+	jobA = store.Job{ID: "a", Queue: "q", Priority: 1, HoldUntil: at(-time.Minute), TTR: 60, ContentType: "text/plain", Content: []byte("first")}
+	jobB = store.Job{ID: "b", Queue: "q", Priority: 2, HoldUntil: at(-time.Minute), TTR: 60, Content: []byte("second")}
+	jobC = store.Job{ID: "c", Queue: "q", Priority: 3, HoldUntil: at(time.Hour), TTR: 60, Content: []byte("held")}
+	jobD = store.Job{ID: "d", Queue: "other", Priority: -1, HoldUntil: at(-time.Minute), TTR: 30, ContentType: "application/octet-stream", Content: binaryContent()}
+)
+
+func withHoldUntil(j store.Job, holdUntil int64) *store.Job {
+	j.HoldUntil = holdUntil
+	return &j
+}
+
+var steps = []struct {
+	name string
+	fn   func(s store.Store) error
+}{
+	{"empty reserve", func(s store.Store) error {
+		_, err := s.Reserve("q", now)
+		return checkErr(err, store.ErrEmpty)
+	}},
+	{"empty peek", func(s store.Store) error {
+		_, err := s.Peek("q", now)
+		return checkErr(err, store.ErrEmpty)
+	}},
+	{"empty scan", func(s store.Store) error {
+		return checkScan(s, "", "", now)
+	}},
+	{"put", func(s store.Store) error {
+		for _, j := range []store.Job{jobC, jobA, jobD, jobB} {
+			j := j
+			if err := checkPut(s, &j, "", store.Created); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"peek", func(s store.Store) error {
+		for i := 0; i < 2; i++ {
+			j, err := s.Peek("q", now)
+			if err := checkJob(j, err, &jobB); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"reserve", func(s store.Store) error {
+		j, err := s.Reserve("q", now)
+		if err := checkJob(j, err, &jobB); err != nil {
+			return err
+		}
+		j, err = s.Reserve("q", now)
+		if err := checkJob(j, err, &jobA); err != nil {
+			return err
+		}
+		_, err = s.Reserve("q", now)
+		return checkErr(err, store.ErrEmpty)
+	}},
+	{"reserve binary", func(s store.Store) error {
+		j, err := s.Reserve("other", now)
+		return checkJob(j, err, &jobD)
+	}},
+	{"reserve after ttr", func(s store.Store) error {
+		j, err := s.Reserve("q", now.Add(time.Second*61))
+		return checkJob(j, err, withHoldUntil(jobB, at(time.Minute)))
+	}},
+	{"scan", func(s store.Store) error {
+		if err := checkScan(s, "", "", now, "a", "b", "c", "d"); err != nil {
+			return err
+		}
+		if err := checkScan(s, "q", "", now, "a", "b", "c"); err != nil {
+			return err
+		}
+		if err := checkScan(s, "", store.StateHeld, now, "a", "b", "c", "d"); err != nil {
+			return err
+		}
+		if err := checkScan(s, "", store.StateReady, now.Add(time.Minute*2), "a", "d"); err != nil {
+			return err
+		}
+		j, err := s.Scan("", "", "b", now)
+		return checkJob(j, err, &jobC)
+	}},
+	{"stats", func(s store.Store) error {
+		when := now.Add(time.Minute * 2)
+		if err := checkStats(s, "", when, store.QueueStats{Queue: "other", Ready: 1}, store.QueueStats{Queue: "q", Ready: 1, Held: 2}); err != nil {
+			return err
+		}
+		if err := checkStats(s, "q", when, store.QueueStats{Queue: "q", Ready: 1, Held: 2}); err != nil {
+			return err
+		}
+		return checkStats(s, "x", when)
+	}},
+	{"update", func(s store.Store) error {
+		u := jobA
+		u.Priority = 10
+		u.HoldUntil = at(time.Hour * 2)
+		u.TTR = 120
+		u.ContentType = "ignored"
+		u.Content = []byte("ignored")
+		if err := checkPut(s, &u, store.ConflictUpdate, store.Updated); err != nil {
+			return err
+		}
+
+		j, err := s.Scan("", "", "", now)
+		if err := checkJob(j, err, &store.Job{ID: "a", Queue: "q", Priority: 10, HoldUntil: at(time.Minute), TTR: 120, ContentType: jobA.ContentType, Content: jobA.Content}); err != nil {
+			return err
+		}
+
+		u.HoldUntil = at(-time.Hour)
+		if err := checkPut(s, &u, "", store.Updated); err != nil {
+			return err
+		}
+
+		j, err = s.Peek("q", now)
+		return checkJob(j, err, &store.Job{ID: "a", Queue: "q", Priority: 10, HoldUntil: at(-time.Hour), TTR: 120, ContentType: jobA.ContentType, Content: jobA.Content})
+	}},
+	{"skip", func(s store.Store) error {
+		u := jobC
+		u.Priority = 100
+		if err := checkPut(s, &u, store.ConflictSkip, store.Skipped); err != nil {
+			return err
+		}
+
+		j, err := s.Scan("", "", "b", now)
+		return checkJob(j, err, &jobC)
+	}},
+	{"fail", func(s store.Store) error {
+		_, err := s.Put(&jobC, store.ConflictFail)
+		return checkErr(err, store.ErrExists)
+	}},
+	{"replace", func(s store.Store) error {
+		u := store.Job{ID: "c", Queue: "other", Priority: 5, HoldUntil: at(time.Hour * 3), TTR: 10, ContentType: "application/json", Content: []byte("replaced")}
+		if err := checkPut(s, &u, store.ConflictReplace, store.Replaced); err != nil {
+			return err
+		}
+
+		if err := checkScan(s, "q", "", now, "a", "b"); err != nil {
+			return err
+		}
+
+		j, err := s.Scan("other", "", "", now)
+		return checkJob(j, err, &u)
+	}},
+	{"queue", func(s store.Store) error {
+		for id, want := range map[string]string{"a": "q", "c": "other"} {
+			if queue, err := s.Queue(id); err != nil {
+				return err
+			} else if queue != want {
+				return fmt.Errorf("job %s is in queue %q, want %q", id, queue, want)
+			}
+		}
+
+		_, err := s.Queue("x")
+		return checkErr(err, store.ErrNotFound)
+	}},
+	{"reschedule", func(s store.Store) error {
+		if err := checkErr(s.Reschedule("q", "d", 1, 0), store.ErrNotFound); err != nil {
+			return err
+		}
+		if err := s.Reschedule("other", "d", -2, at(-time.Minute)); err != nil {
+			return err
+		}
+
+		u := jobD
+		u.Priority = -2
+		j, err := s.Peek("other", now)
+		if err := checkJob(j, err, &u); err != nil {
+			return err
+		}
+
+		return s.Reschedule("other", "d", jobD.Priority, at(time.Second*30))
+	}},
+	{"set content", func(s store.Store) error {
+		if err := checkErr(s.SetContent(&store.Job{ID: "x"}, []byte("x"), ""), store.ErrNotFound); err != nil {
+			return err
+		}
+
+		// content that's changed since it was read is left alone
+		stale := jobB
+		stale.Content = []byte("stale")
+		if err := checkErr(s.SetContent(&stale, []byte("encoded"), "test"), store.ErrNotFound); err != nil {
+			return err
+		}
+		stale = jobB
+		stale.Encoding = "stale"
+		if err := checkErr(s.SetContent(&stale, []byte("encoded"), "test"), store.ErrNotFound); err != nil {
+			return err
+		}
+
+		if err := s.SetContent(&jobB, []byte("encoded"), "test"); err != nil {
+			return err
+		}
+
+		u := withHoldUntil(jobB, at(time.Second*121))
+		u.Encoding = "test"
+		u.Content = []byte("encoded")
+
+		j, err := s.Scan("", "", "a", now)
+		if err := checkJob(j, err, u); err != nil {
+			return err
+		}
+
+		return s.SetContent(u, jobB.Content, "")
+	}},
+	{"delete", func(s store.Store) error {
+		if err := checkErr(s.Delete("other", "a"), store.ErrNotFound); err != nil {
+			return err
+		}
+		if err := checkErr(s.Delete("q", "a"), nil); err != nil {
+			return err
+		}
+		if err := checkErr(s.Delete("q", "a"), store.ErrNotFound); err != nil {
+			return err
+		}
+
+		return checkScan(s, "", "", now, "b", "c", "d")
+	}},
+}
+
+// checkFinal checks the state that the steps above leave behind.
+func checkFinal(s store.Store) error {
+	after := ""
+	for _, want := range []*store.Job{
+		withHoldUntil(jobB, at(time.Second*121)),
+		{ID: "c", Queue: "other", Priority: 5, HoldUntil: at(time.Hour * 3), TTR: 10, ContentType: "application/json", Content: []byte("replaced")},
+		withHoldUntil(jobD, at(time.Second*30)),
+	} {
+		j, err := s.Scan("", "", after, now)
+		if err := checkJob(j, err, want); err != nil {
+			return err
+		}
+
+		after = j.ID
+	}
+
+	_, err := s.Scan("", "", after, now)
+	return checkErr(err, store.ErrEmpty)
+}
@@ -1,15 +1,19 @@
 package jobserver // import "fknsrs.biz/p/jobserver"
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"fknsrs.biz/p/jobserver/internal/keyring"
 	"fknsrs.biz/p/jobserver/internal/protocol"
 )
 
@@ -18,44 +22,176 @@ type (
 )
 
 var (
+	ErrClosed   = errors.New("client closed")
 	ErrTimeout  = errors.New("timed out")
 	ErrNoJobs   = errors.New("no jobs")
 	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("exists")
+	ErrDenied   = errors.New("denied")
 )
 
+// Conflict policies decide what PutJob does when a job with the same ID
+// already exists. ConflictUpdate is what Put does.
+const (
+	ConflictUpdate  = "update"
+	ConflictReplace = "replace"
+	ConflictSkip    = "skip"
+	ConflictFail    = "fail"
+)
+
+// Job states that can be passed to Scan. An empty state matches every job.
+const (
+	StateReady = "ready"
+	StateHeld  = "held"
+)
+
+// Job is a job in a queue. ContentType says what Content is, if the job's
+// producer said; it's how Decode knows which codec to use.
 type Job struct {
-	ID        string
-	Queue     string
-	Priority  float64
-	HoldUntil time.Time
-	TTR       time.Duration
-	Content   string
+	ID          string
+	Queue       string
+	Priority    float64
+	HoldUntil   time.Time
+	TTR         time.Duration
+	ContentType string
+	Content     string
+}
+
+// Bytes returns the job's content as a byte slice. Content doesn't have to be
+// text; any bytes can be put and get back out unchanged.
+func (j *Job) Bytes() []byte {
+	return []byte(j.Content)
+}
+
+func jobFromMessage(m *protocol.JobMessage) *Job {
+	return &Job{
+		ID:          m.ID,
+		Queue:       m.Queue,
+		Priority:    m.Priority,
+		HoldUntil:   time.Unix(m.HoldUntil, 0),
+		TTR:         time.Duration(m.TTR) * time.Second,
+		ContentType: m.ContentType,
+		Content:     m.Content,
+	}
+}
+
+// ConnectionError is what requests fail with when the connection to the server
+// fails while they're waiting for a response, or before they're sent. Err is
+// what went wrong with the connection.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return "connection failed: " + e.Err.Error()
+}
+
+// connection is one connection to the server. broken is closed when it fails,
+// and err says why.
+type connection struct {
+	t      transport
+	broken chan struct{}
+	err    error
+}
+
+func newConnection(t transport) *connection {
+	return &connection{t: t, broken: make(chan struct{})}
+}
+
+// fail marks the connection as failed, which wakes up every request waiting
+// on it. It returns false if the connection had already failed. The caller
+// has to hold the client's lock.
+func (cc *connection) fail(err error) bool {
+	select {
+	case <-cc.broken:
+		return false
+	default:
+		cc.err = err
+		close(cc.broken)
+		return true
+	}
 }
 
 type Client struct {
-	m       sync.RWMutex
-	err     error
-	socket  *net.UDPConn
-	remote  net.Addr
-	pending map[string]chan protocol.Message
-	timeout time.Duration
-	retries int
+	m         sync.RWMutex
+	err       error
+	dial      func() (transport, error)
+	conn      *connection
+	done      chan struct{}
+	pending   map[string]chan protocol.Message
+	timeout   time.Duration
+	retries   int
+	infoM     sync.Mutex
+	info      *ServerInfo
+	infoUntil time.Time
+	probing   bool
+	keys      *keyring.Keyring
+	onError   func(err error)
+	backoff   [2]time.Duration
+	codec     Codec
+	intercept []Interceptor
+	retry     RetryPolicy
+	opRetry   map[string]RetryPolicy
 }
 
+// Dial connects to a server. addr is host:port for UDP over IPv4, or a URL
+// naming the network, like udp6://[::1]:2097, tcp://localhost:2098,
+// tls://localhost:2099, unixgram:///run/jobserver.sock or
+// unix:///run/jobserver.sock. Stream networks like tcp and unix behave the
+// same way as DialTCP, and tls is the same as DialTLS with a nil config.
+// There's no way to give Dial a config, so servers with certificates from a
+// private authority, or that identify clients by their certificates, need
+// DialTLS.
 func Dial(addr string) (*Client, error) {
-	raddr, err := net.ResolveUDPAddr("udp4", addr)
-	if err != nil {
-		return nil, err
+	network, address := "udp4", addr
+
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		network, address = u.Scheme, u.Host
+		if network == "unix" || network == "unixgram" {
+			address = u.Path
+		}
 	}
 
-	s, err := net.DialUDP("udp4", nil, raddr)
+	return newClient(func() (transport, error) {
+		return dialTransport(network, address)
+	})
+}
+
+// DialTCP connects to a server's TCP listener. Messages over TCP aren't
+// limited in size like datagrams are, so this is the way to go for jobs with
+// large content. Requests share the one connection, and don't wait for each
+// other's responses.
+func DialTCP(addr string) (*Client, error) {
+	return newClient(func() (transport, error) {
+		return dialTransport("tcp", addr)
+	})
+}
+
+// DialTLS connects to a server's TLS listener, which works like its TCP
+// listener but encrypted. config can hold a client certificate to identify
+// with, or the authorities to check the server's certificate against; if it's
+// nil, the system's authorities are used.
+func DialTLS(addr string, config *tls.Config) (*Client, error) {
+	return newClient(func() (transport, error) {
+		return dialTLSTransport(addr, config)
+	})
+}
+
+func newClient(dial func() (transport, error)) (*Client, error) {
+	t, err := dial()
 	if err != nil {
 		return nil, err
 	}
 
 	c := Client{
-		socket:  s,
-		remote:  raddr,
+		dial:    dial,
+		conn:    newConnection(t),
+		done:    make(chan struct{}),
 		pending: make(map[string]chan protocol.Message),
 		timeout: time.Second,
 	}
@@ -65,14 +201,166 @@ func Dial(addr string) (*Client, error) {
 	return &c, nil
 }
 
+// Close closes the connection to the server. Requests that are waiting for a
+// response fail with ErrClosed, and so does everything after.
+func (c *Client) Close() error {
+	c.m.Lock()
+	if c.err == ErrClosed {
+		c.m.Unlock()
+		return nil
+	}
+
+	c.err = ErrClosed
+	close(c.done)
+	cc := c.conn
+	failed := !cc.fail(ErrClosed)
+	c.m.Unlock()
+
+	// a connection that already failed has been closed by run
+	if failed {
+		return nil
+	}
+
+	return cc.t.close()
+}
+
+// Err returns the error that stopped the client from working, or nil if it's
+// still usable. Without reconnecting, that's the first error reading from the
+// connection, and with it, it's only ever ErrClosed.
+func (c *Client) Err() error {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.err
+}
+
+// SetErrorHandler sets a function to call each time the connection to the
+// server fails. It's called from the goroutine that reads responses, so it
+// shouldn't block for long.
+func (c *Client) SetErrorHandler(fn func(err error)) {
+	c.m.Lock()
+	c.onError = fn
+	c.m.Unlock()
+}
+
+// SetReconnect makes the client connect again when its connection fails,
+// instead of giving up for good. It waits min before the first attempt, and
+// twice as long after each failed attempt, up to max. Requests made while it's
+// reconnecting fail with a ConnectionError. A min of zero turns reconnecting
+// off, which is the default.
+func (c *Client) SetReconnect(min, max time.Duration) {
+	if max < min {
+		max = min
+	}
+
+	c.m.Lock()
+	c.backoff = [2]time.Duration{min, max}
+	c.m.Unlock()
+}
+
+// run reads responses until the connection fails, and then either gives up or
+// reconnects, depending on SetReconnect.
 func (c *Client) run() {
 	for {
-		d := make([]byte, protocol.MessageSize)
-		if _, _, err := c.socket.ReadFrom(d); err != nil {
+		c.m.RLock()
+		cc := c.conn
+		c.m.RUnlock()
+
+		err := c.read(cc.t)
+
+		c.m.Lock()
+		if c.err == ErrClosed {
+			c.m.Unlock()
+			return
+		}
+
+		cc.fail(&ConnectionError{Err: err})
+		backoff, onError := c.backoff, c.onError
+		if backoff[0] == 0 {
 			c.err = err
+		}
+		c.m.Unlock()
+
+		cc.t.close()
+
+		if onError != nil {
+			onError(err)
+		}
+
+		if backoff[0] == 0 {
 			return
 		}
 
+		if !c.reconnect(backoff[0], backoff[1]) {
+			return
+		}
+	}
+}
+
+// reconnect dials the server until it works, waiting longer after each
+// failure. It returns false if the client is closed first.
+func (c *Client) reconnect(wait, max time.Duration) bool {
+	for {
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return false
+		}
+
+		t, err := c.dial()
+		if err != nil {
+			c.m.RLock()
+			onError := c.onError
+			c.m.RUnlock()
+
+			if onError != nil {
+				onError(err)
+			}
+
+			if wait *= 2; wait > max {
+				wait = max
+			}
+
+			continue
+		}
+
+		c.m.Lock()
+		if c.err == ErrClosed {
+			c.m.Unlock()
+			t.close()
+			return false
+		}
+
+		c.conn = newConnection(t)
+		c.m.Unlock()
+
+		// it might not be the same server any more
+		c.infoM.Lock()
+		c.info = nil
+		c.infoM.Unlock()
+
+		return true
+	}
+}
+
+// read hands responses from t to the requests waiting for them, until t
+// fails.
+func (c *Client) read(t transport) error {
+	for {
+		d, err := t.recv()
+		if err != nil {
+			return err
+		}
+
+		if keys := c.keyring(); keys != nil {
+			sm, err := protocol.Open(keys, d, time.Now(), protocol.AuthWindow)
+			if err != nil {
+				continue
+			}
+
+			d = sm.Message
+		}
+
 		m, err := protocol.Parse(d)
 		if err != nil {
 			continue
@@ -82,17 +370,38 @@ func (c *Client) run() {
 		ch, ok := c.pending[m.GetKey()]
 		c.m.RUnlock()
 		if ok {
-			ch <- m
+			// a retried request can be answered more than once
+			select {
+			case ch <- m:
+			default:
+			}
 		}
 	}
 }
 
-func (c *Client) req(m protocol.Message) (protocol.Message, error) {
-	if c.err != nil {
-		return nil, c.err
-	}
+// req sends a request and waits for the response, for as long as the retry
+// policy for the request says, sending it again each time if the transport can
+// lose messages. If ctx is done first, req gives up straight away with ctx's
+// error, and any response that turns up later is ignored.
+func (c *Client) req(ctx context.Context, m protocol.Message) (protocol.Message, error) {
+	c.m.RLock()
+	err, cc := c.err, c.conn
+	c.m.RUnlock()
 
-	retries := c.retries
+	if err != nil {
+		if err != ErrClosed {
+			err = &ConnectionError{Err: err}
+		}
+		return nil, err
+	}
+	select {
+	case <-cc.broken:
+		return nil, cc.err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	if m.GetKey() == "" {
 		d := make([]byte, 8)
@@ -114,35 +423,167 @@ func (c *Client) req(m protocol.Message) (protocol.Message, error) {
 		c.m.Unlock()
 	}()
 
-	for {
-		if _, err := c.socket.Write(protocol.Serialise(m)); err != nil {
-			return nil, err
+	// only check the server's limits if they're already known, since finding
+	// out means sending a request
+	c.infoM.Lock()
+	info := c.info
+	c.infoM.Unlock()
+
+	call := callFrom(ctx)
+
+	op := ""
+	if call != nil {
+		op = call.Op
+	}
+	policy := c.retryPolicy(op)
+
+	// requests that can't safely be run twice are only sent again while the
+	// server remembers the first response, which means asking it how long
+	// that is
+	resend, rep := cc.t.resend(), repeatable(m)
+
+	var replay time.Duration
+	if resend && !rep {
+		if info == nil {
+			info, _ = c.serverInfo(ctx)
+		}
+		if info != nil {
+			replay = info.ReplayTTL
 		}
+	}
+
+	start := time.Now()
+
+	for n := 1; ; n++ {
+		elapsed := time.Now().Sub(start)
+
+		wait, ok := policy.Timeout(n, elapsed)
+		if n > 1 && !ok {
+			return nil, ErrTimeout
+		}
+
+		if n == 1 || resend && (rep || elapsed < replay) {
+			// sealed messages are sealed again for each try, since the
+			// server won't take the same nonce twice
+			d, err := c.encode(m)
+			if err != nil {
+				return nil, err
+			}
+
+			if info != nil {
+				if limit := cc.t.limit(info); limit > 0 && len(d) > limit {
+					return nil, ErrTooLarge
+				}
+			}
+
+			if call != nil {
+				call.Attempts++
+			}
+
+			// a message that's too large is the request's fault, not the
+			// connection's
+			if err := cc.t.send(d); err == ErrTooLarge {
+				return nil, err
+			} else if err != nil {
+				return nil, &ConnectionError{Err: err}
+			}
+		}
+
+		t := time.NewTimer(wait)
 
 		select {
 		case r := <-ch:
+			t.Stop()
 			return r, nil
-		case <-time.After(c.timeout):
-			if retries == 0 {
-				return nil, ErrTimeout
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-cc.broken:
+			t.Stop()
+
+			// a response might have come in just before the connection
+			// failed
+			select {
+			case r := <-ch:
+				return r, nil
+			default:
+				return nil, cc.err
 			}
-
-			retries--
+		case <-t.C:
 		}
 	}
 }
 
+func (c *Client) encode(m protocol.Message) ([]byte, error) {
+	d := protocol.Serialise(m)
+
+	keys := c.keyring()
+	if keys == nil {
+		return d, nil
+	}
+
+	return protocol.Seal(keys, keys.Primary(), d, time.Now())
+}
+
+func (c *Client) keyring() *keyring.Keyring {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.keys
+}
+
+// SetKeyFile makes the client seal every message with the primary key from
+// the file at path, and ignore responses that aren't sealed with one of its
+// keys. The server needs the same keys. Messages are only accepted within 30
+// seconds of being sealed, so clocks have to roughly agree.
+func (c *Client) SetKeyFile(path string) error {
+	keys, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	c.keys = keys
+	c.m.Unlock()
+
+	return nil
+}
+
+// SetTimeout sets how long to wait for each try of a request, for requests
+// without a retry policy. The default is a second.
 func (c *Client) SetTimeout(t time.Duration) {
+	c.m.Lock()
 	c.timeout = t
+	c.m.Unlock()
 }
 
+// SetRetries sets how many times to try a request again, for requests
+// without a retry policy. The default is not to.
 func (c *Client) SetRetries(n int) {
+	c.m.Lock()
 	c.retries = n
+	c.m.Unlock()
 }
 
 func (c *Client) Ping() (time.Duration, error) {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is Ping, but gives up when ctx is done.
+func (c *Client) PingContext(ctx context.Context) (time.Duration, error) {
+	var d time.Duration
+	err := c.do(ctx, &Call{Op: OpPing}, func(ctx context.Context) error {
+		var err error
+		d, err = c.ping(ctx)
+		return err
+	})
+
+	return d, err
+}
+
+func (c *Client) ping(ctx context.Context) (time.Duration, error) {
 	before := time.Now()
-	if _, err := c.req(&protocol.PingMessage{}); err != nil {
+	if _, err := c.req(ctx, &protocol.PingMessage{}); err != nil {
 		return 0, err
 	}
 
@@ -150,16 +591,74 @@ func (c *Client) Ping() (time.Duration, error) {
 }
 
 func (c *Client) Put(queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
-	m := protocol.JobMessage{
-		Queue:     queue,
+	return c.PutContext(context.Background(), queue, id, content, priority, holdUntil, ttr)
+}
+
+// PutContext is Put, but gives up when ctx is done.
+func (c *Client) PutContext(ctx context.Context, queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.PutJobContext(ctx, &Job{
 		ID:        id,
+		Queue:     queue,
 		Priority:  priority,
-		HoldUntil: holdUntil.Unix(),
-		TTR:       uint64(ttr / time.Second),
+		HoldUntil: holdUntil,
+		TTR:       ttr,
 		Content:   content,
+	}, ConflictUpdate)
+}
+
+// PutBytes is Put for content that's more naturally a byte slice, like
+// protobuf or msgpack messages.
+func (c *Client) PutBytes(queue, id string, content []byte, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.PutBytesContext(context.Background(), queue, id, content, priority, holdUntil, ttr)
+}
+
+// PutBytesContext is PutBytes, but gives up when ctx is done.
+func (c *Client) PutBytesContext(ctx context.Context, queue, id string, content []byte, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return c.PutContext(ctx, queue, id, string(content), priority, holdUntil, ttr)
+}
+
+func (c *Client) PutJob(j *Job, conflict string) error {
+	return c.PutJobContext(context.Background(), j, conflict)
+}
+
+// PutJobContext is PutJob, but gives up when ctx is done.
+func (c *Client) PutJobContext(ctx context.Context, j *Job, conflict string) error {
+	return c.do(ctx, &Call{Op: OpPut, Queue: j.Queue, JobID: j.ID}, func(ctx context.Context) error {
+		return c.putJob(ctx, j, conflict)
+	})
+}
+
+func (c *Client) putJob(ctx context.Context, j *Job, conflict string) error {
+	m := protocol.JobMessage{
+		Queue:       j.Queue,
+		ID:          j.ID,
+		Priority:    j.Priority,
+		HoldUntil:   j.HoldUntil.Unix(),
+		TTR:         uint64(j.TTR / time.Second),
+		Conflict:    conflict,
+		ContentType: j.ContentType,
+		Content:     j.Content,
+	}
+
+	// older servers would silently store encoded content as it is, and
+	// ignore conflict policies and content types
+	if protocol.NeedsEncoding(j.Content) {
+		if err := c.requireVersion(ctx, 1, "binary content"); err != nil {
+			return err
+		}
+	}
+	if conflict != "" && conflict != ConflictUpdate {
+		if err := c.requireVersion(ctx, 1, "conflict policies"); err != nil {
+			return err
+		}
+	}
+	if j.ContentType != "" {
+		if err := c.requireVersion(ctx, 2, "content types"); err != nil {
+			return err
+		}
 	}
 
-	r, err := c.req(&m)
+	r, err := c.req(ctx, &m)
 	if err != nil {
 		return err
 	}
@@ -168,46 +667,73 @@ func (c *Client) Put(queue, id, content string, priority float64, holdUntil time
 	case *protocol.SuccessMessage:
 		return nil
 	case *protocol.ErrorMessage:
-		return errors.New(r.Reason)
+		if r.Reason == "exists" {
+			return ErrExists
+		}
+		return reasonError(r.Reason)
 	default:
 		return ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
 	}
 }
 
 func (c *Client) Reserve(queue string) (*Job, error) {
-	r, err := c.req(&protocol.ReserveMessage{Queue: queue})
+	return c.ReserveContext(context.Background(), queue)
+}
+
+// ReserveContext is Reserve, but gives up when ctx is done.
+func (c *Client) ReserveContext(ctx context.Context, queue string) (*Job, error) {
+	var j *Job
+	call := Call{Op: OpReserve, Queue: queue}
+	err := c.do(ctx, &call, func(ctx context.Context) error {
+		var err error
+		if j, err = c.reserve(ctx, queue); j != nil {
+			call.JobID = j.ID
+		}
+		return err
+	})
+
+	return j, err
+}
+
+func (c *Client) reserve(ctx context.Context, queue string) (*Job, error) {
+	r, err := c.req(ctx, &protocol.ReserveMessage{Queue: queue})
 	if err != nil {
 		return nil, err
 	}
 
 	switch r := r.(type) {
 	case *protocol.JobMessage:
-		return &Job{
-			ID:        r.ID,
-			Queue:     r.Queue,
-			Priority:  r.Priority,
-			HoldUntil: time.Unix(r.HoldUntil, 0),
-			TTR:       time.Duration(r.TTR) * time.Second,
-			Content:   r.Content,
-		}, nil
+		return jobFromMessage(r), nil
 	case *protocol.ErrorMessage:
 		if r.Reason == "empty" {
 			return nil, ErrNoJobs
 		}
-		return nil, errors.New(r.Reason)
+		return nil, reasonError(r.Reason)
 	default:
 		return nil, ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
 	}
 }
 
+// ReserveWait tries to reserve a job from queue every second until it gets
+// one. It only gives up if something goes wrong, so ReserveWaitContext is
+// the way to stop waiting.
 func (c *Client) ReserveWait(queue string) (*Job, error) {
+	return c.ReserveWaitContext(context.Background(), queue)
+}
+
+// ReserveWaitContext is ReserveWait, but gives up when ctx is done.
+func (c *Client) ReserveWaitContext(ctx context.Context, queue string) (*Job, error) {
 	for {
-		j, err := c.Reserve(queue)
+		j, err := c.ReserveContext(ctx, queue)
 		switch err {
 		case nil:
 			return j, nil
 		case ErrNoJobs:
-			time.Sleep(time.Second)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		default:
 			return nil, err
 		}
@@ -215,33 +741,187 @@ func (c *Client) ReserveWait(queue string) (*Job, error) {
 }
 
 func (c *Client) Peek(queue string) (*Job, error) {
-	r, err := c.req(&protocol.PeekMessage{Queue: queue})
+	return c.PeekContext(context.Background(), queue)
+}
+
+// PeekContext is Peek, but gives up when ctx is done.
+func (c *Client) PeekContext(ctx context.Context, queue string) (*Job, error) {
+	var j *Job
+	call := Call{Op: OpPeek, Queue: queue}
+	err := c.do(ctx, &call, func(ctx context.Context) error {
+		var err error
+		if j, err = c.peek(ctx, queue); j != nil {
+			call.JobID = j.ID
+		}
+		return err
+	})
+
+	return j, err
+}
+
+func (c *Client) peek(ctx context.Context, queue string) (*Job, error) {
+	r, err := c.req(ctx, &protocol.PeekMessage{Queue: queue})
 	if err != nil {
 		return nil, err
 	}
 
 	switch r := r.(type) {
 	case *protocol.JobMessage:
-		return &Job{
-			ID:        r.ID,
-			Queue:     r.Queue,
-			Priority:  r.Priority,
-			HoldUntil: time.Unix(r.HoldUntil, 0),
-			TTR:       time.Duration(r.TTR) * time.Second,
-			Content:   r.Content,
-		}, nil
+		return jobFromMessage(r), nil
+	case *protocol.ErrorMessage:
+		if r.Reason == "empty" {
+			return nil, ErrNoJobs
+		}
+		return nil, reasonError(r.Reason)
+	default:
+		return nil, ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+	}
+}
+
+// Scan returns the job with the lowest ID greater than after, optionally
+// limited to one queue and one state. It returns ErrNoJobs once there are no
+// more jobs to return, so a full listing is a loop passing the previous ID back
+// in as after.
+func (c *Client) Scan(queue, state, after string) (*Job, error) {
+	return c.ScanContext(context.Background(), queue, state, after)
+}
+
+// ScanContext is Scan, but gives up when ctx is done.
+func (c *Client) ScanContext(ctx context.Context, queue, state, after string) (*Job, error) {
+	var j *Job
+	call := Call{Op: OpScan, Queue: queue}
+	err := c.do(ctx, &call, func(ctx context.Context) error {
+		var err error
+		if j, err = c.scan(ctx, queue, state, after); j != nil {
+			call.JobID = j.ID
+		}
+		return err
+	})
+
+	return j, err
+}
+
+func (c *Client) scan(ctx context.Context, queue, state, after string) (*Job, error) {
+	if err := c.require(ctx, "scan"); err != nil {
+		return nil, err
+	}
+
+	r, err := c.req(ctx, &protocol.ScanMessage{Queue: queue, State: state, After: after})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := r.(type) {
+	case *protocol.JobMessage:
+		return jobFromMessage(r), nil
+	case *protocol.ErrorMessage:
+		if r.Reason == "empty" {
+			return nil, ErrNoJobs
+		}
+		return nil, reasonError(r.Reason)
+	default:
+		return nil, ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+	}
+}
+
+type QueueStats struct {
+	Queue string
+	Ready uint64
+	Held  uint64
+}
+
+// Stats counts the jobs in the queue with the lowest name greater than after,
+// so that every queue can be listed the same way Scan lists jobs. If queue is
+// set, only that queue is counted.
+func (c *Client) Stats(queue, after string) (*QueueStats, error) {
+	return c.StatsContext(context.Background(), queue, after)
+}
+
+// StatsContext is Stats, but gives up when ctx is done.
+func (c *Client) StatsContext(ctx context.Context, queue, after string) (*QueueStats, error) {
+	var s *QueueStats
+	err := c.do(ctx, &Call{Op: OpStats, Queue: queue}, func(ctx context.Context) error {
+		var err error
+		s, err = c.stats(ctx, queue, after)
+		return err
+	})
+
+	return s, err
+}
+
+func (c *Client) stats(ctx context.Context, queue, after string) (*QueueStats, error) {
+	if err := c.require(ctx, "stats"); err != nil {
+		return nil, err
+	}
+
+	r, err := c.req(ctx, &protocol.StatsMessage{Queue: queue, After: after})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := r.(type) {
+	case *protocol.QueueStatsMessage:
+		return &QueueStats{Queue: r.Queue, Ready: r.Ready, Held: r.Held}, nil
 	case *protocol.ErrorMessage:
 		if r.Reason == "empty" {
 			return nil, ErrNoJobs
 		}
-		return nil, errors.New(r.Reason)
+		return nil, reasonError(r.Reason)
 	default:
 		return nil, ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
 	}
 }
 
 func (c *Client) Delete(queue, id string) error {
-	r, err := c.req(&protocol.DeleteMessage{Queue: queue, ID: id})
+	return c.DeleteContext(context.Background(), queue, id)
+}
+
+// DeleteContext is Delete, but gives up when ctx is done.
+func (c *Client) DeleteContext(ctx context.Context, queue, id string) error {
+	return c.do(ctx, &Call{Op: OpDelete, Queue: queue, JobID: id}, func(ctx context.Context) error {
+		return c.delete(ctx, queue, id)
+	})
+}
+
+func (c *Client) delete(ctx context.Context, queue, id string) error {
+	r, err := c.req(ctx, &protocol.DeleteMessage{Queue: queue, ID: id})
+	if err != nil {
+		return err
+	}
+
+	switch r := r.(type) {
+	case *protocol.SuccessMessage:
+		return nil
+	case *protocol.ErrorMessage:
+		if r.Reason == "not found" {
+			return ErrNotFound
+		}
+		return reasonError(r.Reason)
+	default:
+		return ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+	}
+}
+
+// Release changes the priority of a job and holds it until holdUntil. It's
+// how a reserved job is given back early, or held for longer while it's
+// still being worked on.
+func (c *Client) Release(queue, id string, priority float64, holdUntil time.Time) error {
+	return c.ReleaseContext(context.Background(), queue, id, priority, holdUntil)
+}
+
+// ReleaseContext is Release, but gives up when ctx is done.
+func (c *Client) ReleaseContext(ctx context.Context, queue, id string, priority float64, holdUntil time.Time) error {
+	return c.do(ctx, &Call{Op: OpRelease, Queue: queue, JobID: id}, func(ctx context.Context) error {
+		return c.release(ctx, queue, id, priority, holdUntil)
+	})
+}
+
+func (c *Client) release(ctx context.Context, queue, id string, priority float64, holdUntil time.Time) error {
+	if err := c.require(ctx, "release"); err != nil {
+		return err
+	}
+
+	r, err := c.req(ctx, &protocol.ReleaseMessage{Queue: queue, ID: id, Priority: priority, HoldUntil: holdUntil.Unix()})
 	if err != nil {
 		return err
 	}
@@ -253,8 +933,85 @@ func (c *Client) Delete(queue, id string) error {
 		if r.Reason == "not found" {
 			return ErrNotFound
 		}
-		return errors.New(r.Reason)
+		return reasonError(r.Reason)
 	default:
 		return ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
 	}
 }
+
+// Purge deletes every job in a queue, whether it's ready, held or reserved.
+// Servers with a policy only let admins purge queues.
+func (c *Client) Purge(queue string) error {
+	return c.PurgeContext(context.Background(), queue)
+}
+
+// PurgeContext is Purge, but gives up when ctx is done.
+func (c *Client) PurgeContext(ctx context.Context, queue string) error {
+	return c.do(ctx, &Call{Op: OpPurge, Queue: queue}, func(ctx context.Context) error {
+		return c.purge(ctx, queue)
+	})
+}
+
+func (c *Client) purge(ctx context.Context, queue string) error {
+	if err := c.require(ctx, "purge"); err != nil {
+		return err
+	}
+
+	r, err := c.req(ctx, &protocol.PurgeMessage{Queue: queue})
+	if err != nil {
+		return err
+	}
+
+	switch r := r.(type) {
+	case *protocol.SuccessMessage:
+		return nil
+	case *protocol.ErrorMessage:
+		return reasonError(r.Reason)
+	default:
+		return ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+	}
+}
+
+// Backup makes the server write a snapshot of its jobs to path, which is
+// relative to the directory the server keeps backups in. Servers only take
+// backups if they've been given a directory for them.
+func (c *Client) Backup(path string) error {
+	return c.BackupContext(context.Background(), path)
+}
+
+// BackupContext is Backup, but gives up when ctx is done.
+func (c *Client) BackupContext(ctx context.Context, path string) error {
+	return c.do(ctx, &Call{Op: OpBackup}, func(ctx context.Context) error {
+		return c.backup(ctx, path)
+	})
+}
+
+func (c *Client) backup(ctx context.Context, path string) error {
+	if err := c.require(ctx, "backup"); err != nil {
+		return err
+	}
+
+	r, err := c.req(ctx, &protocol.BackupMessage{Path: path})
+	if err != nil {
+		return err
+	}
+
+	switch r := r.(type) {
+	case *protocol.SuccessMessage:
+		return nil
+	case *protocol.ErrorMessage:
+		return reasonError(r.Reason)
+	default:
+		return ErrUnhandledType(fmt.Errorf("can't handle message type %T", r))
+	}
+}
+
+// reasonError turns the reason in an error message that a method doesn't deal
+// with itself into an error.
+func reasonError(reason string) error {
+	if reason == "denied" {
+		return ErrDenied
+	}
+
+	return errors.New(reason)
+}
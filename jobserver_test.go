@@ -0,0 +1,36 @@
+package jobserver_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+func TestPutTooLarge(t *testing.T) {
+	s := jobservertest.New(t)
+
+	c, err := jobserver.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	content := strings.Repeat("x", protocol.MessageSize)
+	if err := c.Put("q", "big", content, 0, time.Now(), time.Minute); err != jobserver.ErrTooLarge {
+		t.Fatalf("got error %#v, want %v", err, jobserver.ErrTooLarge)
+	}
+
+	// the connection's still fine
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("q", "small", "x", 0, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.AssertJobs("q", "small")
+}
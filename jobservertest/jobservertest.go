@@ -0,0 +1,232 @@
+// Package jobservertest runs job servers inside tests, for testing code that
+// uses jobserver clients without starting jobserverd.
+package jobservertest // import "fknsrs.biz/p/jobserver/jobservertest"
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/server"
+	"github.com/Sirupsen/logrus"
+)
+
+// Server is a job server listening on loopback ports that the system picked,
+// with a store in a temporary directory that's removed when it's closed.
+// Backups that clients ask for go in the same directory. It has its own
+// clock, which starts at the real time and can be moved forward with Advance,
+// so that held jobs can become ready without waiting.
+//
+// Jobs are held to the second, and only become ready once the second they're
+// held until has passed. A job put to be ready now isn't ready until the clock
+// moves on, which Advance(time.Second) takes care of.
+type Server struct {
+	// Addr is the address for UDP clients, and TCPAddr is the address for
+	// TCP clients. Either can be given to jobserver.Dial as is.
+	Addr    string
+	TCPAddr string
+
+	t      testing.TB
+	srv    *server.Server
+	st     server.Store
+	dir    string
+	client *jobserver.Client
+	closed sync.Once
+
+	clockM sync.Mutex
+	offset time.Duration
+}
+
+// New starts a server, using the backend that jobserverd uses by default.
+// It's closed when the test finishes. Anything that goes wrong while starting
+// it fails the test straight away.
+func New(t testing.TB) *Server {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "jobservertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "backups"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	st, err := server.Backends[server.DefaultBackend].Open(filepath.Join(dir, "jobs"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s := Server{t: t, st: st, dir: dir}
+
+	l := logrus.New()
+	l.Out = ioutil.Discard
+
+	s.srv = server.New(st)
+	s.srv.SetLogger(l)
+	s.srv.SetClock(s.Now)
+	s.srv.SetBackupDir(filepath.Join(dir, "backups"))
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		s.close()
+		t.Fatal(err)
+	}
+	s.srv.AddPacketConn(pc)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		s.close()
+		t.Fatal(err)
+	}
+	s.srv.AddListener(ln)
+
+	s.Addr = pc.LocalAddr().String()
+	s.TCPAddr = "tcp://" + ln.Addr().String()
+
+	go s.srv.Serve()
+
+	if s.client, err = jobserver.Dial(s.TCPAddr); err != nil {
+		s.close()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Close)
+
+	return &s
+}
+
+// Client returns a client that's connected to the server over TCP. It's
+// closed along with the server.
+func (s *Server) Client() *jobserver.Client {
+	return s.client
+}
+
+// Close stops the server and removes its store. It's safe to call more than
+// once.
+func (s *Server) Close() {
+	s.closed.Do(s.close)
+}
+
+func (s *Server) close() {
+	if s.client != nil {
+		s.client.Close()
+	}
+
+	s.srv.Shutdown(context.Background())
+	s.st.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Now returns the time according to the server's clock.
+func (s *Server) Now() time.Time {
+	s.clockM.Lock()
+	defer s.clockM.Unlock()
+
+	return time.Now().Add(s.offset)
+}
+
+// Advance moves the server's clock forward by d. Jobs that were held until
+// before the new time are ready straight away, including reserved jobs whose
+// TTR has run out.
+func (s *Server) Advance(d time.Duration) {
+	s.clockM.Lock()
+	defer s.clockM.Unlock()
+
+	s.offset += d
+}
+
+// Jobs returns the jobs in a queue that are in the given state, ordered by ID.
+// An empty state means every job.
+func (s *Server) Jobs(queue, state string) []*jobserver.Job {
+	s.t.Helper()
+
+	var l []*jobserver.Job
+	for after := ""; ; {
+		j, err := s.client.Scan(queue, state, after)
+		if err == jobserver.ErrNoJobs {
+			return l
+		} else if err != nil {
+			s.t.Fatal(err)
+		}
+
+		l = append(l, j)
+		after = j.ID
+	}
+}
+
+// AssertJobs fails the test unless the jobs in a queue have exactly the given
+// IDs, in any order.
+func (s *Server) AssertJobs(queue string, ids ...string) {
+	s.t.Helper()
+	s.assert(queue, "", ids)
+}
+
+// AssertReady fails the test unless the jobs in a queue that are ready to be
+// reserved have exactly the given IDs, in any order.
+func (s *Server) AssertReady(queue string, ids ...string) {
+	s.t.Helper()
+	s.assert(queue, jobserver.StateReady, ids)
+}
+
+// AssertHeld fails the test unless the jobs in a queue that are reserved or
+// held have exactly the given IDs, in any order.
+func (s *Server) AssertHeld(queue string, ids ...string) {
+	s.t.Helper()
+	s.assert(queue, jobserver.StateHeld, ids)
+}
+
+// AssertEmpty fails the test if there are any jobs in a queue.
+func (s *Server) AssertEmpty(queue string) {
+	s.t.Helper()
+	s.assert(queue, "", nil)
+}
+
+func (s *Server) assert(queue, state string, want []string) {
+	s.t.Helper()
+
+	got := []string{}
+	for _, j := range s.Jobs(queue, state) {
+		got = append(got, j.ID)
+	}
+
+	want = append([]string{}, want...)
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(got, want) {
+		what := "jobs"
+		if state != "" {
+			what = state + " jobs"
+		}
+
+		s.t.Errorf("%s in queue %q are %q, want %q", what, queue, got, want)
+	}
+}
+
+// AssertContent fails the test unless a queue has a job with the given ID and
+// content.
+func (s *Server) AssertContent(queue, id, content string) {
+	s.t.Helper()
+
+	for _, j := range s.Jobs(queue, "") {
+		if j.ID == id {
+			if j.Content != content {
+				s.t.Errorf("job %q in queue %q has content %q, want %q", id, queue, j.Content, content)
+			}
+
+			return
+		}
+	}
+
+	s.t.Errorf("no job %q in queue %q", id, queue)
+}
@@ -0,0 +1,159 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"math/rand"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+// RetryPolicy decides how long a client waits for the response to each try of
+// a request, and how many tries it makes. Requests are only sent again over
+// transports that can lose them, like UDP; over TCP, the policy only decides
+// how long to wait altogether.
+type RetryPolicy interface {
+	// Timeout returns how long to wait for the response to the nth try of a
+	// request, counting from 1, where elapsed is how long it's been since the
+	// first try. If ok is false, there's no nth try, and the request fails
+	// with ErrTimeout. The first try is always made.
+	Timeout(n int, elapsed time.Duration) (d time.Duration, ok bool)
+}
+
+type constantRetry struct {
+	timeout time.Duration
+	retries int
+}
+
+func (p constantRetry) Timeout(n int, elapsed time.Duration) (time.Duration, bool) {
+	return p.timeout, n <= p.retries+1
+}
+
+// ConstantRetry waits the same time for every try, and tries again up to
+// retries times. It's what clients do by default, with the timeout and retries
+// from SetTimeout and SetRetries.
+func ConstantRetry(timeout time.Duration, retries int) RetryPolicy {
+	return constantRetry{timeout: timeout, retries: retries}
+}
+
+type exponentialRetry struct {
+	initial time.Duration
+	max     time.Duration
+	retries int
+}
+
+func (p exponentialRetry) Timeout(n int, elapsed time.Duration) (time.Duration, bool) {
+	d := p.initial
+	for i := 1; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+
+	return d, n <= p.retries+1
+}
+
+// ExponentialRetry waits initial for the first try, and twice as long for each
+// try after that, up to max. It tries again up to retries times.
+func ExponentialRetry(initial, max time.Duration, retries int) RetryPolicy {
+	return exponentialRetry{initial: initial, max: max, retries: retries}
+}
+
+type jitter struct {
+	p        RetryPolicy
+	fraction float64
+}
+
+func (p jitter) Timeout(n int, elapsed time.Duration) (time.Duration, bool) {
+	d, ok := p.p.Timeout(n, elapsed)
+
+	return d + time.Duration((rand.Float64()*2-1)*p.fraction*float64(d)), ok
+}
+
+// Jitter changes each of p's waits by a random amount, up to fraction of the
+// wait either way, so that clients that all time out at once don't all try
+// again at once.
+func Jitter(p RetryPolicy, fraction float64) RetryPolicy {
+	return jitter{p: p, fraction: fraction}
+}
+
+type maxElapsed struct {
+	p   RetryPolicy
+	max time.Duration
+}
+
+func (p maxElapsed) Timeout(n int, elapsed time.Duration) (time.Duration, bool) {
+	d, ok := p.p.Timeout(n, elapsed)
+	if n > 1 && elapsed >= p.max {
+		return 0, false
+	}
+	if d > p.max-elapsed {
+		d = p.max - elapsed
+	}
+
+	return d, ok
+}
+
+// MaxElapsed gives up on a request once it's been max since the first try,
+// however many more tries p would make.
+func MaxElapsed(p RetryPolicy, max time.Duration) RetryPolicy {
+	return maxElapsed{p: p, max: max}
+}
+
+// SetRetryPolicy sets the retry policy for every request that doesn't have
+// its own. With a nil policy, the client goes back to waiting for the timeout
+// from SetTimeout and trying again up to the number of times from SetRetries.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.m.Lock()
+	c.retry = p
+	c.m.Unlock()
+}
+
+// SetOpRetryPolicy sets the retry policy for one kind of request, which is
+// one of the Op constants. A nil policy goes back to the client's policy.
+func (c *Client) SetOpRetryPolicy(op string, p RetryPolicy) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if p == nil {
+		delete(c.opRetry, op)
+		return
+	}
+
+	if c.opRetry == nil {
+		c.opRetry = make(map[string]RetryPolicy)
+	}
+
+	c.opRetry[op] = p
+}
+
+// retryPolicy returns the retry policy for an operation.
+func (c *Client) retryPolicy(op string) RetryPolicy {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	if p, ok := c.opRetry[op]; ok {
+		return p
+	}
+	if c.retry != nil {
+		return c.retry
+	}
+
+	return ConstantRetry(c.timeout, c.retries)
+}
+
+// repeatable reports whether a request does the same thing if it's run twice.
+// Reserving or deleting a job, or putting one that mustn't already exist,
+// would go differently the second time if the first try had made it to the
+// server, so those are only sent again while the server remembers the first
+// response.
+func repeatable(m protocol.Message) bool {
+	switch m := m.(type) {
+	case *protocol.ReserveMessage, *protocol.DeleteMessage:
+		return false
+	case *protocol.JobMessage:
+		return m.Conflict != ConflictFail
+	default:
+		return true
+	}
+}
@@ -0,0 +1,100 @@
+package jobserver
+
+import (
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func TestRepeatable(t *testing.T) {
+	for _, tc := range []struct {
+		m    protocol.Message
+		want bool
+	}{
+		{&protocol.PingMessage{}, true},
+		{&protocol.HelloMessage{}, true},
+		{&protocol.JobMessage{}, true},
+		{&protocol.JobMessage{Conflict: ConflictUpdate}, true},
+		{&protocol.JobMessage{Conflict: ConflictReplace}, true},
+		{&protocol.JobMessage{Conflict: ConflictSkip}, true},
+		{&protocol.JobMessage{Conflict: ConflictFail}, false},
+		{&protocol.ReserveMessage{}, false},
+		{&protocol.DeleteMessage{}, false},
+		{&protocol.PeekMessage{}, true},
+		{&protocol.ScanMessage{}, true},
+		{&protocol.StatsMessage{}, true},
+		{&protocol.ReleaseMessage{}, true},
+		{&protocol.BackupMessage{}, true},
+	} {
+		if got := repeatable(tc.m); got != tc.want {
+			t.Errorf("repeatable(%T with %#v) = %v, want %v", tc.m, tc.m, got, tc.want)
+		}
+	}
+}
+
+type try struct {
+	n       int
+	elapsed time.Duration
+	wait    time.Duration
+	ok      bool
+}
+
+func checkTries(t *testing.T, name string, p RetryPolicy, tries []try) {
+	for _, tc := range tries {
+		if wait, ok := p.Timeout(tc.n, tc.elapsed); wait != tc.wait || ok != tc.ok {
+			t.Errorf("%s: try %d after %s waits %s, %v; want %s, %v", name, tc.n, tc.elapsed, wait, ok, tc.wait, tc.ok)
+		}
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	checkTries(t, "constant", ConstantRetry(time.Second, 2), []try{
+		{1, 0, time.Second, true},
+		{3, time.Second * 2, time.Second, true},
+		{4, time.Second * 3, time.Second, false},
+	})
+
+	checkTries(t, "no retries", ConstantRetry(time.Second, 0), []try{
+		{1, 0, time.Second, true},
+		{2, time.Second, time.Second, false},
+	})
+
+	checkTries(t, "exponential", ExponentialRetry(time.Millisecond*100, time.Millisecond*500, 5), []try{
+		{1, 0, time.Millisecond * 100, true},
+		{2, 0, time.Millisecond * 200, true},
+		{3, 0, time.Millisecond * 400, true},
+		{4, 0, time.Millisecond * 500, true},
+		{6, 0, time.Millisecond * 500, true},
+		{7, 0, time.Millisecond * 500, false},
+	})
+
+	checkTries(t, "max elapsed", MaxElapsed(ConstantRetry(time.Second, 10), time.Millisecond*2500), []try{
+		{1, 0, time.Second, true},
+		{3, time.Second * 2, time.Millisecond * 500, true},
+		{4, time.Millisecond * 2500, 0, false},
+	})
+
+	p := Jitter(ConstantRetry(time.Second, 1), 0.25)
+	for i := 0; i < 100; i++ {
+		wait, ok := p.Timeout(1, 0)
+		if wait < time.Millisecond*750 || wait > time.Millisecond*1250 || !ok {
+			t.Fatalf("jitter: waits %s, %v; want between 750ms and 1.25s, true", wait, ok)
+		}
+	}
+}
+
+func TestRetryPolicyOverrides(t *testing.T) {
+	c := &Client{timeout: time.Second, retries: 2}
+
+	checkTries(t, "default", c.retryPolicy(OpPut), []try{{3, 0, time.Second, true}, {4, 0, time.Second, false}})
+
+	c.SetRetryPolicy(ConstantRetry(time.Minute, 0))
+	c.SetOpRetryPolicy(OpReserve, ConstantRetry(time.Hour, 0))
+
+	checkTries(t, "client", c.retryPolicy(OpPut), []try{{1, 0, time.Minute, true}})
+	checkTries(t, "op", c.retryPolicy(OpReserve), []try{{1, 0, time.Hour, true}})
+
+	c.SetOpRetryPolicy(OpReserve, nil)
+	checkTries(t, "op removed", c.retryPolicy(OpReserve), []try{{1, 0, time.Minute, true}})
+}
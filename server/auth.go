@@ -0,0 +1,69 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+var (
+	ErrReplayedNonce = errors.New("nonce has already been used")
+)
+
+// auth checks sealed messages. Each nonce is remembered for as long as a
+// message carrying it could still be inside the time window, so a captured
+// message can't be sent again, even from somewhere else. Clients seal each
+// retry afresh, and the replay cache deals with those.
+type auth struct {
+	keys   *keyring.Keyring
+	window time.Duration
+
+	m     sync.Mutex
+	seen  map[string]bool
+	order *list.List
+}
+
+type authNonce struct {
+	nonce string
+	until time.Time
+}
+
+func newAuth(keys *keyring.Keyring, window time.Duration) *auth {
+	return &auth{
+		keys:   keys,
+		window: window,
+		seen:   make(map[string]bool),
+		order:  list.New(),
+	}
+}
+
+func (a *auth) open(d []byte, now time.Time) (*protocol.Sealed, error) {
+	sm, err := protocol.Open(a.keys, d, now, a.window)
+	if err != nil {
+		return nil, err
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for e := a.order.Front(); e != nil && e.Value.(*authNonce).until.Before(now); e = a.order.Front() {
+		a.order.Remove(e)
+		delete(a.seen, e.Value.(*authNonce).nonce)
+	}
+
+	nonce := sm.KeyID + " " + string(sm.Nonce)
+	if a.seen[nonce] {
+		return nil, ErrReplayedNonce
+	}
+
+	// the message stays inside the window until window after it was sealed,
+	// and it can't have been sealed more than window from now
+	a.seen[nonce] = true
+	a.order.PushBack(&authNonce{nonce: nonce, until: now.Add(a.window * 2)})
+
+	return sm, nil
+}
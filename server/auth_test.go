@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func TestAuthReplayedNonce(t *testing.T) {
+	keys, err := keyring.Parse(strings.NewReader("a AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	a := newAuth(keys, time.Second*30)
+
+	d, err := protocol.Seal(keys, "a", []byte("ping"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.open(d, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same message, sent again anywhere in its window, is rejected
+	for _, later := range []time.Duration{0, time.Second * 10, time.Second * 30} {
+		if _, err := a.open(d, now.Add(later)); err != ErrReplayedNonce {
+			t.Fatalf("replayed %s later, got error %v, want %v", later, err, ErrReplayedNonce)
+		}
+	}
+
+	// once it's outside its window, it's rejected for being stale instead
+	later := now.Add(time.Minute + time.Second)
+	if _, err := a.open(d, later); err == nil || !strings.HasPrefix(err.Error(), protocol.ErrStaleSeal.Error()) {
+		t.Fatalf("replayed after the window, got error %v, want %v", err, protocol.ErrStaleSeal)
+	}
+
+	// and its nonce is forgotten the next time a message gets through
+	d2, err := protocol.Seal(keys, "a", []byte("ping"), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.open(d2, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.seen) != 1 || a.order.Len() != 1 {
+		t.Fatalf("%d nonces are remembered, want 1", len(a.seen))
+	}
+}
@@ -0,0 +1,21 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/logstore"
+)
+
+// Backend is a kind of store. Open opens or makes a store at path, and
+// Restore installs a snapshot made by a backup as the store at dst.
+type Backend struct {
+	Open    func(path string) (Store, error)
+	Restore func(src, dst string, force bool) error
+}
+
+// Backends are the available backends, by name.
+var Backends = map[string]Backend{
+	"log": {
+		Open:    func(path string) (store.Store, error) { return logstore.Open(path) },
+		Restore: logstore.Restore,
+	},
+}
@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package server // import "fknsrs.biz/p/jobserver/server"
+
+// DefaultBackend is the backend to use when there's no reason to pick one.
+// SQLite needs cgo, so builds without it only have the log backend.
+const DefaultBackend = "log"
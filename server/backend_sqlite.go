@@ -0,0 +1,19 @@
+//go:build cgo
+// +build cgo
+
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/sqlite"
+)
+
+// DefaultBackend is the backend to use when there's no reason to pick one.
+const DefaultBackend = "sqlite"
+
+func init() {
+	Backends["sqlite"] = Backend{
+		Open:    func(path string) (store.Store, error) { return sqlite.Open(path) },
+		Restore: sqlite.Restore,
+	}
+}
@@ -0,0 +1,573 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"github.com/Sirupsen/logrus"
+)
+
+// The beanstalkd front-end lets beanstalkd clients use jobserverd. Tubes are
+// queues. Beanstalkd priorities are unsigned with the most urgent first, so
+// they're negated on the way in. Jobs put through it get numeric IDs, since
+// that's what beanstalkd clients expect; jobs put any other way can only be
+// used by beanstalkd clients if their IDs happen to be numbers too.
+//
+// There's no distinction between reserved and delayed jobs in jobserverd, so
+// stats-tube counts them all as delayed. A connection can delete any job
+// except one that another beanstalkd connection has reserved and is still
+// within its TTR; jobs reserved any other way look delayed, and can be
+// deleted. Tubes exist while they have jobs in them, or while the connection
+// asking about them is using or watching them. Jobs reserved by a connection
+// aren't released when it closes; they become ready again once their TTR runs
+// out.
+var (
+	beanstalkPollInterval = time.Millisecond * 100
+	beanstalkLastID       = uint64(time.Now().UnixNano())
+)
+
+type beanstalkCommand struct {
+	name string
+	args []string
+	data []byte
+	// if set, this is sent back instead of running the command
+	reply string
+}
+
+// beanstalkHolds records which connection has reserved which jobs, and until
+// when, so that connections can't delete each other's reserved jobs.
+type beanstalkHolds struct {
+	m     sync.Mutex
+	holds map[string]beanstalkHold
+}
+
+type beanstalkHold struct {
+	b     *beanstalkSession
+	until time.Time
+}
+
+func (h *beanstalkHolds) hold(id string, b *beanstalkSession, until time.Time) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.holds == nil {
+		h.holds = make(map[string]beanstalkHold)
+	}
+
+	h.holds[id] = beanstalkHold{b: b, until: until}
+}
+
+// heldByOther reports whether a connection other than b has the job reserved.
+func (h *beanstalkHolds) heldByOther(id string, b *beanstalkSession, now time.Time) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	e, ok := h.holds[id]
+
+	return ok && e.b != b && now.Before(e.until)
+}
+
+// release forgets that b has the job reserved, if it still does.
+func (h *beanstalkHolds) release(id string, b *beanstalkSession) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if e, ok := h.holds[id]; ok && e.b == b {
+		delete(h.holds, id)
+	}
+}
+
+type beanstalkSession struct {
+	s        *Server
+	c        net.Conn
+	w        *bufio.Writer
+	l        *logrus.Entry
+	done     chan struct{}
+	use      string
+	watch    []string
+	reserved map[string]*protocol.JobMessage
+}
+
+func (s *Server) serveBeanstalk(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveBeanstalkConn(c)
+	}
+}
+
+func (s *Server) serveBeanstalkConn(c net.Conn) {
+	defer c.Close()
+
+	if !s.track(c) {
+		return
+	}
+	defer s.untrack(c)
+
+	b := beanstalkSession{
+		s:        s,
+		c:        c,
+		w:        bufio.NewWriter(c),
+		l:        s.log.WithField("remote", c.RemoteAddr().String()),
+		done:     make(chan struct{}),
+		use:      "default",
+		watch:    []string{"default"},
+		reserved: make(map[string]*protocol.JobMessage),
+	}
+
+	b.l.Debug("accepted beanstalk connection")
+
+	// commands are read separately so that a blocking reserve can tell when
+	// the client goes away
+	ch := make(chan beanstalkCommand)
+	go b.read(ch)
+
+	for cmd := range ch {
+		if cmd.reply != "" {
+			b.send(cmd.reply)
+		} else if !b.run(cmd) {
+			break
+		}
+
+		if err := b.w.Flush(); err != nil {
+			b.l.WithField("error", err.Error()).Error("error writing response")
+			break
+		}
+	}
+
+	// let the reader finish up if it's waiting to hand over a command
+	c.Close()
+	for range ch {
+	}
+
+	for id := range b.reserved {
+		s.beanstalk.release(id, &b)
+	}
+
+	b.l.Debug("closed beanstalk connection")
+}
+
+func (b *beanstalkSession) read(ch chan<- beanstalkCommand) {
+	defer close(ch)
+	defer close(b.done)
+
+	r := bufio.NewReader(b.c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				b.l.WithField("error", err.Error()).Debug("error reading command")
+			}
+
+			return
+		}
+
+		bits := strings.Fields(line)
+		if len(bits) == 0 {
+			ch <- beanstalkCommand{reply: "UNKNOWN_COMMAND"}
+			continue
+		}
+
+		cmd := beanstalkCommand{name: bits[0], args: bits[1:]}
+
+		if cmd.name == "put" {
+			if len(cmd.args) != 4 {
+				ch <- beanstalkCommand{reply: "BAD_FORMAT"}
+				continue
+			}
+
+			n, err := strconv.Atoi(cmd.args[3])
+			if err != nil || n < 0 {
+				ch <- beanstalkCommand{reply: "BAD_FORMAT"}
+				continue
+			}
+
+			if n > protocol.MaxFrameSize {
+				// the data still has to be read past to find the next command
+				if _, err := io.CopyN(ioutil.Discard, r, int64(n)+2); err != nil {
+					return
+				}
+
+				ch <- beanstalkCommand{reply: "JOB_TOO_BIG"}
+				continue
+			}
+
+			d := make([]byte, n+2)
+			if _, err := io.ReadFull(r, d); err != nil {
+				return
+			}
+
+			if !bytes.HasSuffix(d, []byte("\r\n")) {
+				ch <- beanstalkCommand{reply: "EXPECTED_CRLF"}
+				continue
+			}
+
+			cmd.data = d[0:n]
+		}
+
+		ch <- cmd
+	}
+}
+
+func (b *beanstalkSession) send(format string, args ...interface{}) {
+	fmt.Fprintf(b.w, format+"\r\n", args...)
+}
+
+func (b *beanstalkSession) sendJob(m *protocol.JobMessage) {
+	b.send("RESERVED %s %d", m.ID, len(m.Content))
+	b.w.WriteString(m.Content)
+	b.w.WriteString("\r\n")
+}
+
+// handle runs a message through the same handler as every other transport.
+// If that fails, or panics, the client gets INTERNAL_ERROR and nil is
+// returned. Requests that the policy doesn't allow get DENIED, which isn't
+// something beanstalkd would send, but clients treat any response they don't
+// know as an error.
+func (b *beanstalkSession) handle(m protocol.Message) (res protocol.Message) {
+	l := b.l.WithField("seq", atomic.AddInt64(&b.s.seq, 1))
+
+	defer func() {
+		if e := recover(); e != nil {
+			l.WithField("error", panicError(e).Error()).Error("error processing message")
+			b.send("INTERNAL_ERROR")
+			res = nil
+		}
+	}()
+
+	res, err := b.s.handle(m, "", l)
+	if err != nil {
+		l.WithField("error", err.Error()).Error("error processing message")
+		b.send("INTERNAL_ERROR")
+		return nil
+	}
+
+	if res, ok := res.(*protocol.ErrorMessage); ok && res.Reason == "denied" {
+		b.send("DENIED")
+		return nil
+	}
+
+	return res
+}
+
+// run runs a command and sends its response. It returns false if the
+// connection should be closed.
+func (b *beanstalkSession) run(cmd beanstalkCommand) bool {
+	switch cmd.name {
+	case "quit":
+		return false
+	case "use":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		b.use = cmd.args[0]
+		b.send("USING %s", b.use)
+	case "watch":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		if !b.watching(cmd.args[0]) {
+			b.watch = append(b.watch, cmd.args[0])
+		}
+		b.send("WATCHING %d", len(b.watch))
+	case "ignore":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		if b.watching(cmd.args[0]) && len(b.watch) == 1 {
+			b.send("NOT_IGNORED")
+			break
+		}
+
+		var watch []string
+		for _, t := range b.watch {
+			if t != cmd.args[0] {
+				watch = append(watch, t)
+			}
+		}
+		b.watch = watch
+		b.send("WATCHING %d", len(b.watch))
+	case "put":
+		pri, err1 := strconv.ParseUint(cmd.args[0], 10, 32)
+		delay, err2 := strconv.ParseUint(cmd.args[1], 10, 32)
+		ttr, err3 := strconv.ParseUint(cmd.args[2], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			b.send("BAD_FORMAT")
+			break
+		}
+		if ttr == 0 {
+			ttr = 1
+		}
+
+		id := strconv.FormatUint(atomic.AddUint64(&beanstalkLastID, 1), 10)
+
+		switch b.handle(&protocol.JobMessage{
+			ID:        id,
+			Queue:     b.use,
+			Priority:  -float64(pri),
+			HoldUntil: beanstalkHoldUntil(b.s.now(), delay),
+			TTR:       ttr,
+			Conflict:  store.ConflictFail,
+			Content:   string(cmd.data),
+		}).(type) {
+		case *protocol.SuccessMessage:
+			b.send("INSERTED %s", id)
+		case *protocol.ErrorMessage:
+			b.send("INTERNAL_ERROR")
+		}
+	case "reserve", "reserve-with-timeout":
+		var deadline time.Time
+		if cmd.name == "reserve-with-timeout" {
+			if len(cmd.args) != 1 {
+				b.send("BAD_FORMAT")
+				break
+			}
+
+			n, err := strconv.ParseUint(cmd.args[0], 10, 32)
+			if err != nil {
+				b.send("BAD_FORMAT")
+				break
+			}
+
+			deadline = time.Now().Add(time.Duration(n) * time.Second)
+		}
+
+		for {
+			m, ok := b.reserve()
+			if !ok {
+				break
+			}
+
+			if m != nil {
+				b.reserved[m.ID] = m
+				b.s.beanstalk.hold(m.ID, b, b.s.now().Add(time.Duration(m.TTR)*time.Second))
+				b.sendJob(m)
+				break
+			}
+
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				b.send("TIMED_OUT")
+				break
+			}
+
+			select {
+			case <-time.After(beanstalkPollInterval):
+			case <-b.done:
+				return false
+			}
+		}
+	case "delete":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		// beanstalkd won't delete a job that another connection has
+		// reserved, but anything else is fair game
+		id := cmd.args[0]
+		if b.s.beanstalk.heldByOther(id, b, b.s.now()) {
+			b.send("NOT_FOUND")
+			break
+		}
+
+		queue, err := b.s.store.Queue(id)
+		if err == store.ErrNotFound {
+			delete(b.reserved, id)
+			b.send("NOT_FOUND")
+			break
+		} else if err != nil {
+			b.l.WithField("error", err.Error()).Error("error finding job")
+			b.send("INTERNAL_ERROR")
+			break
+		}
+
+		switch res := b.handle(&protocol.DeleteMessage{Queue: queue, ID: id}).(type) {
+		case *protocol.SuccessMessage:
+			delete(b.reserved, id)
+			b.s.beanstalk.release(id, b)
+			b.send("DELETED")
+		case *protocol.ErrorMessage:
+			if res.Reason == "not found" {
+				delete(b.reserved, id)
+				b.send("NOT_FOUND")
+			} else {
+				b.send("INTERNAL_ERROR")
+			}
+		}
+	case "release":
+		if len(cmd.args) != 3 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		pri, err1 := strconv.ParseUint(cmd.args[1], 10, 32)
+		delay, err2 := strconv.ParseUint(cmd.args[2], 10, 32)
+		if err1 != nil || err2 != nil {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		m, ok := b.reserved[cmd.args[0]]
+		if !ok || b.s.beanstalk.heldByOther(m.ID, b, b.s.now()) {
+			b.send("NOT_FOUND")
+			break
+		}
+
+		delete(b.reserved, m.ID)
+		b.s.beanstalk.release(m.ID, b)
+
+		b.reschedule(m, -float64(pri), beanstalkHoldUntil(b.s.now(), delay), "RELEASED")
+	case "touch":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		m, ok := b.reserved[cmd.args[0]]
+		if !ok || b.s.beanstalk.heldByOther(m.ID, b, b.s.now()) {
+			b.send("NOT_FOUND")
+			break
+		}
+
+		b.s.beanstalk.hold(m.ID, b, b.s.now().Add(time.Duration(m.TTR)*time.Second))
+		b.reschedule(m, m.Priority, b.s.now().Unix()+int64(m.TTR), "TOUCHED")
+	case "stats-tube":
+		if len(cmd.args) != 1 {
+			b.send("BAD_FORMAT")
+			break
+		}
+
+		var res *protocol.QueueStatsMessage
+		switch r := b.handle(&protocol.StatsMessage{Queue: cmd.args[0]}).(type) {
+		case nil:
+			return true
+		case *protocol.QueueStatsMessage:
+			res = r
+		default:
+			b.send("INTERNAL_ERROR")
+			return true
+		}
+
+		using, watching := 0, 0
+		if b.use == cmd.args[0] {
+			using = 1
+		}
+		if b.watching(cmd.args[0]) {
+			watching = 1
+		}
+
+		if res.Ready+res.Held == 0 && using+watching == 0 {
+			b.send("NOT_FOUND")
+			break
+		}
+
+		var d bytes.Buffer
+		fmt.Fprintf(&d, "---\n")
+		fmt.Fprintf(&d, "name: %s\n", res.Queue)
+		fmt.Fprintf(&d, "current-jobs-urgent: 0\n")
+		fmt.Fprintf(&d, "current-jobs-ready: %d\n", res.Ready)
+		fmt.Fprintf(&d, "current-jobs-reserved: 0\n")
+		fmt.Fprintf(&d, "current-jobs-delayed: %d\n", res.Held)
+		fmt.Fprintf(&d, "current-jobs-buried: 0\n")
+		fmt.Fprintf(&d, "total-jobs: %d\n", res.Ready+res.Held)
+		fmt.Fprintf(&d, "current-using: %d\n", using)
+		fmt.Fprintf(&d, "current-watching: %d\n", watching)
+		fmt.Fprintf(&d, "current-waiting: 0\n")
+		fmt.Fprintf(&d, "cmd-delete: 0\n")
+		fmt.Fprintf(&d, "cmd-pause-tube: 0\n")
+		fmt.Fprintf(&d, "pause: 0\n")
+		fmt.Fprintf(&d, "pause-time-left: 0\n")
+
+		b.send("OK %d", d.Len())
+		b.w.Write(d.Bytes())
+		b.w.WriteString("\r\n")
+	default:
+		b.send("UNKNOWN_COMMAND")
+	}
+
+	return true
+}
+
+func (b *beanstalkSession) watching(tube string) bool {
+	for _, t := range b.watch {
+		if t == tube {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reserve reserves the most urgent ready job from the watched tubes. It
+// returns nil if there isn't one, and false if it sent an error instead.
+func (b *beanstalkSession) reserve() (*protocol.JobMessage, bool) {
+	for {
+		var best *protocol.JobMessage
+		for _, t := range b.watch {
+			switch res := b.handle(&protocol.PeekMessage{Queue: t}).(type) {
+			case nil:
+				return nil, false
+			case *protocol.JobMessage:
+				if best == nil || res.Priority > best.Priority {
+					best = res
+				}
+			}
+		}
+
+		if best == nil {
+			return nil, true
+		}
+
+		switch res := b.handle(&protocol.ReserveMessage{Queue: best.Queue}).(type) {
+		case nil:
+			return nil, false
+		case *protocol.JobMessage:
+			return res, true
+		}
+
+		// someone else got to it first, so look again
+	}
+}
+
+func (b *beanstalkSession) reschedule(m *protocol.JobMessage, priority float64, holdUntil int64, reply string) {
+	switch res := b.handle(&protocol.ReleaseMessage{Queue: m.Queue, ID: m.ID, Priority: priority, HoldUntil: holdUntil}).(type) {
+	case *protocol.SuccessMessage:
+		m.Priority = priority
+		b.send(reply)
+	case *protocol.ErrorMessage:
+		if res.Reason == "not found" {
+			delete(b.reserved, m.ID)
+			b.s.beanstalk.release(m.ID, b)
+			b.send("NOT_FOUND")
+		} else {
+			b.send("INTERNAL_ERROR")
+		}
+	}
+}
+
+// beanstalkHoldUntil works out the hold_until for a delay in seconds. Jobs are
+// ready once hold_until has passed, so a job with no delay is held until the
+// second before now.
+func beanstalkHoldUntil(now time.Time, delay uint64) int64 {
+	return now.Unix() + int64(delay) - 1
+}
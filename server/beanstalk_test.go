@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type beanstalkClient struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dialBeanstalk(t *testing.T, addr string) *beanstalkClient {
+	c, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetDeadline(time.Now().Add(time.Second * 10))
+
+	return &beanstalkClient{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+// do sends a command and returns the first line of the response, without the
+// trailing CRLF.
+func (b *beanstalkClient) do(cmd string) string {
+	if _, err := fmt.Fprintf(b.c, "%s\r\n", cmd); err != nil {
+		b.t.Fatal(err)
+	}
+
+	return b.line()
+}
+
+func (b *beanstalkClient) line() string {
+	l, err := b.r.ReadString('\n')
+	if err != nil {
+		b.t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(l, "\r\n") {
+		b.t.Fatalf("response %q doesn't end with CRLF", l)
+	}
+
+	return strings.TrimSuffix(l, "\r\n")
+}
+
+// expect sends a command and fails the test unless the first line of the
+// response starts with want.
+func (b *beanstalkClient) expect(cmd, want string) string {
+	res := b.do(cmd)
+	if !strings.HasPrefix(res, want) {
+		b.t.Fatalf("%q got %q, want %q", cmd, res, want)
+	}
+
+	return res
+}
+
+// body reads a response body of n bytes and its trailing CRLF.
+func (b *beanstalkClient) body(n int) string {
+	d := make([]byte, n+2)
+	if _, err := io.ReadFull(b.r, d); err != nil {
+		b.t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(string(d), "\r\n") {
+		b.t.Fatalf("body %q doesn't end with CRLF", d)
+	}
+
+	return string(d[:n])
+}
+
+// stats gets a tube's stats and returns the value of one of them.
+func (b *beanstalkClient) stats(tube, name string) string {
+	var n int
+	fmt.Sscanf(b.expect("stats-tube "+tube, "OK "), "OK %d", &n)
+
+	for _, l := range strings.Split(b.body(n), "\n") {
+		if strings.HasPrefix(l, name+": ") {
+			return strings.TrimPrefix(l, name+": ")
+		}
+	}
+
+	b.t.Fatalf("no %s in stats for tube %s", name, tube)
+	return ""
+}
+
+func TestBeanstalk(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddBeanstalkListener(ln)
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	a := dialBeanstalk(t, ln.Addr().String())
+	defer a.c.Close()
+	b := dialBeanstalk(t, ln.Addr().String())
+	defer b.c.Close()
+
+	a.expect("", "UNKNOWN_COMMAND")
+	a.expect("frobnicate", "UNKNOWN_COMMAND")
+	a.expect("use", "BAD_FORMAT")
+	a.expect("put 1 0", "BAD_FORMAT")
+	a.expect("put x 0 60 5\r\nhello", "BAD_FORMAT")
+	a.expect("put 1 0 60 5\r\nhelloXX", "EXPECTED_CRLF")
+	// and the CRLF after the data is read as an empty command
+	if l := a.line(); l != "UNKNOWN_COMMAND" {
+		t.Fatalf("got %q after the bad data, want %q", l, "UNKNOWN_COMMAND")
+	}
+
+	a.expect("use emails", "USING emails")
+	var id string
+	fmt.Sscanf(a.expect("put 1 0 60 5\r\nhello", "INSERTED "), "INSERTED %s", &id)
+
+	a.expect("stats-tube nothing", "NOT_FOUND")
+	if n := a.stats("emails", "current-jobs-ready"); n != "1" {
+		t.Fatalf("tube has %s ready jobs, want 1", n)
+	}
+	if n := a.stats("emails", "current-using"); n != "1" {
+		t.Fatalf("tube has %s users, want 1", n)
+	}
+	if n := b.stats("emails", "current-using"); n != "0" {
+		t.Fatalf("tube has %s users according to another connection, want 0", n)
+	}
+
+	b.expect("watch emails", "WATCHING 2")
+	b.expect("ignore default", "WATCHING 1")
+	b.expect("ignore emails", "NOT_IGNORED")
+
+	if res := b.expect("reserve-with-timeout 1", "RESERVED "); res != fmt.Sprintf("RESERVED %s 5", id) {
+		t.Fatalf("reserved %q, want job %s", res, id)
+	}
+	if d := b.body(5); d != "hello" {
+		t.Fatalf("reserved job has content %q", d)
+	}
+
+	b.expect("reserve-with-timeout 0", "TIMED_OUT")
+
+	// the job is b's now, so a can't delete or release it
+	a.expect("delete "+id, "NOT_FOUND")
+	a.expect("release "+id+" 1 0", "NOT_FOUND")
+
+	b.expect("touch "+id, "TOUCHED")
+	b.expect("delete "+id, "DELETED")
+	b.expect("delete "+id, "NOT_FOUND")
+
+	// jobs that nobody has reserved can be deleted by anyone, like a
+	// producer cancelling jobs it queued
+	var ready, delayed string
+	fmt.Sscanf(a.expect("put 1 0 60 5\r\nready", "INSERTED "), "INSERTED %s", &ready)
+	fmt.Sscanf(a.expect("put 1 3600 60 7\r\ndelayed", "INSERTED "), "INSERTED %s", &delayed)
+
+	a.expect("delete "+ready, "DELETED")
+	b.expect("delete "+delayed, "DELETED")
+	a.expect("delete "+delayed, "NOT_FOUND")
+
+	if n := a.stats("emails", "total-jobs"); n != "0" {
+		t.Fatalf("tube has %s jobs after deleting them all, want 0", n)
+	}
+}
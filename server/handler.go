@@ -0,0 +1,521 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"github.com/Sirupsen/logrus"
+)
+
+// dispatch parses and handles a single message from any transport, and sends
+// the response with send. Responses bigger than limit are replaced with an
+// error, since they wouldn't make it to the client.
+//
+// identity is who the transport knows the client to be, if anyone. Otherwise
+// a client that seals its messages is identified by the ID of its key.
+//
+// Repeated requests are told apart by conn, which numbers each stream
+// connection, or by remote for datagrams, which is nil for a datagram from an
+// unbound unix socket. Those clients are anonymous, so their requests aren't
+// replayed, and send is nil if there's no way to get a response back to them.
+func (s *Server) dispatch(d []byte, remote net.Addr, conn uint64, identity string, limit int, send func(d []byte) error) {
+	before := time.Now()
+
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+
+	l := s.log.WithField("seq", atomic.AddInt64(&s.seq, 1))
+
+	// a panic only fails the message that caused it, not the whole server
+	defer func() {
+		if e := recover(); e != nil {
+			l.WithField("error", panicError(e).Error()).Error("error processing message")
+		}
+	}()
+
+	from, replay := "-", s.replay
+	if remote != nil {
+		from = remote.String()
+	}
+
+	// every client on a unix socket has the same empty address, so it's
+	// only good for telling clients apart if they don't have a connection
+	scope := from
+	if conn != 0 {
+		scope = "#" + strconv.FormatUint(conn, 10)
+	} else if remote == nil {
+		replay = nil
+	}
+
+	l.WithFields(logrus.Fields{
+		"size":   len(d),
+		"remote": from,
+	}).Debug("got message")
+
+	// a request that can't be answered would only have its effects, like a
+	// reserved job that nobody knows about
+	if send == nil {
+		l.WithField("remote", from).Warn("dropping message with nowhere to send a response")
+		return
+	}
+
+	keyID := ""
+	if s.auth != nil {
+		sm, err := s.auth.open(d, before)
+		if err != nil {
+			l.WithFields(logrus.Fields{
+				"remote": from,
+				"error":  err.Error(),
+			}).Warn("dropping message that failed authentication")
+			return
+		}
+
+		keyID, d = sm.KeyID, sm.Message
+	}
+
+	if identity == "" {
+		identity = keyID
+	}
+
+	reply := func(m protocol.Message) error {
+		d, err := s.encode(m, keyID)
+		if err != nil {
+			return err
+		}
+
+		if len(d) > limit {
+			if d, err = s.encode(&protocol.ErrorMessage{Key: m.GetKey(), Reason: "too large"}, keyID); err != nil {
+				return err
+			}
+		}
+
+		return send(d)
+	}
+
+	m, err := protocol.Parse(bytes.TrimSpace(d))
+	if err != nil {
+		l.WithField("error", err.Error()).Error("error parsing message")
+		return
+	}
+
+	l = l.WithField("message_key", m.GetKey())
+
+	id := scope + " " + keyID + " " + m.GetKey()
+	if m.GetKey() == "" {
+		replay = nil
+	}
+	if replay != nil {
+		if res, ok, err := replay.start(id, before); err != nil {
+			l.WithField("error", err.Error()).Warn("turning away message")
+
+			if err := reply(&protocol.ErrorMessage{Key: m.GetKey(), Reason: "busy"}); err != nil {
+				l.WithField("error", err.Error()).Error("error sending response")
+			}
+
+			return
+		} else if !ok {
+			if res == nil {
+				l.Debug("ignoring repeated message that's still being processed")
+				return
+			}
+
+			l.Debug("replaying response to repeated message")
+
+			if err := reply(res); err != nil {
+				l.WithField("error", err.Error()).Error("error sending response")
+			}
+
+			return
+		}
+	}
+
+	l.WithField("message_type", fmt.Sprintf("%T", m)).Debug("processing message")
+
+	respond := func() {
+		defer func() {
+			if e := recover(); e != nil {
+				if replay != nil {
+					replay.forget(id)
+				}
+
+				l.WithField("error", panicError(e).Error()).Error("error processing message")
+			}
+		}()
+
+		res, err := s.handle(m, identity, l)
+
+		l := l.WithField("measure#duration", time.Now().Sub(before).Seconds()*1000)
+
+		if err != nil {
+			if replay != nil {
+				replay.forget(id)
+			}
+
+			l.WithField("error", err.Error()).Error("error processing message")
+			return
+		}
+
+		// a reserved job that's too large to send back would be held for
+		// its TTR with nobody working on it, so it's given back straight
+		// away, as it was before it was reserved
+		if j, ok := res.(*protocol.JobMessage); ok {
+			if _, ok := m.(*protocol.ReserveMessage); ok {
+				if d, err := s.encode(j, keyID); err == nil && len(d) > limit {
+					if err := s.store.Reschedule(j.Queue, j.ID, j.Priority, j.HoldUntil); err != nil {
+						l.WithFields(logrus.Fields{
+							"job_id": j.ID,
+							"error":  err.Error(),
+						}).Error("error releasing job that's too large to send")
+					}
+
+					res = &protocol.ErrorMessage{Key: j.Key, Reason: "too large"}
+				}
+			}
+		}
+
+		if replay != nil {
+			replay.finish(id, res)
+		}
+
+		if res != nil {
+			if err := reply(res); err != nil {
+				l.WithField("error", err.Error()).Error("error sending response")
+				return
+			}
+		}
+
+		l.Debug("processed message successfully")
+	}
+
+	// backups take a while, and the server has to keep serving meanwhile
+	if _, ok := m.(*protocol.BackupMessage); ok {
+		atomic.AddInt64(&s.active, 1)
+		go func() {
+			defer atomic.AddInt64(&s.active, -1)
+			respond()
+		}()
+	} else {
+		respond()
+	}
+}
+
+// panicError turns the value that something panicked with into an error.
+func panicError(e interface{}) error {
+	if err, ok := e.(error); ok {
+		return err
+	}
+
+	return fmt.Errorf("%v", e)
+}
+
+// encode serialises a response, sealing it with the same key as the request if
+// messages are authenticated.
+func (s *Server) encode(m protocol.Message, keyID string) ([]byte, error) {
+	d := protocol.Serialise(m)
+
+	if s.auth == nil {
+		return d, nil
+	}
+
+	return protocol.Seal(s.auth.keys, keyID, d, time.Now())
+}
+
+// jobMessage builds the response for a job. By the time a job gets here, the
+// store should have undone every encoding applied to its content.
+func jobMessage(key string, j *store.Job) (*protocol.JobMessage, error) {
+	if j.Encoding != "" {
+		return nil, fmt.Errorf("can't decode content of job %s with encoding %q", j.ID, j.Encoding)
+	}
+
+	return &protocol.JobMessage{
+		Key:         key,
+		ID:          j.ID,
+		Queue:       j.Queue,
+		Priority:    j.Priority,
+		HoldUntil:   j.HoldUntil,
+		TTR:         j.TTR,
+		ContentType: j.ContentType,
+		Content:     string(j.Content),
+	}, nil
+}
+
+// handle runs a request from the client with the given identity against the
+// store and returns the response to send back. Messages that aren't requests
+// get a nil response. An error means that the request couldn't be processed at
+// all, and nothing should be sent.
+func (s *Server) handle(m protocol.Message, identity string, l *logrus.Entry) (protocol.Message, error) {
+	before := time.Now()
+
+	if op, queue := operation(m); op != "" && s.policy != nil && !s.policy.allows(identity, op, queue) {
+		l.WithFields(logrus.Fields{
+			"identity":  identity,
+			"operation": op,
+			"queue":     queue,
+		}).Warn("denied request")
+
+		return &protocol.ErrorMessage{Key: m.GetKey(), Reason: "denied"}, nil
+	}
+
+	switch m := m.(type) {
+	case *protocol.PingMessage:
+		return m, nil
+	case *protocol.HelloMessage:
+		l.WithFields(logrus.Fields{
+			"client_version": m.Version,
+			"client_types":   m.Types,
+		}).Debug("got hello")
+
+		res := protocol.HelloMessage{
+			Key:            m.Key,
+			Version:        protocol.Version,
+			Types:          strings.Join(protocol.DefaultParser.Types(), ","),
+			MaxMessageSize: protocol.MessageSize,
+			MaxFrameSize:   protocol.MaxFrameSize,
+		}
+
+		if s.replay != nil {
+			res.ReplayTTL = int(s.replay.ttl / time.Second)
+		}
+
+		return &res, nil
+	case *protocol.JobMessage:
+		if !store.ValidConflict(m.Conflict) {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "invalid conflict policy"}, nil
+		}
+
+		if m.HoldUntil == 0 {
+			m.HoldUntil = s.now().Unix()
+		}
+		if m.TTR == 0 {
+			m.TTR = uint64(time.Hour / time.Second)
+		}
+
+		// a put can change a job that's already in another queue, or move it
+		// out of there, so the client has to be allowed to put to that queue
+		// too. puts are checked and made one at a time, so that the job can't
+		// be moved in between.
+		if s.policy != nil {
+			s.putM.Lock()
+			defer s.putM.Unlock()
+
+			if queue, err := s.store.Queue(m.ID); err == nil && queue != m.Queue && !s.policy.allows(identity, opPut, queue) {
+				l.WithFields(logrus.Fields{
+					"identity":  identity,
+					"operation": opPut,
+					"queue":     queue,
+					"job_id":    m.ID,
+				}).Warn("denied request")
+
+				return &protocol.ErrorMessage{Key: m.Key, Reason: "denied"}, nil
+			} else if err != nil && err != store.ErrNotFound {
+				return nil, err
+			}
+		}
+
+		result, err := s.store.Put(&store.Job{
+			ID:          m.ID,
+			Queue:       m.Queue,
+			Priority:    m.Priority,
+			HoldUntil:   m.HoldUntil,
+			TTR:         m.TTR,
+			ContentType: m.ContentType,
+			Content:     []byte(m.Content),
+		}, m.Conflict)
+		if err == store.ErrExists {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "exists"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		l.WithFields(logrus.Fields{
+			"queue":               m.Queue,
+			"job_id":              m.ID,
+			"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
+		}).Info(result + " job")
+
+		return &protocol.SuccessMessage{Key: m.Key}, nil
+	case *protocol.ReserveMessage:
+		j, err := s.store.Reserve(m.Queue, s.now())
+		if err == store.ErrEmpty {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "empty"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		l.WithFields(logrus.Fields{
+			"queue":               m.Queue,
+			"job_id":              j.ID,
+			"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
+		}).Info("dispatched job")
+
+		return jobMessage(m.Key, j)
+	case *protocol.PeekMessage:
+		j, err := s.store.Peek(m.Queue, s.now())
+		if err == store.ErrEmpty {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "empty"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return jobMessage(m.Key, j)
+	case *protocol.ScanMessage:
+		if !store.ValidState(m.State) {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "invalid state"}, nil
+		}
+
+		j, err := s.store.Scan(m.Queue, m.State, m.After, s.now())
+		if err == store.ErrEmpty {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "empty"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return jobMessage(m.Key, j)
+	case *protocol.StatsMessage:
+		st, err := s.store.Stats(m.Queue, m.After, s.now())
+		if err == store.ErrEmpty {
+			// a named queue with no jobs in it is still a queue
+			if m.Queue != "" && m.After < m.Queue {
+				return &protocol.QueueStatsMessage{Key: m.Key, Queue: m.Queue}, nil
+			}
+
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "empty"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &protocol.QueueStatsMessage{
+			Key:   m.Key,
+			Queue: st.Queue,
+			Ready: st.Ready,
+			Held:  st.Held,
+		}, nil
+	case *protocol.DeleteMessage:
+		if err := s.store.Delete(m.Queue, m.ID); err == store.ErrNotFound {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "not found"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		l.WithFields(logrus.Fields{
+			"queue":               m.Queue,
+			"job_id":              m.ID,
+			"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
+		}).Info("deleted job")
+
+		return &protocol.SuccessMessage{Key: m.Key}, nil
+	case *protocol.ReleaseMessage:
+		if err := s.store.Reschedule(m.Queue, m.ID, m.Priority, m.HoldUntil); err == store.ErrNotFound {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "not found"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		l.WithFields(logrus.Fields{
+			"queue":               m.Queue,
+			"job_id":              m.ID,
+			"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
+		}).Info("released job")
+
+		return &protocol.SuccessMessage{Key: m.Key}, nil
+	case *protocol.PurgeMessage:
+		// an empty queue would mean every queue to Scan
+		if m.Queue == "" {
+			return &protocol.ErrorMessage{Key: m.Key, Reason: "invalid queue"}, nil
+		}
+
+		n := 0
+		for after := ""; ; {
+			j, err := s.store.Scan(m.Queue, "", after, s.now())
+			if err == store.ErrEmpty {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			if err := s.store.Delete(m.Queue, j.ID); err != nil && err != store.ErrNotFound {
+				return nil, err
+			}
+
+			n++
+			after = j.ID
+		}
+
+		l.WithFields(logrus.Fields{
+			"queue":               m.Queue,
+			"jobs":                n,
+			"measure#duration_ms": time.Now().Sub(before).Seconds() * 1000,
+		}).Info("purged queue")
+
+		return &protocol.SuccessMessage{Key: m.Key}, nil
+	case *protocol.BackupMessage:
+		l := l.WithField("path", m.Path)
+
+		path, err := s.backupPath(m.Path)
+		if err != nil {
+			l.WithField("error", err.Error()).Warn("refused backup")
+			return &protocol.ErrorMessage{Key: m.Key, Reason: err.Error()}, nil
+		}
+
+		if err := s.store.Backup(path); err != nil {
+			l.WithField("error", err.Error()).Error("backup failed")
+			return &protocol.ErrorMessage{Key: m.Key, Reason: err.Error()}, nil
+		}
+
+		l.WithField("measure#duration_ms", time.Now().Sub(before).Seconds()*1000).Info("backed up database")
+
+		return &protocol.SuccessMessage{Key: m.Key}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// backupPath works out where a backup that a client asked for goes, which is
+// always somewhere in the backup directory. Symlinks in there could point
+// anywhere, so the directory the backup goes in is resolved and has to still
+// be in the backup directory, and the backup can't replace a symlink.
+func (s *Server) backupPath(p string) (string, error) {
+	if s.backupDir == "" {
+		return "", ErrBackupsDisabled
+	}
+
+	if p == "" || filepath.IsAbs(p) {
+		return "", ErrBadBackupPath
+	}
+	for _, e := range strings.Split(filepath.ToSlash(p), "/") {
+		if e == ".." {
+			return "", ErrBadBackupPath
+		}
+	}
+
+	root, err := filepath.EvalSymlinks(s.backupDir)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(root, p)
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrBadBackupPath
+	}
+
+	path = filepath.Join(dir, filepath.Base(path))
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", ErrBadBackupPath
+	}
+
+	return path, nil
+}
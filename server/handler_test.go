@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"fknsrs.biz/p/jobserver/internal/store/logstore"
+	"github.com/Sirupsen/logrus"
+)
+
+// newTestServer makes a server with a log store in a temporary directory, and
+// returns it along with a function that cleans up after it.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := logstore.Open(filepath.Join(dir, "jobs"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.Out = ioutil.Discard
+
+	s := New(st)
+	s.SetLogger(l)
+
+	return s, func() {
+		st.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHandlePutPolicy(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	p, err := parsePolicy(strings.NewReader("team-a put a.*\nteam-b put b.*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.policy = p
+
+	put := func(identity, queue, content, conflict string) string {
+		res, err := s.handle(&protocol.JobMessage{
+			Key:      "k",
+			ID:       "job",
+			Queue:    queue,
+			Content:  content,
+			Conflict: conflict,
+		}, identity, s.log.WithField("test", t.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch res := res.(type) {
+		case *protocol.SuccessMessage:
+			return "ok"
+		case *protocol.ErrorMessage:
+			return res.Reason
+		default:
+			t.Fatalf("unexpected response %#v", res)
+			return ""
+		}
+	}
+
+	if r := put("team-b", "b.jobs", "b", ""); r != "ok" {
+		t.Fatalf("team-b putting to its own queue got %q", r)
+	}
+	if r := put("team-a", "b.jobs", "a", ""); r != "denied" {
+		t.Fatalf("team-a putting to team-b's queue got %q", r)
+	}
+
+	for _, conflict := range []string{store.ConflictReplace, store.ConflictUpdate, store.ConflictSkip} {
+		if r := put("team-a", "a.jobs", "a", conflict); r != "denied" {
+			t.Errorf("team-a putting team-b's job with conflict %q got %q", conflict, r)
+		}
+	}
+
+	j, err := s.store.Scan("", "", "", s.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Queue != "b.jobs" || string(j.Content) != "b" {
+		t.Fatalf("team-b's job was changed to %q in queue %q", j.Content, j.Queue)
+	}
+
+	if r := put("team-b", "b.other", "moved", store.ConflictReplace); r != "ok" {
+		t.Fatalf("team-b moving its own job got %q", r)
+	}
+	if r := put("team-b", "a.jobs", "moved", store.ConflictReplace); r != "denied" {
+		t.Fatalf("team-b moving its job to team-a's queue got %q", r)
+	}
+}
+
+func TestHandleBackup(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	backup := func(path string) string {
+		res, err := s.handle(&protocol.BackupMessage{Key: "k", Path: path}, "", s.log.WithField("test", t.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch res := res.(type) {
+		case *protocol.SuccessMessage:
+			return "ok"
+		case *protocol.ErrorMessage:
+			return res.Reason
+		default:
+			t.Fatalf("unexpected response %#v", res)
+			return ""
+		}
+	}
+
+	if r := backup("snapshot"); r != ErrBackupsDisabled.Error() {
+		t.Fatalf("backup without a backup directory got %q", r)
+	}
+
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s.SetBackupDir(dir)
+
+	for _, p := range []string{"", "/tmp/snapshot", "../snapshot", "a/../../snapshot", "a/.."} {
+		if r := backup(p); r != ErrBadBackupPath.Error() {
+			t.Errorf("backup to %q got %q", p, r)
+		}
+	}
+
+	if r := backup("snapshot"); r != "ok" {
+		t.Fatalf("backup got %q", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+
+	// symlinks can't take backups out of the backup directory
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "file"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../sub", filepath.Join(dir, "sub", "in")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"out/snapshot", "link"} {
+		if r := backup(p); r != ErrBadBackupPath.Error() {
+			t.Errorf("backup to %q got %q", p, r)
+		}
+	}
+
+	files, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("backups were written outside the backup directory: %v", files)
+	}
+
+	// symlinks that stay inside are fine
+	if r := backup("sub/in/snapshot"); r != "ok" {
+		t.Fatalf("backup through a symlink inside the backup directory got %q", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	p, err := parsePolicy(strings.NewReader("team-a put,reserve,delete a.*\nops admin *\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.policy = p
+
+	handle := func(identity string, m protocol.Message) string {
+		res, err := s.handle(m, identity, s.log.WithField("test", t.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch res := res.(type) {
+		case *protocol.SuccessMessage:
+			return "ok"
+		case *protocol.ErrorMessage:
+			return res.Reason
+		default:
+			t.Fatalf("unexpected response %#v", res)
+			return ""
+		}
+	}
+
+	for _, j := range []struct{ id, queue string }{{"1", "a.jobs"}, {"2", "a.jobs"}, {"3", "a.other"}} {
+		if r := handle("team-a", &protocol.JobMessage{Key: "k", ID: j.id, Queue: j.queue, HoldUntil: 1}); r != "ok" {
+			t.Fatalf("put got %q", r)
+		}
+	}
+
+	// reserved jobs are purged too
+	if res, err := s.handle(&protocol.ReserveMessage{Key: "k", Queue: "a.jobs"}, "team-a", s.log.WithField("test", t.Name())); err != nil {
+		t.Fatal(err)
+	} else if _, ok := res.(*protocol.JobMessage); !ok {
+		t.Fatalf("reserve got %#v", res)
+	}
+
+	// deleting jobs from a queue isn't enough to purge it
+	if r := handle("team-a", &protocol.PurgeMessage{Key: "k", Queue: "a.jobs"}); r != "denied" {
+		t.Fatalf("team-a purging got %q", r)
+	}
+	if r := handle("ops", &protocol.PurgeMessage{Key: "k"}); r != "invalid queue" {
+		t.Fatalf("purging without a queue got %q", r)
+	}
+	if r := handle("ops", &protocol.PurgeMessage{Key: "k", Queue: "a.jobs"}); r != "ok" {
+		t.Fatalf("ops purging got %q", r)
+	}
+
+	for queue, want := range map[string][]string{"a.jobs": nil, "a.other": {"3"}} {
+		var got []string
+		for after := ""; ; {
+			j, err := s.store.Scan(queue, "", after, s.now())
+			if err == store.ErrEmpty {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, j.ID)
+			after = j.ID
+		}
+
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("queue %s has jobs %v after purging, want %v", queue, got, want)
+		}
+	}
+}
+
+// panicStore is a store that panics when a job is reserved.
+type panicStore struct {
+	Store
+}
+
+func (panicStore) Reserve(queue string, now time.Time) (*store.Job, error) {
+	panic("reserve broke")
+}
+
+func TestHandlePanic(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	s.store = panicStore{s.store}
+
+	sent := false
+	s.dispatch(protocol.Serialise(&protocol.ReserveMessage{Key: "k", Queue: "q"}), &net.UDPAddr{}, 0, "", protocol.MessageSize, func(d []byte) error {
+		sent = true
+		return nil
+	})
+	if sent {
+		t.Fatal("got a response to a request that panicked")
+	}
+
+	if _, ok, _ := s.replay.start((&net.UDPAddr{}).String()+"  k", time.Now()); !ok {
+		t.Fatal("request that panicked is still in the replay cache")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/queues/q/reserve", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("http request that panicked got status %d", w.Code)
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddBeanstalkListener(ln)
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	b := dialBeanstalk(t, ln.Addr().String())
+	defer b.c.Close()
+
+	b.expect("put 1 0 60 1\r\nx", "INSERTED")
+	b.expect("reserve-with-timeout 0", "INTERNAL_ERROR")
+	b.expect("use other", "USING other")
+}
+
+func TestHandleReserveTooLarge(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddListener(ln)
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddPacketConn(pc)
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	tc, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	tr := bufio.NewReader(tc)
+	tcp := func(m protocol.Message) protocol.Message {
+		if err := protocol.WriteFrame(tc, protocol.Serialise(m)); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := protocol.ReadFrame(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := protocol.Parse(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	// too large for a datagram, but fine over TCP
+	holdUntil := time.Now().Add(-time.Minute).Unix()
+	content := strings.Repeat("x", protocol.MessageSize*2)
+	res := tcp(&protocol.JobMessage{Key: "put", ID: "big", Queue: "q", Priority: 3, HoldUntil: holdUntil, Content: content})
+	if _, ok := res.(*protocol.SuccessMessage); !ok {
+		t.Fatalf("put got %#v", res)
+	}
+
+	uc, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	if _, err := uc.Write(protocol.Serialise(&protocol.ReserveMessage{Key: "reserve", Queue: "q"})); err != nil {
+		t.Fatal(err)
+	}
+
+	uc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	b := make([]byte, protocol.MessageSize)
+	n, err := uc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = protocol.Parse(b[0:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := res.(*protocol.ErrorMessage); !ok || e.Reason != "too large" {
+		t.Fatalf("reserve over udp got %#v", res)
+	}
+
+	// the job wasn't left reserved, and it's as it was before
+	res = tcp(&protocol.ReserveMessage{Key: "again", Queue: "q"})
+	j, ok := res.(*protocol.JobMessage)
+	if !ok {
+		t.Fatalf("reserve over tcp got %#v", res)
+	}
+	if j.ID != "big" || j.Priority != 3 || j.HoldUntil != holdUntil || j.Content != content {
+		t.Fatalf("reserve over tcp got job %s with priority %v and hold_until %d", j.ID, j.Priority, j.HoldUntil)
+	}
+}
@@ -0,0 +1,207 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"github.com/Sirupsen/logrus"
+)
+
+// httpJob is how jobs look in the HTTP API. HoldUntil is a unix timestamp and
+// TTR is in seconds, the same as on the wire. Content is encoded the same way
+// as it is on the wire, so content that isn't UTF-8, which can't go in a JSON
+// string, is base64 encoded, and content_encoding says so.
+type httpJob struct {
+	ID              string  `json:"id"`
+	Queue           string  `json:"queue"`
+	Priority        float64 `json:"priority"`
+	HoldUntil       int64   `json:"hold_until"`
+	TTR             uint64  `json:"ttr"`
+	ContentType     string  `json:"content_type,omitempty"`
+	ContentEncoding string  `json:"content_encoding,omitempty"`
+	Content         string  `json:"content"`
+}
+
+type httpQueueStats struct {
+	Queue string `json:"queue"`
+	Ready uint64 `json:"ready"`
+	Held  uint64 `json:"held"`
+}
+
+// httpStatus maps the reasons in error messages to status codes.
+var httpStatus = map[string]int{
+	"empty":                   http.StatusNotFound,
+	"not found":               http.StatusNotFound,
+	"exists":                  http.StatusConflict,
+	"denied":                  http.StatusForbidden,
+	"invalid conflict policy": http.StatusBadRequest,
+	"invalid state":           http.StatusBadRequest,
+}
+
+// ServeHTTP turns requests into the same messages that come in over UDP and
+// TCP, so that they go through the same handler. The API looks like this:
+//
+//	PUT    /queues/{queue}/jobs/{id}[?conflict=...]  put a job
+//	DELETE /queues/{queue}/jobs/{id}                 delete a job
+//	POST   /queues/{queue}/reserve                   reserve a job
+//	GET    /queues/{queue}/peek                      peek at a job
+//	GET    /queues/{queue}/stats                     count a queue's jobs
+//	GET    /stats                                    count every queue's jobs
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := s.log.WithFields(logrus.Fields{
+		"seq":    atomic.AddInt64(&s.seq, 1),
+		"remote": r.RemoteAddr,
+	})
+
+	defer func() {
+		if e := recover(); e != nil {
+			l.WithField("error", panicError(e).Error()).Error("error processing message")
+			writeHTTPError(w, http.StatusInternalServerError, "internal error")
+		}
+	}()
+
+	l.WithFields(logrus.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Debug("got http request")
+
+	var bits []string
+	for _, b := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		u, err := url.PathUnescape(b)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "invalid path")
+			return
+		}
+		bits = append(bits, u)
+	}
+
+	var route string
+	switch {
+	case len(bits) == 1 && bits[0] == "stats":
+		route = "stats"
+	case len(bits) == 3 && bits[0] == "queues" && bits[2] != "jobs":
+		route = bits[2]
+	case len(bits) == 4 && bits[0] == "queues" && bits[2] == "jobs":
+		route = "jobs"
+	default:
+		writeHTTPError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method + " " + route {
+	case "PUT jobs":
+		var j httpJob
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(protocol.MaxFrameSize))).Decode(&j); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "invalid job: "+err.Error())
+			return
+		}
+
+		content, err := protocol.DecodeContent(j.ContentEncoding, j.Content)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "invalid content: "+err.Error())
+			return
+		}
+
+		s.serveHTTPMessage(w, l, &protocol.JobMessage{
+			ID:          bits[3],
+			Queue:       bits[1],
+			Priority:    j.Priority,
+			HoldUntil:   j.HoldUntil,
+			TTR:         j.TTR,
+			Conflict:    r.URL.Query().Get("conflict"),
+			ContentType: j.ContentType,
+			Content:     content,
+		})
+	case "DELETE jobs":
+		s.serveHTTPMessage(w, l, &protocol.DeleteMessage{Queue: bits[1], ID: bits[3]})
+	case "POST reserve":
+		s.serveHTTPMessage(w, l, &protocol.ReserveMessage{Queue: bits[1]})
+	case "GET peek":
+		s.serveHTTPMessage(w, l, &protocol.PeekMessage{Queue: bits[1]})
+	case "GET stats":
+		if len(bits) == 3 {
+			s.serveHTTPMessage(w, l, &protocol.StatsMessage{Queue: bits[1]})
+			return
+		}
+
+		queues := []httpQueueStats{}
+		for after := ""; ; {
+			res, err := s.handle(&protocol.StatsMessage{After: after}, "", l)
+			if err != nil {
+				l.WithField("error", err.Error()).Error("error processing message")
+				writeHTTPError(w, http.StatusInternalServerError, "internal error")
+				return
+			}
+
+			if res, ok := res.(*protocol.ErrorMessage); ok && res.Reason == "denied" {
+				writeHTTPError(w, http.StatusForbidden, res.Reason)
+				return
+			}
+
+			m, ok := res.(*protocol.QueueStatsMessage)
+			if !ok {
+				break
+			}
+
+			queues = append(queues, httpQueueStats{Queue: m.Queue, Ready: m.Ready, Held: m.Held})
+			after = m.Queue
+		}
+
+		writeHTTPJSON(w, http.StatusOK, map[string]interface{}{"queues": queues})
+	default:
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveHTTPMessage(w http.ResponseWriter, l *logrus.Entry, m protocol.Message) {
+	res, err := s.handle(m, "", l)
+	if err != nil {
+		l.WithField("error", err.Error()).Error("error processing message")
+		writeHTTPError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	switch res := res.(type) {
+	case *protocol.SuccessMessage:
+		w.WriteHeader(http.StatusNoContent)
+	case *protocol.JobMessage:
+		j := httpJob{
+			ID:          res.ID,
+			Queue:       res.Queue,
+			Priority:    res.Priority,
+			HoldUntil:   res.HoldUntil,
+			TTR:         res.TTR,
+			ContentType: res.ContentType,
+		}
+
+		j.ContentEncoding, j.Content = protocol.EncodeContent(res.Content)
+
+		writeHTTPJSON(w, http.StatusOK, j)
+	case *protocol.QueueStatsMessage:
+		writeHTTPJSON(w, http.StatusOK, httpQueueStats{Queue: res.Queue, Ready: res.Ready, Held: res.Held})
+	case *protocol.ErrorMessage:
+		code, ok := httpStatus[res.Reason]
+		if !ok {
+			code = http.StatusInternalServerError
+		}
+
+		writeHTTPError(w, code, res.Reason)
+	default:
+		writeHTTPError(w, http.StatusInternalServerError, "unexpected response")
+	}
+}
+
+func writeHTTPJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, code int, reason string) {
+	writeHTTPJSON(w, code, map[string]string{"error": reason})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+// httpClient sends requests to an HTTP test server, and decodes the JSON that
+// comes back.
+type httpClient struct {
+	t   *testing.T
+	url string
+}
+
+func (c httpClient) do(method, path, body string, v interface{}) int {
+	c.t.Helper()
+
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if v != nil && res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			c.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+
+	return res.StatusCode
+}
+
+// expect sends a request and fails the test unless it gets the given status
+// and, for errors, reason.
+func (c httpClient) expect(method, path, body string, code int, reason string) {
+	c.t.Helper()
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	if got := c.do(method, path, body, &e); got != code || e.Error != reason {
+		c.t.Errorf("%s %s got %d %q, want %d %q", method, path, got, e.Error, code, reason)
+	}
+}
+
+func newHTTPTest(t *testing.T) (*Server, httpClient, func()) {
+	s, done := newTestServer(t)
+	hs := httptest.NewServer(s)
+
+	return s, httpClient{t: t, url: hs.URL}, func() {
+		hs.Close()
+		done()
+	}
+}
+
+func TestHTTPRoutes(t *testing.T) {
+	_, c, done := newHTTPTest(t)
+	defer done()
+
+	past := time.Now().Add(-time.Minute).Unix()
+	job := func(content string) string {
+		d, _ := json.Marshal(httpJob{Priority: 2, HoldUntil: past, TTR: 30, ContentType: "text/plain", Content: content})
+		return string(d)
+	}
+
+	c.expect("PUT", "/queues/q/jobs/a", job("first"), http.StatusNoContent, "")
+	c.expect("PUT", "/queues/q/jobs/b", job("second"), http.StatusNoContent, "")
+
+	var j httpJob
+	if code := c.do("GET", "/queues/q/peek", "", &j); code != http.StatusOK {
+		t.Fatalf("peek got %d", code)
+	}
+	if j.ID != "a" || j.Queue != "q" || j.Priority != 2 || j.HoldUntil != past || j.TTR != 30 || j.ContentType != "text/plain" || j.Content != "first" {
+		t.Fatalf("peek got %#v", j)
+	}
+
+	var st httpQueueStats
+	if code := c.do("GET", "/queues/q/stats", "", &st); code != http.StatusOK {
+		t.Fatalf("queue stats got %d", code)
+	}
+	if st != (httpQueueStats{Queue: "q", Ready: 2}) {
+		t.Fatalf("queue stats got %#v", st)
+	}
+
+	j = httpJob{}
+	if code := c.do("POST", "/queues/q/reserve", "", &j); code != http.StatusOK {
+		t.Fatalf("reserve got %d", code)
+	}
+	if j.ID != "a" {
+		t.Fatalf("reserved %#v, want job a", j)
+	}
+
+	c.expect("PUT", "/queues/other/jobs/c", job("third"), http.StatusNoContent, "")
+
+	var all struct {
+		Queues []httpQueueStats `json:"queues"`
+	}
+	if code := c.do("GET", "/stats", "", &all); code != http.StatusOK {
+		t.Fatalf("stats got %d", code)
+	}
+	want := []httpQueueStats{{Queue: "other", Ready: 1}, {Queue: "q", Ready: 1, Held: 1}}
+	if len(all.Queues) != len(want) || all.Queues[0] != want[0] || all.Queues[1] != want[1] {
+		t.Fatalf("stats got %#v, want %#v", all.Queues, want)
+	}
+
+	c.expect("DELETE", "/queues/q/jobs/a", "", http.StatusNoContent, "")
+	c.expect("DELETE", "/queues/q/jobs/b", "", http.StatusNoContent, "")
+
+	// escaped paths are unescaped, so IDs can have slashes in them
+	c.expect("PUT", "/queues/q/jobs/x%2Fy", job("escaped"), http.StatusNoContent, "")
+	j = httpJob{}
+	if code := c.do("GET", "/queues/q/peek", "", &j); code != http.StatusOK || j.ID != "x/y" {
+		t.Fatalf("peek got %d %#v, want job x/y", code, j)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	s, c, done := newHTTPTest(t)
+	defer done()
+
+	c.expect("POST", "/queues/q/reserve", "", http.StatusNotFound, "empty")
+	c.expect("GET", "/queues/q/peek", "", http.StatusNotFound, "empty")
+	c.expect("DELETE", "/queues/q/jobs/missing", "", http.StatusNotFound, "not found")
+
+	c.expect("PUT", "/queues/q/jobs/a", `{"content":"x"}`, http.StatusNoContent, "")
+	c.expect("PUT", "/queues/q/jobs/a?conflict=fail", `{"content":"x"}`, http.StatusConflict, "exists")
+	c.expect("PUT", "/queues/q/jobs/a?conflict=replace", `{"content":"y"}`, http.StatusNoContent, "")
+	c.expect("PUT", "/queues/q/jobs/a?conflict=bogus", `{"content":"z"}`, http.StatusBadRequest, "invalid conflict policy")
+
+	c.expect("PUT", "/queues/q/jobs/b", `{`, http.StatusBadRequest, "invalid job: unexpected EOF")
+	c.expect("PUT", "/queues/q/jobs/b", `{"content_encoding":"base64","content":"!"}`, http.StatusBadRequest, "invalid content: illegal base64 data at input byte 0")
+	c.expect("PUT", "/queues/q/jobs/b", `{"content_encoding":"rot13","content":"x"}`, http.StatusBadRequest, `invalid content: unknown content encoding "rot13"`)
+
+	c.expect("GET", "/queues/q/jobs/a", "", http.StatusMethodNotAllowed, "method not allowed")
+	c.expect("PUT", "/queues/q/reserve", "", http.StatusMethodNotAllowed, "method not allowed")
+	c.expect("POST", "/stats", "", http.StatusMethodNotAllowed, "method not allowed")
+	c.expect("GET", "/", "", http.StatusNotFound, "not found")
+	c.expect("GET", "/queues/q", "", http.StatusNotFound, "not found")
+	c.expect("GET", "/queues/q/jobs", "", http.StatusNotFound, "not found")
+	c.expect("GET", "/queues/q/jobs/a/b", "", http.StatusNotFound, "not found")
+
+	// no route sends a scan, but the reason it can fail with still maps to a
+	// status
+	w := httptest.NewRecorder()
+	s.serveHTTPMessage(w, s.log.WithField("test", t.Name()), &protocol.ScanMessage{State: "bogus"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid state") {
+		t.Fatalf("invalid state got %d %s", w.Code, w.Body.String())
+	}
+
+	// clients that come in over HTTP have no identity
+	p, err := parsePolicy(strings.NewReader("- put,reserve public.*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.policy = p
+
+	c.expect("PUT", "/queues/public.q/jobs/p", `{"content":"x"}`, http.StatusNoContent, "")
+	c.expect("PUT", "/queues/q/jobs/b", `{"content":"x"}`, http.StatusForbidden, "denied")
+	c.expect("DELETE", "/queues/public.q/jobs/p", "", http.StatusForbidden, "denied")
+	c.expect("GET", "/queues/q/stats", "", http.StatusForbidden, "denied")
+	c.expect("GET", "/stats", "", http.StatusForbidden, "denied")
+}
+
+func TestHTTPContentEncoding(t *testing.T) {
+	s, c, done := newHTTPTest(t)
+	defer done()
+
+	content := "\xff\xfe binary \x00"
+	encoded := `{"hold_until":1,"content_encoding":"base64","content":"//4gYmluYXJ5IAA="}`
+
+	c.expect("PUT", "/queues/q/jobs/bin", encoded, http.StatusNoContent, "")
+	c.expect("PUT", "/queues/q/jobs/text", `{"hold_until":2,"content":"plain"}`, http.StatusNoContent, "")
+
+	j, err := s.store.Scan("q", "", "", s.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != "bin" || string(j.Content) != content {
+		t.Fatalf("stored job %s with content %q, want %q", j.ID, j.Content, content)
+	}
+
+	for _, want := range []httpJob{
+		{ID: "bin", ContentEncoding: "base64", Content: "//4gYmluYXJ5IAA="},
+		{ID: "text", Content: "plain"},
+	} {
+		var j httpJob
+		if code := c.do("POST", "/queues/q/reserve", "", &j); code != http.StatusOK {
+			t.Fatalf("reserve got %d", code)
+		}
+		if j.ID != want.ID || j.ContentEncoding != want.ContentEncoding || j.Content != want.Content {
+			t.Errorf("reserved %#v, want %#v", j, want)
+		}
+	}
+}
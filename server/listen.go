@@ -0,0 +1,82 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// listen opens a listener for an address written as a URL, like
+// udp6://[::]:2097, tcp://:2098, tls://:2099, unixgram:///run/jobserver.sock
+// or unix:///run/jobserver.sock. Datagram addresses get a PacketConn and stream
+// addresses get a Listener. An address without a scheme is UDP over IPv4,
+// since that's all there used to be.
+//
+// TLS listeners use tlsConfig, and can't be opened without it. Unix sockets
+// are given the file mode in mode. A socket left behind by a previous run is
+// removed first, but any other kind of file is left alone.
+func listen(addr string, mode os.FileMode, tlsConfig *tls.Config) (net.PacketConn, net.Listener, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp4://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+		pc, err := net.ListenPacket(u.Scheme, u.Host)
+		return pc, nil, err
+	case "tcp", "tcp4", "tcp6":
+		ln, err := net.Listen(u.Scheme, u.Host)
+		return nil, ln, err
+	case "tls":
+		if tlsConfig == nil {
+			return nil, nil, fmt.Errorf("no certificate to listen with for %q", addr)
+		}
+
+		ln, err := tls.Listen("tcp", u.Host, tlsConfig)
+		return nil, ln, err
+	case "unixgram", "unix":
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf("no socket path in %q", addr)
+		}
+
+		if fi, err := os.Lstat(u.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(u.Path); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var pc net.PacketConn
+		var ln net.Listener
+		if u.Scheme == "unixgram" {
+			pc, err = net.ListenPacket(u.Scheme, u.Path)
+		} else {
+			ln, err = net.Listen(u.Scheme, u.Path)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := os.Chmod(u.Path, mode); err != nil {
+			if pc != nil {
+				pc.Close()
+			}
+			if ln != nil {
+				ln.Close()
+			}
+
+			return nil, nil, err
+		}
+
+		return pc, ln, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown network %q in %q", u.Scheme, addr)
+	}
+}
@@ -0,0 +1,32 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"net"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func (s *Server) servePacket(conn net.PacketConn) error {
+	for {
+		s.log.Debug("waiting for incoming message")
+
+		b := make([]byte, protocol.MessageSize)
+		n, r, err := conn.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+
+		// a datagram from an unbound unix socket has no address to reply to
+		var send func(d []byte) error
+		if r != nil {
+			send = func(d []byte) error {
+				_, err := conn.WriteTo(d, r)
+
+				return err
+			}
+		}
+
+		// anything bigger than MessageSize would be truncated by the client
+		s.dispatch(b[0:n], r, 0, "", protocol.MessageSize, send)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+	"fknsrs.biz/p/jobserver/internal/store"
+)
+
+func TestPacketUnboundUnixgram(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "sockets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "server.sock"), Net: "unixgram"}
+
+	if err := s.Listen("unixgram://" + addr.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	// an unbound socket has no address, so the server can't reply to it
+	anon, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+
+	if _, err := anon.Write(protocol.Serialise(&protocol.JobMessage{Key: "k", ID: "j", Queue: "q", Content: "x"})); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.DialUnix("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write(protocol.Serialise(&protocol.PingMessage{Key: "k"})); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	b := make([]byte, protocol.MessageSize)
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("server stopped answering after a message from an unbound socket: %s", err.Error())
+	}
+
+	m, err := protocol.Parse(b[0:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*protocol.PingMessage); !ok {
+		t.Fatalf("got response %#v", m)
+	}
+
+	if _, err := s.store.Scan("", "", "", s.now()); err != store.ErrEmpty {
+		t.Fatalf("message from an unbound socket was handled, scan got %v", err)
+	}
+}
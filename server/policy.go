@@ -0,0 +1,165 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+// Operations that a policy can allow.
+const (
+	opPut     = "put"
+	opReserve = "reserve"
+	opDelete  = "delete"
+	opAdmin   = "admin"
+)
+
+// policy decides which clients can do what to which queues. A client is
+// identified by the common name of the certificate it connected over TLS with,
+// or else by the ID of the key its messages were sealed with. Clients that
+// don't authenticate, including everything that comes in over HTTP or the
+// beanstalkd protocol, have an empty identity.
+//
+// A policy file has one rule per line, made of an identity, a comma-separated
+// list of operations and a comma-separated list of queue patterns:
+//
+//	# identity  operations          queues
+//	team-a      put,reserve,delete  a.*
+//	reporting   reserve             a.reports,b.reports
+//	ops         admin               *
+//	-           put                 public.*
+//
+// An identity of "-" matches clients that don't authenticate, and "*" matches
+// every client. Queue patterns are matched with path.Match, and don't apply to
+// admin operations, which aren't about any one queue. Anything that no rule
+// allows is denied.
+type policy struct {
+	rules []policyRule
+}
+
+type policyRule struct {
+	identity string
+	ops      map[string]bool
+	queues   []string
+}
+
+func loadPolicy(file string) (*policy, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parsePolicy(fd)
+}
+
+func parsePolicy(r io.Reader) (*policy, error) {
+	var p policy
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		f := strings.Fields(l)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("policy line %d: expected identity, operations and queues", n)
+		}
+
+		r := policyRule{identity: f[0], ops: make(map[string]bool)}
+		if r.identity == "-" {
+			r.identity = ""
+		}
+
+		for _, op := range strings.Split(f[1], ",") {
+			switch op {
+			case opPut, opReserve, opDelete, opAdmin:
+				r.ops[op] = true
+			default:
+				return nil, fmt.Errorf("policy line %d: unknown operation %q", n, op)
+			}
+		}
+
+		for _, q := range strings.Split(f[2], ",") {
+			if _, err := path.Match(q, ""); err != nil {
+				return nil, fmt.Errorf("policy line %d: invalid queue pattern %q", n, q)
+			}
+
+			r.queues = append(r.queues, q)
+		}
+
+		p.rules = append(p.rules, r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// allows returns true if some rule lets identity do op to queue.
+func (p *policy) allows(identity, op, queue string) bool {
+	for _, r := range p.rules {
+		if r.identity != "*" && r.identity != identity {
+			continue
+		}
+		if !r.ops[op] {
+			continue
+		}
+		if op == opAdmin {
+			return true
+		}
+
+		for _, q := range r.queues {
+			if ok, _ := path.Match(q, queue); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// operation returns the operation a message needs, and the queue it needs it
+// for. Messages that anyone can send give an empty operation.
+//
+// Reading a queue's jobs or stats counts as reserving from it. Scanning or
+// getting the stats of every queue, purging a queue, and making backups are
+// admin operations.
+func operation(m protocol.Message) (string, string) {
+	switch m := m.(type) {
+	case *protocol.JobMessage:
+		return opPut, m.Queue
+	case *protocol.ReserveMessage:
+		return opReserve, m.Queue
+	case *protocol.PeekMessage:
+		return opReserve, m.Queue
+	case *protocol.ScanMessage:
+		if m.Queue == "" {
+			return opAdmin, ""
+		}
+		return opReserve, m.Queue
+	case *protocol.ReleaseMessage:
+		return opReserve, m.Queue
+	case *protocol.StatsMessage:
+		if m.Queue == "" {
+			return opAdmin, ""
+		}
+		return opReserve, m.Queue
+	case *protocol.DeleteMessage:
+		return opDelete, m.Queue
+	case *protocol.PurgeMessage:
+		return opAdmin, m.Queue
+	case *protocol.BackupMessage:
+		return opAdmin, ""
+	default:
+		return "", ""
+	}
+}
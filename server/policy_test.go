@@ -0,0 +1,103 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+const testPolicy = `
+# identity  operations          queues
+team-a      put,reserve,delete  a.*
+reporting   reserve             a.reports,b.reports
+ops         admin               *
+-           put                 public.*
+*           reserve             shared
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := parsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.rules) != 5 {
+		t.Fatalf("got %d rules, want 5", len(p.rules))
+	}
+
+	if p.rules[3].identity != "" {
+		t.Errorf("identity \"-\" was parsed as %q", p.rules[3].identity)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, s := range []string{
+		"team-a put",
+		"team-a put a.* extra",
+		"team-a publish a.*",
+		"team-a put a.[",
+	} {
+		if _, err := parsePolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("policy %q parsed without an error", s)
+		}
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	p, err := parsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		identity, op, queue string
+		want                bool
+	}{
+		{"team-a", opPut, "a.jobs", true},
+		{"team-a", opDelete, "a.jobs", true},
+		{"team-a", opPut, "b.jobs", false},
+		{"team-a", opAdmin, "", false},
+		{"reporting", opReserve, "b.reports", true},
+		{"reporting", opPut, "a.reports", false},
+		{"reporting", opReserve, "a.jobs", false},
+		{"ops", opAdmin, "", true},
+		{"ops", opAdmin, "a.jobs", true},
+		{"team-a", opAdmin, "a.jobs", false},
+		{"ops", opPut, "a.jobs", false},
+		{"", opPut, "public.x", true},
+		{"", opReserve, "public.x", false},
+		{"team-a", opPut, "public.x", false},
+		{"anyone", opReserve, "shared", true},
+		{"", opReserve, "shared", true},
+		{"anyone", opReserve, "shared.x", false},
+	} {
+		if got := p.allows(tc.identity, tc.op, tc.queue); got != tc.want {
+			t.Errorf("allows(%q, %q, %q) = %v, want %v", tc.identity, tc.op, tc.queue, got, tc.want)
+		}
+	}
+}
+
+func TestOperation(t *testing.T) {
+	for _, tc := range []struct {
+		m         protocol.Message
+		op, queue string
+	}{
+		{&protocol.JobMessage{Queue: "q"}, opPut, "q"},
+		{&protocol.ReserveMessage{Queue: "q"}, opReserve, "q"},
+		{&protocol.PeekMessage{Queue: "q"}, opReserve, "q"},
+		{&protocol.ScanMessage{Queue: "q"}, opReserve, "q"},
+		{&protocol.ScanMessage{}, opAdmin, ""},
+		{&protocol.StatsMessage{Queue: "q"}, opReserve, "q"},
+		{&protocol.StatsMessage{}, opAdmin, ""},
+		{&protocol.ReleaseMessage{Queue: "q"}, opReserve, "q"},
+		{&protocol.DeleteMessage{Queue: "q"}, opDelete, "q"},
+		{&protocol.PurgeMessage{Queue: "q"}, opAdmin, "q"},
+		{&protocol.BackupMessage{}, opAdmin, ""},
+		{&protocol.PingMessage{}, "", ""},
+	} {
+		if op, queue := operation(tc.m); op != tc.op || queue != tc.queue {
+			t.Errorf("operation(%T) = %q, %q, want %q, %q", tc.m, op, queue, tc.op, tc.queue)
+		}
+	}
+}
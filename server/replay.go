@@ -0,0 +1,96 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+// replayCache remembers the responses to recent requests. Clients send a
+// request again with the same key when they don't hear back in time, and if
+// it was only the response that got lost, running the request again would
+// do it twice; a reserve would hold a second job and orphan the first until
+// its TTR ran out. Instead, the original response is sent again.
+//
+// Requests are identified by where they came from and their key. The cache
+// holds at most size responses, each for ttl. Clients count on a response being
+// kept for that long before they send a request again, so when the cache is
+// full, new requests are turned away instead of making room.
+type replayCache struct {
+	m       sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+var errReplayFull = errors.New("too many recent requests to remember another")
+
+type replayEntry struct {
+	id       string
+	added    time.Time
+	response protocol.Message
+}
+
+func newReplayCache(size int, ttl time.Duration) *replayCache {
+	return &replayCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// start records that a request is about to be handled, and returns true. If
+// the request has been seen before, it returns false along with the response
+// to send again, which is nil if the request is still being handled. If
+// there's no room for the request, it returns errReplayFull, and the request
+// shouldn't be handled.
+func (c *replayCache) start(id string, now time.Time) (protocol.Message, bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for e := c.order.Front(); e != nil && now.Sub(e.Value.(*replayEntry).added) >= c.ttl; e = c.order.Front() {
+		c.remove(e)
+	}
+
+	if e, ok := c.entries[id]; ok {
+		return e.Value.(*replayEntry).response, false, nil
+	}
+
+	if c.order.Len() >= c.size {
+		return nil, false, errReplayFull
+	}
+
+	c.entries[id] = c.order.PushBack(&replayEntry{id: id, added: now})
+
+	return nil, true, nil
+}
+
+// finish records the response to a request.
+func (c *replayCache) finish(id string, res protocol.Message) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		e.Value.(*replayEntry).response = res
+	}
+}
+
+// forget removes a request, so that it can be tried again if it's sent again.
+func (c *replayCache) forget(id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *replayCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*replayEntry).id)
+}
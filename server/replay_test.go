@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := newReplayCache(2, time.Minute)
+
+	if _, ok, _ := c.start("a", now); !ok {
+		t.Fatal("new request wasn't started")
+	}
+
+	if res, ok, _ := c.start("a", now); ok || res != nil {
+		t.Fatalf("request being handled was started again, with response %#v", res)
+	}
+
+	res := &protocol.SuccessMessage{Key: "a"}
+	c.finish("a", res)
+
+	if r, ok, _ := c.start("a", now.Add(time.Second)); ok || r != res {
+		t.Fatalf("finished request wasn't replayed, got %#v", r)
+	}
+
+	if _, ok, _ := c.start("a", now.Add(time.Minute)); !ok {
+		t.Fatal("request was replayed after its ttl")
+	}
+}
+
+func TestReplayCacheForget(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := newReplayCache(10, time.Minute)
+
+	c.start("a", now)
+	c.forget("a")
+
+	if _, ok, _ := c.start("a", now); !ok {
+		t.Fatal("forgotten request wasn't started again")
+	}
+}
+
+func TestReplayCacheSize(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := newReplayCache(2, time.Minute)
+
+	for _, id := range []string{"a", "b"} {
+		if _, ok, err := c.start(id, now); !ok || err != nil {
+			t.Fatalf("request %s wasn't started: %v", id, err)
+		}
+		c.finish(id, &protocol.SuccessMessage{Key: id})
+	}
+
+	if _, ok, err := c.start("c", now); ok || err != errReplayFull {
+		t.Fatalf("request c was let into a full cache, got %v", err)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		if res, ok, _ := c.start(id, now.Add(time.Second*59)); ok || res == nil {
+			t.Fatalf("request %s was forgotten before its ttl", id)
+		}
+	}
+
+	if _, ok, err := c.start("c", now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("request c wasn't started once the others expired: %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+// Package server is the job server, in a form that can run inside other
+// programs. jobserverd is a thin wrapper around it.
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fknsrs.biz/p/jobserver/internal/keyring"
+	"fknsrs.biz/p/jobserver/internal/store"
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrServerClosed    = errors.New("server closed")
+	ErrBackupsDisabled = errors.New("backups are turned off")
+	ErrBadBackupPath   = errors.New("backup path has to be relative, can't contain .., and can't lead out of the backup directory")
+)
+
+// Store is where a server keeps its jobs. Stores come from the backends in
+// Backends.
+type Store = store.Store
+
+// Kinds of listener that a server can serve.
+const (
+	listenerPacket    = "packet"
+	listenerStream    = "stream"
+	listenerHTTP      = "http"
+	listenerBeanstalk = "beanstalk"
+)
+
+type listener struct {
+	kind string
+	pc   net.PacketConn
+	ln   net.Listener
+}
+
+func (l *listener) addr() net.Addr {
+	if l.pc != nil {
+		return l.pc.LocalAddr()
+	}
+
+	return l.ln.Addr()
+}
+
+func (l *listener) close() error {
+	if l.pc != nil {
+		return l.pc.Close()
+	}
+
+	return l.ln.Close()
+}
+
+// Server serves the jobs in a store to clients on any number of listeners.
+// It doesn't own the store, so closing the store is up to whoever opened it.
+type Server struct {
+	store     Store
+	log       *logrus.Logger
+	replay    *replayCache
+	auth      *auth
+	policy    *policy
+	putM      sync.Mutex
+	tls       *tls.Config
+	backupDir string
+	mode      os.FileMode
+	now       func() time.Time
+	seq       int64
+	active    int64
+	connSeq   uint64
+	beanstalk beanstalkHolds
+
+	m         sync.Mutex
+	listeners []*listener
+	conns     map[net.Conn]bool
+	http      *http.Server
+	errs      chan error
+	serving   bool
+	closed    chan struct{}
+}
+
+// New makes a server for the jobs in st. By default it logs to logrus's
+// standard logger, remembers the responses to up to 100000 requests for a
+// minute so that retries aren't run twice, and makes unix sockets with mode
+// 0660.
+func New(st Store) *Server {
+	s := Server{
+		store:  st,
+		log:    logrus.StandardLogger(),
+		replay: newReplayCache(100000, time.Minute),
+		mode:   0660,
+		now:    time.Now,
+		conns:  make(map[net.Conn]bool),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+
+	s.http = &http.Server{Handler: &s}
+
+	return &s
+}
+
+// SetLogger sets where the server logs to.
+func (s *Server) SetLogger(l *logrus.Logger) {
+	s.log = l
+}
+
+// SetReplay sets how many recent responses are kept for repeated requests,
+// and for how long. Requests that come in while size responses are being kept
+// are turned away, so size should be more than the number of requests that
+// the server gets in ttl. A size of zero turns replays off.
+func (s *Server) SetReplay(size int, ttl time.Duration) {
+	if size <= 0 {
+		s.replay = nil
+		return
+	}
+
+	s.replay = newReplayCache(size, ttl)
+}
+
+// SetAuthKeyFile makes the server only accept messages sealed with the keys in
+// the file at path, within window of the server's time, and seal responses
+// with them. This doesn't cover HTTP or beanstalkd listeners.
+func (s *Server) SetAuthKeyFile(path string, window time.Duration) error {
+	keys, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+
+	s.log.WithField("primary_key", keys.Primary()).Info("authenticating messages")
+
+	s.auth = newAuth(keys, window)
+
+	return nil
+}
+
+// SetPolicyFile makes the server only allow the requests that the rules in
+// the file at path allow.
+func (s *Server) SetPolicyFile(path string) error {
+	p, err := loadPolicy(path)
+	if err != nil {
+		return err
+	}
+
+	s.log.WithField("rules", len(p.rules)).Info("enforcing policy")
+
+	s.policy = p
+
+	return nil
+}
+
+// SetBackupDir lets clients make backups, into files in dir. The paths that
+// clients give are relative to dir, and can't lead out of it. Backups are off
+// until this is called.
+func (s *Server) SetBackupDir(dir string) {
+	s.backupDir = dir
+}
+
+// SetClock sets where the server gets the time from when it decides which
+// jobs are ready, and how long to hold them for. It's for tests that need
+// held jobs to become ready without waiting. Timeouts and logs still use the
+// real time.
+func (s *Server) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// SetTLSConfig sets the configuration for tls:// addresses given to Listen.
+// LoadTLSConfig makes one from files.
+func (s *Server) SetTLSConfig(c *tls.Config) {
+	s.tls = c
+}
+
+// SetSocketMode sets the file mode for unix sockets made by Listen.
+func (s *Server) SetSocketMode(mode os.FileMode) {
+	s.mode = mode
+}
+
+// Listen opens a listener for an address and serves clients on it. Addresses
+// are host:port for UDP over IPv4, or URLs like udp6://[::]:2097,
+// tcp://:2098, tls://:2099, unixgram:///run/jobserver.sock or
+// unix:///run/jobserver.sock.
+func (s *Server) Listen(addr string) error {
+	pc, ln, err := listen(addr, s.mode, s.tls)
+	if err != nil {
+		return err
+	}
+
+	if pc != nil {
+		s.add(&listener{kind: listenerPacket, pc: pc})
+	} else {
+		s.add(&listener{kind: listenerStream, ln: ln})
+	}
+
+	return nil
+}
+
+// AddPacketConn serves clients that send datagrams to pc.
+func (s *Server) AddPacketConn(pc net.PacketConn) {
+	s.add(&listener{kind: listenerPacket, pc: pc})
+}
+
+// AddListener serves clients that connect to ln and send framed messages.
+func (s *Server) AddListener(ln net.Listener) {
+	s.add(&listener{kind: listenerStream, ln: ln})
+}
+
+// AddHTTPListener serves the HTTP API on ln.
+func (s *Server) AddHTTPListener(ln net.Listener) {
+	s.add(&listener{kind: listenerHTTP, ln: ln})
+}
+
+// AddBeanstalkListener serves beanstalkd clients on ln.
+func (s *Server) AddBeanstalkListener(ln net.Listener) {
+	s.add(&listener{kind: listenerBeanstalk, ln: ln})
+}
+
+// add adds a listener, and starts serving it if the server is already
+// serving. Listeners added after the server's shut down are closed.
+func (s *Server) add(l *listener) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closing() {
+		l.close()
+		return
+	}
+
+	s.listeners = append(s.listeners, l)
+
+	if s.serving {
+		go s.serveListener(l)
+	}
+}
+
+// Addrs returns the addresses of every listener, in the order they were
+// added. It's how to find out which ports were picked for addresses like
+// 127.0.0.1:0.
+func (s *Server) Addrs() []net.Addr {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var l []net.Addr
+	for _, ln := range s.listeners {
+		l = append(l, ln.addr())
+	}
+
+	return l
+}
+
+// Serve serves clients on every listener until one of them fails, and
+// returns its error. After Shutdown, it returns ErrServerClosed.
+func (s *Server) Serve() error {
+	s.m.Lock()
+	if s.closing() {
+		s.m.Unlock()
+		return ErrServerClosed
+	}
+	s.serving = true
+	for _, l := range s.listeners {
+		go s.serveListener(l)
+	}
+	s.m.Unlock()
+
+	select {
+	case err := <-s.errs:
+		// listeners fail when they're closed, too
+		if s.closing() {
+			return ErrServerClosed
+		}
+
+		return err
+	case <-s.closed:
+		return ErrServerClosed
+	}
+}
+
+func (s *Server) serveListener(l *listener) {
+	var err error
+	switch l.kind {
+	case listenerPacket:
+		err = s.servePacket(l.pc)
+	case listenerStream:
+		err = s.serveStream(l.ln)
+	case listenerHTTP:
+		err = s.http.Serve(l.ln)
+	case listenerBeanstalk:
+		err = s.serveBeanstalk(l.ln)
+	}
+
+	select {
+	case <-s.closed:
+	case s.errs <- err:
+	default:
+	}
+}
+
+// Shutdown stops the server. It closes every listener, waits for the
+// requests that are being handled to finish, and then closes every
+// connection. If ctx is done first, the connections are closed straight away
+// and Shutdown returns ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	select {
+	case <-s.closed:
+		s.m.Unlock()
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	for _, l := range s.listeners {
+		l.close()
+	}
+	s.m.Unlock()
+
+	err := s.http.Shutdown(ctx)
+
+	// stream connections don't have a way to say that they're idle, so this
+	// watches the number of requests being handled, like net/http does
+	t := time.NewTicker(time.Millisecond * 10)
+	defer t.Stop()
+
+	for err == nil && atomic.LoadInt64(&s.active) > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	s.m.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+
+	return err
+}
+
+// closing returns true once Shutdown has been called.
+func (s *Server) closing() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// track keeps track of a connection, so that Shutdown can close it. It
+// returns false if the server's already shut down, and the connection should
+// be closed.
+func (s *Server) track(c net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closing() {
+		return false
+	}
+
+	s.conns[c] = true
+
+	return true
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.m.Lock()
+	delete(s.conns, c)
+	s.m.Unlock()
+}
@@ -0,0 +1,93 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func (s *Server) serveStream(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveStreamConn(c)
+	}
+}
+
+// serveStreamConn handles the framed messages on one connection. Each message
+// is handled in its own goroutine, and responses carry the key of their
+// request, so clients can have many requests in flight at once and a slow one
+// doesn't hold up the rest. Responses go out in whatever order they're ready.
+// A TLS client with a verified certificate is identified by it for every
+// message on the connection.
+func (s *Server) serveStreamConn(c net.Conn) {
+	defer c.Close()
+
+	if !s.track(c) {
+		return
+	}
+	defer s.untrack(c)
+
+	l := s.log.WithField("remote", c.RemoteAddr().String())
+
+	identity := ""
+	if tc, ok := c.(*tls.Conn); ok {
+		id, err := tlsIdentity(tc)
+		if err != nil {
+			l.WithField("error", err.Error()).Warn("tls handshake failed")
+			return
+		}
+
+		identity = id
+		l = l.WithField("identity", identity)
+	}
+
+	l.Debug("accepted connection")
+
+	conn := atomic.AddUint64(&s.connSeq, 1)
+
+	var m sync.Mutex
+	send := func(d []byte) error {
+		m.Lock()
+		defer m.Unlock()
+
+		return protocol.WriteFrame(c, d)
+	}
+
+	// the connection stays open until every response has gone out, even if
+	// the client's done sending
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	r := bufio.NewReader(c)
+	for {
+		d, err := protocol.ReadFrame(r)
+		if err != nil {
+			if err != io.EOF && !s.closing() {
+				l.WithField("error", err.Error()).Error("error reading frame")
+			}
+
+			break
+		}
+
+		// counted here rather than in dispatch, so that Shutdown can't miss
+		// a message that's been read but not started on yet
+		atomic.AddInt64(&s.active, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&s.active, -1)
+			s.dispatch(d, c.RemoteAddr(), conn, identity, protocol.MaxFrameSize, send)
+		}()
+	}
+
+	l.Debug("closed connection")
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+func TestStreamPipelining(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddListener(ln)
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const n = 50
+
+	// every request goes out before any response is read, and the client's
+	// done sending before the responses have all been sent
+	w := bufio.NewWriter(c)
+	for i := 0; i < n; i++ {
+		m := protocol.JobMessage{Key: fmt.Sprintf("k%d", i), ID: fmt.Sprintf("j%d", i), Queue: "q", Content: "x"}
+		if err := protocol.WriteFrame(w, protocol.Serialise(&m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]bool)
+	r := bufio.NewReader(c)
+	for i := 0; i < n; i++ {
+		d, err := protocol.ReadFrame(r)
+		if err != nil {
+			t.Fatalf("reading response %d: %s", i, err.Error())
+		}
+
+		m, err := protocol.Parse(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(*protocol.SuccessMessage); !ok {
+			t.Fatalf("got response %#v", m)
+		}
+
+		keys[m.GetKey()] = true
+	}
+
+	if len(keys) != n {
+		t.Fatalf("got responses to %d requests, want %d", len(keys), n)
+	}
+}
+
+func TestStreamReplayPerConnection(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "sockets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "server.sock")
+	if err := s.Listen("unix://" + path); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	for _, id := range []string{"a", "b"} {
+		res, err := s.handle(&protocol.JobMessage{Key: "k", ID: id, Queue: "q", HoldUntil: 1, Content: id}, "", s.log.WithField("test", t.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := res.(*protocol.SuccessMessage); !ok {
+			t.Fatalf("put got %#v", res)
+		}
+	}
+
+	// every client of a unix socket has the same empty address, so only the
+	// connection tells them apart
+	reserved := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err := protocol.WriteFrame(c, protocol.Serialise(&protocol.ReserveMessage{Key: "same", Queue: "q"})); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := protocol.ReadFrame(bufio.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := protocol.Parse(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j, ok := m.(*protocol.JobMessage)
+		if !ok {
+			t.Fatalf("reserve %d got %#v", i, m)
+		}
+
+		reserved[j.ID] = true
+	}
+
+	if len(reserved) != 2 {
+		t.Fatalf("two clients reserved %d jobs between them, so one got the other's response", len(reserved))
+	}
+}
@@ -0,0 +1,66 @@
+package server // import "fknsrs.biz/p/jobserver/server"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// LoadTLSConfig builds the configuration for TLS listeners. If caFile is set,
+// clients can present a certificate signed by one of the authorities in it,
+// and the certificate's common name is the client's identity. Clients without
+// a certificate can still connect, but have no identity.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		d, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(d) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return &c, nil
+}
+
+// handshakeTimeout is how long a client gets to finish the TLS handshake
+// once it's connected, so that clients that connect and then say nothing
+// don't tie up connections forever.
+var handshakeTimeout = time.Second * 10
+
+// tlsIdentity finishes the handshake on a TLS connection and returns the
+// common name of the client's verified certificate, if it has one.
+func tlsIdentity(c *tls.Conn) (string, error) {
+	if err := c.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+
+	if err := c.Handshake(); err != nil {
+		return "", err
+	}
+
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+
+	if s := c.ConnectionState(); len(s.VerifiedChains) > 0 {
+		return s.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,233 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoShards = errors.New("no shards")
+)
+
+// Shard keys decide how a Sharded client spreads jobs over its servers. With
+// ShardByQueue, every job in a queue is on the same server. With ShardByJob,
+// each job is on a server picked by its ID, so one big queue is spread over
+// all of them.
+const (
+	ShardByQueue = "queue"
+	ShardByJob   = "job"
+)
+
+// shardPoints is how many points each server gets on the hash ring. More
+// points spread the keys more evenly.
+const shardPoints = 64
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// Sharded spreads jobs over several servers, each with their own jobs, using
+// consistent hashing. Adding or removing a server only moves the keys that
+// hash near its points on the ring, rather than nearly all of them.
+//
+// Servers are placed on the ring by their addresses, so a server that moves
+// to a new address gets a different share of the keys.
+type Sharded struct {
+	addrs   []string
+	clients []*Client
+	ring    []ringPoint
+	by      string
+	next    uint32
+}
+
+// NewSharded makes a sharded client for the servers at addrs, spreading jobs
+// over them by the key in by. dial connects to each of them; if it's nil,
+// Dial is used.
+func NewSharded(addrs []string, by string, dial func(addr string) (*Client, error)) (*Sharded, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoShards
+	}
+
+	if by != ShardByQueue && by != ShardByJob {
+		return nil, fmt.Errorf("unknown shard key %q", by)
+	}
+
+	if dial == nil {
+		dial = Dial
+	}
+
+	s := Sharded{by: by}
+
+	for i, addr := range addrs {
+		c, err := dial(addr)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.addrs = append(s.addrs, addr)
+		s.clients = append(s.clients, c)
+
+		for p := 0; p < shardPoints; p++ {
+			s.ring = append(s.ring, ringPoint{
+				hash:  hashKey(addr + "#" + strconv.Itoa(p)),
+				shard: i,
+			})
+		}
+	}
+
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+
+	return &s, nil
+}
+
+// Close closes the connections to every server.
+func (s *Sharded) Close() error {
+	var err error
+	for _, c := range s.clients {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Shard returns the address of the server that owns a job.
+func (s *Sharded) Shard(queue, id string) string {
+	return s.addrs[s.shard(queue, id)]
+}
+
+// Client returns the client for the server at addr, or nil if it isn't one
+// of the shards. It's for anything that the sharded client doesn't do itself.
+func (s *Sharded) Client(addr string) *Client {
+	for i, a := range s.addrs {
+		if a == addr {
+			return s.clients[i]
+		}
+	}
+
+	return nil
+}
+
+// hashKey places a key on the ring. Like ketama, it uses the start of an MD5
+// hash, since faster hashes put similar keys like job-1 and job-2 close
+// together.
+func hashKey(key string) uint32 {
+	h := md5.Sum([]byte(key))
+
+	return binary.BigEndian.Uint32(h[0:4])
+}
+
+// shard returns the index of the server that owns a job.
+func (s *Sharded) shard(queue, id string) int {
+	key := queue
+	if s.by == ShardByJob {
+		key = id
+	}
+
+	h := hashKey(key)
+
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+
+	return s.ring[i].shard
+}
+
+// any calls fn for each server that might have jobs in a queue until it finds
+// one, which is only the queue's own server when sharding by queue. When
+// sharding by job, each call starts with the server after the one the last
+// call started with, so no server's jobs wait behind another's. A server that
+// fails doesn't stop the rest from being tried, and its error is only returned
+// if none of them have a job.
+func (s *Sharded) any(queue string, fn func(c *Client) (*Job, error)) (*Job, error) {
+	if s.by == ShardByQueue {
+		return fn(s.clients[s.shard(queue, "")])
+	}
+
+	start := int(atomic.AddUint32(&s.next, 1) % uint32(len(s.clients)))
+
+	var first error
+	for i := range s.clients {
+		j, err := fn(s.clients[(start+i)%len(s.clients)])
+		if err == nil {
+			return j, nil
+		} else if err != ErrNoJobs && first == nil {
+			first = err
+		}
+	}
+
+	if first != nil {
+		return nil, first
+	}
+
+	return nil, ErrNoJobs
+}
+
+func (s *Sharded) Put(queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return s.PutContext(context.Background(), queue, id, content, priority, holdUntil, ttr)
+}
+
+// PutContext is Put, but gives up when ctx is done.
+func (s *Sharded) PutContext(ctx context.Context, queue, id, content string, priority float64, holdUntil time.Time, ttr time.Duration) error {
+	return s.clients[s.shard(queue, id)].PutContext(ctx, queue, id, content, priority, holdUntil, ttr)
+}
+
+func (s *Sharded) PutJob(j *Job, conflict string) error {
+	return s.PutJobContext(context.Background(), j, conflict)
+}
+
+// PutJobContext is PutJob, but gives up when ctx is done.
+func (s *Sharded) PutJobContext(ctx context.Context, j *Job, conflict string) error {
+	return s.clients[s.shard(j.Queue, j.ID)].PutJobContext(ctx, j, conflict)
+}
+
+func (s *Sharded) Reserve(queue string) (*Job, error) {
+	return s.ReserveContext(context.Background(), queue)
+}
+
+// ReserveContext is Reserve, but gives up when ctx is done.
+func (s *Sharded) ReserveContext(ctx context.Context, queue string) (*Job, error) {
+	return s.any(queue, func(c *Client) (*Job, error) {
+		return c.ReserveContext(ctx, queue)
+	})
+}
+
+func (s *Sharded) Peek(queue string) (*Job, error) {
+	return s.PeekContext(context.Background(), queue)
+}
+
+// PeekContext is Peek, but gives up when ctx is done.
+func (s *Sharded) PeekContext(ctx context.Context, queue string) (*Job, error) {
+	return s.any(queue, func(c *Client) (*Job, error) {
+		return c.PeekContext(ctx, queue)
+	})
+}
+
+func (s *Sharded) Delete(queue, id string) error {
+	return s.DeleteContext(context.Background(), queue, id)
+}
+
+// DeleteContext is Delete, but gives up when ctx is done.
+func (s *Sharded) DeleteContext(ctx context.Context, queue, id string) error {
+	return s.clients[s.shard(queue, id)].DeleteContext(ctx, queue, id)
+}
+
+func (s *Sharded) Release(queue, id string, priority float64, holdUntil time.Time) error {
+	return s.ReleaseContext(context.Background(), queue, id, priority, holdUntil)
+}
+
+// ReleaseContext is Release, but gives up when ctx is done.
+func (s *Sharded) ReleaseContext(ctx context.Context, queue, id string, priority float64, holdUntil time.Time) error {
+	return s.clients[s.shard(queue, id)].ReleaseContext(ctx, queue, id, priority, holdUntil)
+}
@@ -0,0 +1,173 @@
+package jobserver_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+func TestShardedSkipsFailedShards(t *testing.T) {
+	up, down := jobservertest.New(t), jobservertest.New(t)
+
+	s, err := jobserver.NewSharded([]string{up.TCPAddr, down.TCPAddr}, jobserver.ShardByJob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	down.Close()
+
+	for _, id := range []string{"a", "b"} {
+		if err := up.Client().Put("q", id, id, 0, up.Now(), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	up.Advance(time.Second)
+
+	// each reserve starts with a different shard, so one of them starts with
+	// the one that's down
+	for i := 0; i < 2; i++ {
+		if _, err := s.Reserve("q"); err != nil {
+			t.Fatalf("reserve %d failed with a shard down: %s", i, err.Error())
+		}
+	}
+
+	if _, err := s.Reserve("q"); err == nil || err == jobserver.ErrNoJobs {
+		t.Fatalf("reserve with no jobs and a shard down got %v, want its error", err)
+	}
+}
+
+// shardServers starts n servers, and returns them by their TCP addresses
+// along with the addresses in the order they were started.
+func shardServers(t *testing.T, n int) (map[string]*jobservertest.Server, []string) {
+	servers := make(map[string]*jobservertest.Server)
+	var addrs []string
+	for i := 0; i < n; i++ {
+		srv := jobservertest.New(t)
+		servers[srv.TCPAddr] = srv
+		addrs = append(addrs, srv.TCPAddr)
+	}
+
+	return servers, addrs
+}
+
+func TestShardedRouting(t *testing.T) {
+	for _, by := range []string{jobserver.ShardByQueue, jobserver.ShardByJob} {
+		t.Run(by, func(t *testing.T) {
+			servers, addrs := shardServers(t, 3)
+
+			s, err := jobserver.NewSharded(addrs, by, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			past := time.Now().Add(-time.Minute)
+
+			// the jobs each server should have, by queue
+			want := make(map[string]map[string][]string)
+			for _, addr := range addrs {
+				want[addr] = make(map[string][]string)
+			}
+
+			queues := []string{"a", "b", "c", "d", "e", "f"}
+			for i := 0; i < 30; i++ {
+				q, id := queues[i%len(queues)], fmt.Sprintf("job-%d", i)
+				if err := s.Put(q, id, id, 0, past, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+
+				owner := s.Shard(q, id)
+				want[owner][q] = append(want[owner][q], id)
+			}
+
+			used := 0
+			for addr, srv := range servers {
+				if len(want[addr]) > 0 {
+					used++
+				}
+				for _, q := range queues {
+					srv.AssertJobs(q, want[addr][q]...)
+				}
+			}
+			if used < 2 {
+				t.Fatalf("every job went to one of %d servers", len(servers))
+			}
+
+			for _, q := range queues {
+				j, err := s.Reserve(q)
+				if err != nil {
+					t.Fatalf("reserving from %s: %v", q, err)
+				}
+
+				owner := servers[s.Shard(q, j.ID)]
+				if by == jobserver.ShardByQueue && owner.TCPAddr != s.Shard(q, "") {
+					t.Fatalf("reserved job %s from queue %s on %s, want %s", j.ID, q, owner.TCPAddr, s.Shard(q, ""))
+				}
+				owner.AssertHeld(q, j.ID)
+
+				if err := s.Release(q, j.ID, 0, past); err != nil {
+					t.Fatalf("releasing job %s: %v", j.ID, err)
+				}
+				owner.AssertHeld(q)
+
+				if err := s.Delete(q, j.ID); err != nil {
+					t.Fatalf("deleting job %s: %v", j.ID, err)
+				}
+
+				var rest []string
+				for _, id := range want[owner.TCPAddr][q] {
+					if id != j.ID {
+						rest = append(rest, id)
+					}
+				}
+				want[owner.TCPAddr][q] = rest
+				owner.AssertJobs(q, rest...)
+			}
+		})
+	}
+}
+
+func TestShardedRingMovesFewKeys(t *testing.T) {
+	srv := jobservertest.New(t)
+	dial := func(string) (*jobserver.Client, error) { return jobserver.Dial(srv.Addr) }
+
+	var addrs []string
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d:7000", i+1))
+	}
+
+	before, err := jobserver.NewSharded(addrs, jobserver.ShardByJob, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+
+	added := "10.0.0.100:7000"
+	after, err := jobserver.NewSharded(append(addrs, added), jobserver.ShardByJob, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+
+	const keys = 10000
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		id := fmt.Sprintf("job-%d", i)
+		if a, b := before.Shard("q", id), after.Shard("q", id); a != b {
+			if b != added {
+				t.Fatalf("job %s moved from %s to %s, not to the new server", id, a, b)
+			}
+			moved++
+		}
+	}
+
+	// the new server should get about 1/11 of the keys, which is 909
+	if want := keys / (len(addrs) + 1); moved < want/2 || moved > want*2 {
+		t.Fatalf("adding a server moved %d of %d keys, want about %d", moved, keys, want)
+	}
+}
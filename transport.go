@@ -0,0 +1,154 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"fknsrs.biz/p/jobserver/internal/protocol"
+)
+
+var (
+	ErrTooLarge = errors.New("message too large")
+)
+
+// transport carries serialised messages between a client and the server.
+type transport interface {
+	// send fails with ErrTooLarge for messages that the transport can't
+	// carry, and with any other error if the connection's broken.
+	send(d []byte) error
+	recv() ([]byte, error)
+	// resend reports whether a request should be sent again when it times
+	// out, which is only worth doing if the transport can lose messages.
+	resend() bool
+	// limit is the largest message the server will take over the transport.
+	limit(info *ServerInfo) int
+	close() error
+}
+
+// dialTransport connects to a server over any of the networks that it can
+// listen on.
+func dialTransport(network, address string) (transport, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		c, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &packetTransport{conn: c}, nil
+	case "unixgram":
+		// the server can only send responses back to a socket with a name
+		d := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, d); err != nil {
+			return nil, err
+		}
+		local := filepath.Join(os.TempDir(), "jobserver-"+hex.EncodeToString(d)+".sock")
+
+		c, err := net.DialUnix(network, &net.UnixAddr{Name: local, Net: network}, &net.UnixAddr{Name: address, Net: network})
+		if err != nil {
+			return nil, err
+		}
+
+		return &packetTransport{conn: c, path: local}, nil
+	case "tcp", "tcp4", "tcp6", "unix":
+		c, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &streamTransport{conn: c, r: bufio.NewReader(c)}, nil
+	case "tls":
+		return dialTLSTransport(address, nil)
+	default:
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+}
+
+// dialTLSTransport connects to a TLS listener. A nil config checks the
+// server's certificate against the system's authorities, and doesn't send a
+// client certificate.
+func dialTLSTransport(address string, config *tls.Config) (transport, error) {
+	c, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamTransport{conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type packetTransport struct {
+	conn net.Conn
+	// path is the client's own socket, for unixgram
+	path string
+}
+
+func (t *packetTransport) send(d []byte) error {
+	if len(d) > protocol.MessageSize {
+		return ErrTooLarge
+	}
+
+	_, err := t.conn.Write(d)
+
+	return err
+}
+
+func (t *packetTransport) recv() ([]byte, error) {
+	d := make([]byte, protocol.MessageSize)
+
+	n, err := t.conn.Read(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d[0:n], nil
+}
+
+func (t *packetTransport) resend() bool { return true }
+
+func (t *packetTransport) limit(info *ServerInfo) int { return info.MaxMessageSize }
+
+func (t *packetTransport) close() error {
+	if t.path != "" {
+		defer os.Remove(t.path)
+	}
+
+	return t.conn.Close()
+}
+
+type streamTransport struct {
+	m    sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (t *streamTransport) send(d []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if err := protocol.WriteFrame(t.conn, d); err == protocol.ErrFrameTooLarge {
+		return ErrTooLarge
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *streamTransport) recv() ([]byte, error) {
+	return protocol.ReadFrame(t.r)
+}
+
+func (t *streamTransport) resend() bool { return false }
+
+func (t *streamTransport) limit(info *ServerInfo) int { return info.MaxFrameSize }
+
+func (t *streamTransport) close() error { return t.conn.Close() }
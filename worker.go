@@ -0,0 +1,315 @@
+package jobserver // import "fknsrs.biz/p/jobserver"
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Handler does the work for a job. If it returns nil, the job is deleted. If
+// it returns an error made with Bury, the job is moved to the bury queue, and
+// any other error puts the job back to be tried again later.
+//
+// ctx is done if the worker loses the job, because it couldn't be held any
+// longer or was deleted by someone else, or if the worker gives up waiting
+// for it while shutting down.
+type Handler interface {
+	Handle(ctx context.Context, j *Job) error
+}
+
+// HandlerFunc lets a plain function be a Handler.
+type HandlerFunc func(ctx context.Context, j *Job) error
+
+func (fn HandlerFunc) Handle(ctx context.Context, j *Job) error {
+	return fn(ctx, j)
+}
+
+type buryError struct {
+	err error
+}
+
+func (e *buryError) Error() string { return e.err.Error() }
+
+// Bury wraps an error returned by a Handler to say that the job shouldn't be
+// tried again.
+func Bury(err error) error {
+	return &buryError{err: err}
+}
+
+// PanicError is the error for a job whose handler panicked. The job is tried
+// again later, the same as if the handler had returned an error.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// Worker reserves jobs from a set of queues and runs a handler for each one.
+// Jobs are held for as long as their handlers take, by holding them for
+// another TTR every half of their TTR.
+type Worker struct {
+	c            *Client
+	handlers     map[string]Handler
+	queues       []string
+	concurrency  int
+	pollInterval time.Duration
+	retryDelay   time.Duration
+	drainTimeout time.Duration
+	burySuffix   string
+	onError      func(j *Job, err error)
+}
+
+// NewWorker makes a worker that uses c. By default it runs one job at a time,
+// looks for jobs every second when there aren't any, tries failed jobs again
+// after 10 seconds and buries jobs in a queue named after the original with
+// ".buried" on the end.
+func NewWorker(c *Client) *Worker {
+	return &Worker{
+		c:            c,
+		handlers:     make(map[string]Handler),
+		concurrency:  1,
+		pollInterval: time.Second,
+		retryDelay:   time.Second * 10,
+		burySuffix:   ".buried",
+	}
+}
+
+// Handle sets the handler for the jobs in a queue.
+func (w *Worker) Handle(queue string, h Handler) {
+	if _, ok := w.handlers[queue]; !ok {
+		w.queues = append(w.queues, queue)
+		sort.Strings(w.queues)
+	}
+
+	w.handlers[queue] = h
+}
+
+// HandleFunc sets a function as the handler for the jobs in a queue.
+func (w *Worker) HandleFunc(queue string, fn func(ctx context.Context, j *Job) error) {
+	w.Handle(queue, HandlerFunc(fn))
+}
+
+// SetConcurrency sets how many jobs can be worked on at once.
+func (w *Worker) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	w.concurrency = n
+}
+
+// SetPollInterval sets how long to wait before looking again when none of
+// the queues have any jobs ready.
+func (w *Worker) SetPollInterval(d time.Duration) {
+	w.pollInterval = d
+}
+
+// SetRetryDelay sets how long a job is held for after its handler fails.
+func (w *Worker) SetRetryDelay(d time.Duration) {
+	w.retryDelay = d
+}
+
+// SetDrainTimeout sets how long Run waits for jobs that are being worked on
+// once it's been told to stop. After that, their handlers' contexts are
+// cancelled. Zero means waiting as long as it takes, which is the default.
+func (w *Worker) SetDrainTimeout(d time.Duration) {
+	w.drainTimeout = d
+}
+
+// SetBurySuffix sets what's added to a queue's name to get the name of the
+// queue its buried jobs go to.
+func (w *Worker) SetBurySuffix(s string) {
+	w.burySuffix = s
+}
+
+// SetErrorHandler sets a function to call with everything that goes wrong:
+// handlers that fail or panic, and requests to the server that fail. j is nil
+// for errors that aren't about a particular job.
+func (w *Worker) SetErrorHandler(fn func(j *Job, err error)) {
+	w.onError = fn
+}
+
+func (w *Worker) error(j *Job, err error) {
+	if w.onError != nil {
+		w.onError(j, err)
+	}
+}
+
+// Run works on jobs until ctx is done, and then waits for the jobs that are
+// still being worked on before returning nil. If the client stops working for
+// good, Run stops the same way and returns the client's error.
+func (w *Worker) Run(ctx context.Context) error {
+	// handlers get their own context, so that they can finish what they're
+	// doing after ctx is done
+	hctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.loop(ctx, hctx, i)
+		}(i)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		if w.drainTimeout > 0 {
+			select {
+			case <-drained:
+			case <-time.After(w.drainTimeout):
+				cancel()
+			}
+		}
+
+		<-drained
+	}
+
+	if err := w.c.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loop is what each of the worker's goroutines does. They each start looking
+// for jobs at a different queue, so that one busy queue doesn't starve the
+// rest.
+func (w *Worker) loop(ctx, hctx context.Context, n int) {
+	for ctx.Err() == nil && w.c.Err() == nil {
+		j := w.reserve(ctx, n)
+		if j == nil {
+			select {
+			case <-time.After(w.pollInterval):
+			case <-ctx.Done():
+			}
+
+			continue
+		}
+
+		n++
+
+		w.work(hctx, j)
+	}
+}
+
+// reserve reserves a job from the first queue that has one, starting with the
+// nth queue.
+func (w *Worker) reserve(ctx context.Context, n int) *Job {
+	for i := range w.queues {
+		q := w.queues[(n+i)%len(w.queues)]
+
+		j, err := w.c.ReserveContext(ctx, q)
+		switch err {
+		case nil:
+			return j
+		case ErrNoJobs:
+		default:
+			if ctx.Err() == nil {
+				w.error(nil, err)
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// work runs the handler for a job, keeping the job held while it runs, and
+// then deletes, releases or buries the job depending on how it went.
+func (w *Worker) work(ctx context.Context, j *Job) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.heartbeat(j, done, cancel)
+	}()
+
+	err := w.call(ctx, j)
+
+	close(done)
+	<-stopped
+
+	switch err := err.(type) {
+	case nil:
+		if err := w.c.Delete(j.Queue, j.ID); err != nil {
+			w.error(j, err)
+		}
+	case *buryError:
+		w.error(j, err.err)
+
+		// job IDs are unique across queues, so replacing the job moves it
+		b := *j
+		b.Queue = j.Queue + w.burySuffix
+		b.HoldUntil = time.Now()
+
+		if err := w.c.PutJob(&b, ConflictReplace); err != nil {
+			w.error(j, err)
+		}
+	default:
+		w.error(j, err)
+
+		if err := w.c.Release(j.Queue, j.ID, j.Priority, time.Now().Add(w.retryDelay)); err != nil {
+			w.error(j, err)
+		}
+	}
+}
+
+// call runs a job's handler, turning a panic into an error.
+func (w *Worker) call(ctx context.Context, j *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return w.handlers[j.Queue].Handle(ctx, j)
+}
+
+// heartbeat holds a job for another TTR every half of its TTR, until done is
+// closed. If the job can't be held, lost is called. Servers hold jobs to the
+// second, so even a job with a TTR of a second is held for longer than it
+// takes for the next heartbeat.
+func (w *Worker) heartbeat(j *Job, done chan struct{}, lost func()) {
+	if j.TTR <= 0 {
+		return
+	}
+
+	t := time.NewTicker(j.TTR / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		err := w.c.Release(j.Queue, j.ID, j.Priority, time.Now().Add(j.TTR))
+		if err == ErrNotFound {
+			w.error(j, err)
+			lost()
+			return
+		} else if err != nil {
+			w.error(j, err)
+		}
+	}
+}
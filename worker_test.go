@@ -0,0 +1,178 @@
+package jobserver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fknsrs.biz/p/jobserver"
+	"fknsrs.biz/p/jobserver/jobservertest"
+)
+
+// startWorker runs a worker with a handler for queue q, and returns a channel
+// that gets every error the worker reports, along with a function that stops
+// it and waits for it to finish.
+func startWorker(t *testing.T, s *jobservertest.Server, fn func(ctx context.Context, j *jobserver.Job) error) (chan error, func()) {
+	c, err := jobserver.Dial(s.TCPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+
+	w := jobserver.NewWorker(c)
+	w.SetPollInterval(time.Millisecond * 10)
+	w.SetErrorHandler(func(j *jobserver.Job, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	w.HandleFunc("q", fn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx)
+	}()
+
+	return errs, func() {
+		cancel()
+		<-done
+		c.Close()
+	}
+}
+
+// putReady puts a job that's ready straight away, without moving the server's
+// clock, which the worker doesn't know about.
+func putReady(t *testing.T, s *jobservertest.Server, id string, ttr time.Duration) {
+	if err := s.Client().Put("q", id, id, 0, s.Now().Add(-time.Second*2), ttr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually fails the test if fn doesn't return true within a few seconds.
+func eventually(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second * 5); !fn(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestWorkerSuccess(t *testing.T) {
+	s := jobservertest.New(t)
+
+	ran := make(chan string, 1)
+	_, stop := startWorker(t, s, func(ctx context.Context, j *jobserver.Job) error {
+		ran <- j.Content
+		return nil
+	})
+	defer stop()
+
+	putReady(t, s, "a", time.Minute)
+
+	if c := <-ran; c != "a" {
+		t.Fatalf("handler got content %q", c)
+	}
+
+	eventually(t, "the job to be deleted", func() bool { return len(s.Jobs("q", "")) == 0 })
+}
+
+func TestWorkerFailure(t *testing.T) {
+	s := jobservertest.New(t)
+
+	failure := errors.New("failed")
+	errs, stop := startWorker(t, s, func(ctx context.Context, j *jobserver.Job) error {
+		return failure
+	})
+	defer stop()
+
+	putReady(t, s, "a", time.Minute)
+
+	if err := <-errs; err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+
+	// released to be tried again after the retry delay
+	eventually(t, "the job to be released", func() bool {
+		l := s.Jobs("q", jobserver.StateHeld)
+		return len(l) == 1 && l[0].HoldUntil.After(time.Now().Add(time.Second*5))
+	})
+}
+
+func TestWorkerBury(t *testing.T) {
+	s := jobservertest.New(t)
+
+	failure := errors.New("hopeless")
+	errs, stop := startWorker(t, s, func(ctx context.Context, j *jobserver.Job) error {
+		return jobserver.Bury(failure)
+	})
+	defer stop()
+
+	putReady(t, s, "a", time.Minute)
+
+	if err := <-errs; err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+
+	eventually(t, "the job to be buried", func() bool {
+		return len(s.Jobs("q", "")) == 0 && len(s.Jobs("q.buried", "")) == 1
+	})
+	s.AssertContent("q.buried", "a", "a")
+}
+
+func TestWorkerPanic(t *testing.T) {
+	s := jobservertest.New(t)
+
+	errs, stop := startWorker(t, s, func(ctx context.Context, j *jobserver.Job) error {
+		panic("oh no")
+	})
+	defer stop()
+
+	putReady(t, s, "a", time.Minute)
+
+	err := <-errs
+	if p, ok := err.(*jobserver.PanicError); !ok || p.Value != "oh no" || len(p.Stack) == 0 {
+		t.Fatalf("got error %#v, want a PanicError", err)
+	}
+
+	eventually(t, "the job to be released", func() bool { return len(s.Jobs("q", jobserver.StateHeld)) == 1 })
+	s.AssertJobs("q", "a")
+}
+
+func TestWorkerHeartbeat(t *testing.T) {
+	s := jobservertest.New(t)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	_, stop := startWorker(t, s, func(ctx context.Context, j *jobserver.Job) error {
+		close(started)
+
+		select {
+		case <-finish:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	defer stop()
+
+	// without heartbeats, a job with a TTR of a second is ready again within
+	// two seconds of being reserved
+	putReady(t, s, "a", time.Second)
+
+	<-started
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(time.Millisecond * 500)
+		s.AssertReady("q")
+	}
+
+	close(finish)
+
+	eventually(t, "the job to be deleted", func() bool { return len(s.Jobs("q", "")) == 0 })
+}